@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// ArchiveConfig limits uploaded archives that are extracted into separate files
+type ArchiveConfig struct {
+	// entries of any kind, directories included
+	MaxEntries int64
+	// total size of extracted files
+	MaxExtractedSize int64
+}
+
+// ExtractedFile is a file created from an archive entry
+type ExtractedFile struct {
+	FileId string `json:"fileId"`
+	Path   string `json:"path"`
+}
+
+type ExtractResult struct {
+	Files []ExtractedFile `json:"files"`
+}
+
+// archiveEntry is a file with its path inside the archive
+type archiveEntry struct {
+	name     string
+	metadata models.FileMetadata
+}
+
+// archiveWriter writes entries of a zip or tar.gz archive one by one
+type archiveWriter interface {
+	writeEntry(name string, modified time.Time, data []byte) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zipWriter *zip.Writer
+}
+
+func (w zipArchiveWriter) writeEntry(name string, modified time.Time, data []byte) error {
+	entryWriter, err := w.zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = entryWriter.Write(data)
+	return err
+}
+
+func (w zipArchiveWriter) Close() error {
+	return w.zipWriter.Close()
+}
+
+type tarArchiveWriter struct {
+	gzipWriter *gzip.Writer
+	tarWriter  *tar.Writer
+}
+
+func (w tarArchiveWriter) writeEntry(name string, modified time.Time, data []byte) error {
+	err := w.tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.tarWriter.Write(data)
+	return err
+}
+
+func (w tarArchiveWriter) Close() error {
+	err := w.tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	return w.gzipWriter.Close()
+}
+
+func newArchiveWriter(format string, writer io.Writer) archiveWriter {
+	if format == ArchiveTarGz {
+		gzipWriter := gzip.NewWriter(writer)
+		return tarArchiveWriter{gzipWriter: gzipWriter, tarWriter: tar.NewWriter(gzipWriter)}
+	}
+	return zipArchiveWriter{zipWriter: zip.NewWriter(writer)}
+}
+
+// entryName makes a file name safe for archives and unique among names already used
+func entryName(dir string, metadata models.FileMetadata, used map[string]bool) string {
+	filename := strings.NewReplacer("/", "_", `\`, "_").Replace(metadata.Filename)
+	if filename == "" || filename == "." || filename == ".." {
+		filename = metadata.FileId
+	}
+	name := path.Join(dir, filename+metadata.Extension)
+	for i := 2; used[name]; i++ {
+		name = path.Join(dir, fmt.Sprintf("%s (%d)%s", filename, i, metadata.Extension))
+	}
+	used[name] = true
+	return name
+}
+
+// folderEntries returns files of a folder and all its subfolders with paths relative to the folder
+func (app *App) folderEntries(folderId string, dir string, used map[string]bool) ([]archiveEntry, error) {
+	files, err := app.folderFiles(folderId, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	var entries []archiveEntry
+	for _, metadata := range files.Items {
+		entries = append(entries, archiveEntry{name: entryName(dir, metadata, used), metadata: metadata})
+	}
+	folders, err := app.Backend.GetFolders(folderId)
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		subfolderEntries, err := app.folderEntries(folder.FolderId, path.Join(dir, folder.Name), used)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, subfolderEntries...)
+	}
+	return entries, nil
+}
+
+// archiveEntries selects files by "fileId" parameters, a whole folder tree with recursive=true
+// or the same filters as GET /files
+func (app *App) archiveEntries(request *http.Request) ([]archiveEntry, error) {
+	values := request.URL.Query()
+	used := map[string]bool{}
+	var entries []archiveEntry
+
+	if fileIds := values["fileId"]; len(fileIds) > 0 {
+		for _, fileId := range fileIds {
+			metadata, err := app.Backend.GetFileMetadata(fileId)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, archiveEntry{name: entryName("", metadata, used), metadata: metadata})
+		}
+		return entries, nil
+	}
+
+	if values.Get("recursive") == "true" {
+		folderId := folderIdFromUrl(values.Get("folderId"))
+		_, err := app.getFolder(folderId)
+		if err != nil {
+			return nil, err
+		}
+		return app.folderEntries(folderId, "", used)
+	}
+
+	query, err := readFilesQuery(request)
+	if err != nil {
+		return nil, err
+	}
+	query.Page, query.PageSize, query.SkipCount = 1, maxFilesPerPage, true
+	for {
+		result, err := app.Backend.GetAllFiles(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range result.Items {
+			entries = append(entries, archiveEntry{name: entryName("", metadata, used), metadata: metadata})
+		}
+		if result.NextCursor == "" {
+			return entries, nil
+		}
+		query.After, err = backends.ParseCursor(result.NextCursor, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeFile returns original content of a stored file
+func (app *App) decodeFile(result backends.GetFileResult, customerKey []byte) ([]byte, error) {
+	data, err := app.decryptFile(result, customerKey)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data, result.Metadata.Compression)
+}
+
+// GetArchiveHandler streams selected files as a zip or tar.gz archive, files are read
+// one at a time so only the current file is kept in memory
+func (app *App) GetArchiveHandler(writer http.ResponseWriter, request *http.Request) {
+	format := request.URL.Query().Get("format")
+	if format == "" {
+		format = ArchiveZip
+	}
+	if format != ArchiveZip && format != ArchiveTarGz {
+		utils.WriteResponseStatusCode(models.Error{Detail: "expected zip or tar.gz for format"}, http.StatusBadRequest, writer)
+		return
+	}
+	customerKey, err := readCustomerKey(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	entries, err := app.archiveEntries(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	// errors can not be reported once streaming has started, so keys are checked upfront
+	for _, entry := range entries {
+		_, err = app.dataKey(entry.metadata, customerKey)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+
+	contentType := "application/zip"
+	if format == ArchiveTarGz {
+		contentType = "application/gzip"
+	}
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "files."+format))
+	archive := newArchiveWriter(format, writer)
+	for _, entry := range entries {
+		result, err := app.Backend.GetFile(entry.metadata.FileId)
+		var data []byte
+		if err == nil {
+			data, err = app.decodeFile(result, customerKey)
+		}
+		if err == nil {
+			err = archive.writeEntry(entry.name, time.Unix(result.Metadata.UpdatedAt, 0), data)
+		}
+		if err != nil {
+			// truncated archive tells the client that the download failed
+			log.Printf("Failed to archive file %s: %v", entry.metadata.FileId, err)
+			return
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		log.Printf("Failed to finish archive: %v", err)
+	}
+}
+
+func invalidArchiveError(detail string) error {
+	return &backends.FileServerError{Code: http.StatusBadRequest, Detail: detail}
+}
+
+// walkArchive calls fn for every entry of a zip, tar or tar.gz archive in archive order,
+// content is nil for entries other than regular files
+func walkArchive(data []byte, fn func(name string, mode fs.FileMode, content io.Reader) error) error {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return invalidArchiveError(fmt.Sprintf("invalid zip archive: %v", err))
+		}
+		for _, file := range zipReader.File {
+			if !file.Mode().IsRegular() {
+				err = fn(file.Name, file.Mode(), nil)
+			} else {
+				var content io.ReadCloser
+				content, err = file.Open()
+				if err != nil {
+					return invalidArchiveError(fmt.Sprintf("invalid zip entry %s: %v", file.Name, err))
+				}
+				err = fn(file.Name, file.Mode(), content)
+				content.Close()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var reader io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return invalidArchiveError(fmt.Sprintf("invalid gzip archive: %v", err))
+		}
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidArchiveError("unsupported archive, expected zip, tar or tar.gz")
+		}
+		mode := header.FileInfo().Mode()
+		if mode.IsRegular() {
+			err = fn(header.Name, mode, tarReader)
+		} else {
+			err = fn(header.Name, mode, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archivePath splits an entry name into path segments, names escaping
+// the target folder are rejected
+func archivePath(name string) ([]string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return nil, invalidArchiveError(fmt.Sprintf("absolute path in archive: %s", name))
+	}
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return nil, invalidArchiveError(fmt.Sprintf("path outside of the archive: %s", name))
+		}
+		err := validateFolderName(segment)
+		if err != nil {
+			return nil, invalidArchiveError(fmt.Sprintf("invalid path in archive: %s", name))
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// checkArchive validates paths of all entries and counts the real size of extracted
+// files, so nothing is stored from an archive that breaks the limits
+func (app *App) checkArchive(data []byte) error {
+	var entries, extracted int64
+	limits := app.Config.Archive
+	return walkArchive(data, func(name string, mode fs.FileMode, content io.Reader) error {
+		entries++
+		if limits.MaxEntries > 0 && entries > limits.MaxEntries {
+			return &backends.FileServerError{
+				Code:   http.StatusRequestEntityTooLarge,
+				Detail: fmt.Sprintf("archive has more than %d entries", limits.MaxEntries),
+			}
+		}
+		_, err := archivePath(name)
+		if err != nil || content == nil {
+			return err
+		}
+		// sizes in headers can lie, content is read up to the remaining limit
+		reader := content
+		if limits.MaxExtractedSize > 0 {
+			reader = io.LimitReader(content, limits.MaxExtractedSize-extracted+1)
+		}
+		size, err := io.Copy(io.Discard, reader)
+		if err != nil {
+			return invalidArchiveError(fmt.Sprintf("invalid archive entry %s: %v", name, err))
+		}
+		extracted += size
+		if limits.MaxExtractedSize > 0 && extracted > limits.MaxExtractedSize {
+			return &backends.FileServerError{
+				Code:   http.StatusRequestEntityTooLarge,
+				Detail: fmt.Sprintf("extracted files exceed %d bytes", limits.MaxExtractedSize),
+			}
+		}
+		return nil
+	})
+}
+
+// extractArchive stores every file of an uploaded archive as a separate file,
+// directories of the archive become folders inside the upload folder.
+// Files stored before a failure are purged
+func (app *App) extractArchive(request *http.Request, chunk utils.ChunkResult, customerKey []byte) (ExtractResult, error) {
+	result := ExtractResult{Files: []ExtractedFile{}}
+	if chunk.ChunkNumber != 1 || !chunk.IsLastChunk {
+		return result, invalidArchiveError("archives are extracted only from single chunk uploads")
+	}
+	data := utils.ReadChunkBytes(chunk)
+	err := app.checkArchive(data)
+	if err != nil {
+		return result, err
+	}
+	template := utils.ReadJsonData[models.FileMetadata](chunk.JsonData)
+	baseId, err := app.uploadFolder(request)
+	if err != nil {
+		return result, err
+	}
+
+	var reserved reservation
+	folders := map[string]string{}
+	err = walkArchive(data, func(name string, mode fs.FileMode, content io.Reader) error {
+		segments, err := archivePath(name)
+		if err != nil || len(segments) == 0 || (content == nil && !mode.IsDir()) {
+			// links and special files are skipped
+			return err
+		}
+		dir := segments
+		if !mode.IsDir() {
+			dir = segments[:len(segments)-1]
+		}
+		dirPath := strings.Join(dir, "/")
+		folderId, ok := folders[dirPath]
+		if !ok {
+			folderId, err = app.resolveFolderPath(baseId, dir, true)
+			if err != nil {
+				return err
+			}
+			folders[dirPath] = folderId
+		}
+		if mode.IsDir() {
+			return nil
+		}
+
+		now := time.Now().UTC().Unix()
+		metadata := template
+		metadata.FileId = uuid.New().String()
+		filename := segments[len(segments)-1]
+		metadata.Extension = path.Ext(filename)
+		metadata.Filename = filename[:len(filename)-len(metadata.Extension)]
+		metadata.FolderId = folderId
+		metadata.CreatedAt, metadata.UpdatedAt = now, now
+		result.Files = append(result.Files, ExtractedFile{FileId: metadata.FileId, Path: strings.Join(segments, "/")})
+		return app.storeFile(request, metadata, content, customerKey, &reserved)
+	})
+	if err != nil {
+		fileIds := make([]string, 0, len(result.Files))
+		for _, file := range result.Files {
+			fileIds = append(fileIds, file.FileId)
+		}
+		app.discardFiles(request, fileIds, reserved)
+		return ExtractResult{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"net/http"
+	"os"
+)
+
+const ApiKeyHeader = "X-Api-Key"
+
+// LoadApiKeys reads a json object mapping hex sha256 hashes of api keys
+// to the tenant and user they authenticate
+func LoadApiKeys(path string) (map[string]models.Principal, error) {
+	var keys map[string]models.Principal
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keys, fmt.Errorf("failed to read api keys: %w", err)
+	}
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return keys, fmt.Errorf("failed to parse api keys: %w", err)
+	}
+	for hash, principal := range keys {
+		if principal.Tenant == "" {
+			principal.Tenant = utils.DefaultTenant
+		}
+		if principal.User == "" {
+			principal.User = utils.DefaultUser
+		}
+		keys[hash] = principal
+	}
+	return keys, nil
+}
+
+// Authenticator sets the principal files and quotas are accounted to. A client is known by
+// its api key, tenant and user headers are trusted only behind a gateway that sets them itself.
+// Without api keys and trusted headers every client is the default tenant and user
+type Authenticator struct {
+	keys         map[string]models.Principal
+	trustHeaders bool
+}
+
+func NewAuthenticator(keys map[string]models.Principal, trustHeaders bool) *Authenticator {
+	return &Authenticator{keys: keys, trustHeaders: trustHeaders}
+}
+
+// principal returns the principal of a request, false when the client could not be authenticated
+func (a *Authenticator) principal(request *http.Request) (models.Principal, bool) {
+	apiKey := request.Header.Get(ApiKeyHeader)
+	switch {
+	case apiKey != "":
+		hash := sha256.Sum256([]byte(apiKey))
+		principal, ok := a.keys[hex.EncodeToString(hash[:])]
+		return principal, ok
+	case a.trustHeaders:
+		return utils.HeaderPrincipal(request), true
+	case len(a.keys) > 0:
+		return models.Principal{}, false
+	}
+	return utils.GetPrincipal(request), true
+}
+
+// Authenticate answers 401 to a client that could not be authenticated
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		principal, ok := a.principal(request)
+		if !ok {
+			utils.WriteResponseStatusCode(
+				models.Error{Detail: "valid api key is required"},
+				http.StatusUnauthorized,
+				writer,
+			)
+			return
+		}
+		next.ServeHTTP(writer, utils.WithPrincipal(request, principal))
+	})
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrincipalComesFromAuthenticatedKey(t *testing.T) {
+	hash := sha256.Sum256([]byte("secret"))
+	path := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(path, []byte(`{"`+hex.EncodeToString(hash[:])+`": {"tenant": "acme", "user": "alice"}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadApiKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(authenticator *Authenticator, apiKey string) (int, models.Principal) {
+		var principal models.Principal
+		handler := authenticator.Authenticate(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			principal = utils.GetPrincipal(request)
+		}))
+		request := httptest.NewRequest(http.MethodGet, "/usage", nil)
+		request.Header.Set(utils.TenantHeader, "other")
+		request.Header.Set(utils.UserHeader, "mallory")
+		if apiKey != "" {
+			request.Header.Set(ApiKeyHeader, apiKey)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code, principal
+	}
+
+	cases := []struct {
+		name          string
+		authenticator *Authenticator
+		apiKey        string
+		code          int
+		principal     models.Principal
+	}{
+		{"valid key", NewAuthenticator(keys, false), "secret", http.StatusOK, models.Principal{Tenant: "acme", User: "alice"}},
+		{"unknown key", NewAuthenticator(keys, false), "guess", http.StatusUnauthorized, models.Principal{}},
+		{"missing key", NewAuthenticator(keys, false), "", http.StatusUnauthorized, models.Principal{}},
+		{"no keys configured", NewAuthenticator(nil, false), "", http.StatusOK, models.Principal{Tenant: utils.DefaultTenant, User: utils.DefaultUser}},
+		{"trusted gateway", NewAuthenticator(nil, true), "", http.StatusOK, models.Principal{Tenant: "other", User: "mallory"}},
+	}
+	for _, c := range cases {
+		code, principal := send(c.authenticator, c.apiKey)
+		if code != c.code || principal != c.principal {
+			t.Errorf("%s: got %d as %+v, expected %d as %+v", c.name, code, principal, c.code, c.principal)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package backends
+
+const (
+	// BatchDelete moves a file to trash
+	BatchDelete = "delete"
+	// BatchUpdate changes metadata of a file like UpdateFile without content
+	BatchUpdate = "update"
+)
+
+// BatchOperation is a metadata change of a single file, the caller checks
+// retention and validates updates before the batch is applied
+type BatchOperation struct {
+	Kind   string
+	FileId string
+	Update FileMetadataUpdate
+}
@@ -0,0 +1,235 @@
+package backends
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"hybrid-storage/models"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	SortByFilename  = "filename"
+	SortByExtension = "extension"
+	SortByCreatedAt = "createdAt"
+	SortBySize      = "size"
+	SortByUpdatedAt = "updatedAt"
+)
+
+func IsValidSortField(field string) bool {
+	switch field {
+	case SortByFilename, SortByExtension, SortByCreatedAt, SortByUpdatedAt, SortBySize:
+		return true
+	}
+	return false
+}
+
+// FileFilter narrows down listed files, zero values match any file.
+// Time ranges and sizes are inclusive
+type FileFilter struct {
+	// case insensitive substring or prefix of filename without extension
+	Filename       string
+	FilenamePrefix string
+	// with or without a leading dot, case insensitive
+	Extension string
+	// exact filename with extension
+	Name string
+	Tag  string
+	// files of a single folder, empty string is the root folder
+	FolderId      *string
+	CreatedAfter  int64
+	CreatedBefore int64
+	UpdatedAfter  int64
+	UpdatedBefore int64
+	MinSize       int64
+	MaxSize       int64
+}
+
+// FilesQuery selects a page of visible files, files are ordered by SortBy
+// and then by file id so pages are stable
+type FilesQuery struct {
+	Page       int
+	PageSize   int
+	Filter     FileFilter
+	SortBy     string
+	Descending bool
+	// continue right after the cursor instead of skipping pages
+	After *FileCursor
+	// do not count all matching files
+	SkipCount bool
+}
+
+func (q FilesQuery) sortField() string {
+	if q.SortBy == "" {
+		return SortByCreatedAt
+	}
+	return q.SortBy
+}
+
+func (q FilesQuery) offset() int {
+	if q.After != nil {
+		return 0
+	}
+	return (q.Page - 1) * q.PageSize
+}
+
+// FileCursor is the sort key of the last file of a page
+type FileCursor struct {
+	SortBy      string `json:"s"`
+	Descending  bool   `json:"d,omitempty"`
+	FileId      string `json:"f"`
+	StringValue string `json:"v,omitempty"`
+	IntValue    int64  `json:"n,omitempty"`
+}
+
+func isStringSortField(field string) bool {
+	return field == SortByFilename || field == SortByExtension
+}
+
+// value returns the sort value in the type of the sorted column
+func (c FileCursor) value() any {
+	if isStringSortField(c.SortBy) {
+		return c.StringValue
+	}
+	return c.IntValue
+}
+
+// metadata returns file metadata with the sort key of the cursor
+func (c FileCursor) metadata() models.FileMetadata {
+	metadata := models.FileMetadata{FileId: c.FileId}
+	switch c.SortBy {
+	case SortByFilename:
+		metadata.Filename = c.StringValue
+	case SortByExtension:
+		metadata.Extension = c.StringValue
+	case SortByUpdatedAt:
+		metadata.UpdatedAt = c.IntValue
+	case SortBySize:
+		metadata.Size = c.IntValue
+	default:
+		metadata.CreatedAt = c.IntValue
+	}
+	return metadata
+}
+
+func (c FileCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursorAfter returns cursor pointing right after the file
+func (q FilesQuery) cursorAfter(metadata models.FileMetadata) string {
+	cursor := FileCursor{SortBy: q.sortField(), Descending: q.Descending, FileId: metadata.FileId}
+	switch cursor.SortBy {
+	case SortByFilename:
+		cursor.StringValue = metadata.Filename
+	case SortByExtension:
+		cursor.StringValue = metadata.Extension
+	case SortByUpdatedAt:
+		cursor.IntValue = metadata.UpdatedAt
+	case SortBySize:
+		cursor.IntValue = metadata.Size
+	default:
+		cursor.IntValue = metadata.CreatedAt
+	}
+	return cursor.encode()
+}
+
+// nextCursor returns cursor of the next page, empty on the last page
+func (q FilesQuery) nextCursor(files []models.FileMetadata, isNextPage bool) string {
+	if !isNextPage || len(files) == 0 {
+		return ""
+	}
+	return q.cursorAfter(files[len(files)-1])
+}
+
+// ParseCursor decodes a cursor token, the cursor must come from a listing with the same sort
+func ParseCursor(token string, query FilesQuery) (*FileCursor, error) {
+	var cursor FileCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil || !IsValidSortField(cursor.SortBy) || cursor.FileId == "" {
+		return nil, &FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: "invalid cursor",
+		}
+	}
+	if cursor.SortBy != query.sortField() || cursor.Descending != query.Descending {
+		return nil, &FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: "cursor does not match sort and order of the listing",
+		}
+	}
+	return &cursor, nil
+}
+
+// splitName splits a name into stored filename and extension
+func splitName(name string) (string, string) {
+	extension := filepath.Ext(name)
+	return name[:len(name)-len(extension)], extension
+}
+
+// normalizedExtension returns extension in the stored form, with a leading dot
+func (f FileFilter) normalizedExtension() string {
+	return "." + strings.TrimPrefix(f.Extension, ".")
+}
+
+func (f FileFilter) matches(metadata models.FileMetadata) bool {
+	filename := strings.ToLower(metadata.Filename)
+	switch {
+	case f.Filename != "" && !strings.Contains(filename, strings.ToLower(f.Filename)):
+		return false
+	case f.FilenamePrefix != "" && !strings.HasPrefix(filename, strings.ToLower(f.FilenamePrefix)):
+		return false
+	case f.Extension != "" && !strings.EqualFold(metadata.Extension, f.normalizedExtension()):
+		return false
+	case f.Name != "" && metadata.Filename+metadata.Extension != f.Name:
+		return false
+	case f.Tag != "" && !slices.Contains(metadata.Tags, f.Tag):
+		return false
+	case f.FolderId != nil && metadata.FolderId != *f.FolderId:
+		return false
+	case f.CreatedAfter != 0 && metadata.CreatedAt < f.CreatedAfter:
+		return false
+	case f.CreatedBefore != 0 && metadata.CreatedAt > f.CreatedBefore:
+		return false
+	case f.UpdatedAfter != 0 && metadata.UpdatedAt < f.UpdatedAfter:
+		return false
+	case f.UpdatedBefore != 0 && metadata.UpdatedAt > f.UpdatedBefore:
+		return false
+	case f.MinSize != 0 && metadata.Size < f.MinSize:
+		return false
+	case f.MaxSize != 0 && metadata.Size > f.MaxSize:
+		return false
+	}
+	return true
+}
+
+// compareFiles orders metadata the same way the database backends do
+func (q FilesQuery) compareFiles(a models.FileMetadata, b models.FileMetadata) int {
+	var result int
+	switch q.sortField() {
+	case SortByFilename:
+		result = cmp.Compare(a.Filename, b.Filename)
+	case SortByExtension:
+		result = cmp.Compare(a.Extension, b.Extension)
+	case SortByUpdatedAt:
+		result = cmp.Compare(a.UpdatedAt, b.UpdatedAt)
+	case SortBySize:
+		result = cmp.Compare(a.Size, b.Size)
+	default:
+		result = cmp.Compare(a.CreatedAt, b.CreatedAt)
+	}
+	if result == 0 {
+		result = cmp.Compare(a.FileId, b.FileId)
+	}
+	if q.Descending {
+		return -result
+	}
+	return result
+}
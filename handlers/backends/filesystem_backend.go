@@ -1,176 +1,988 @@
 package backends
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"hybrid-storage/models"
 	"hybrid-storage/utils"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-type FileSystemBackend struct{}
+type FileSystemBackend struct {
+	// store chunks once by content hash, versions keep lists of chunk hashes
+	Dedup bool
+}
 
 const PERMISSIONS = 0755
 const FILES_DIR = "files"
 const METADATA_FILE = "metadata.json"
-const FILE_NAME = "file"
+const VERSIONS_DIR = "versions"
+const VERSIONS_FILE = "versions.json"
+const CHUNKS_DIR = "chunks"
+const MANIFEST_SUFFIX = ".chunks.json"
 
-func (fsb FileSystemBackend) UploadFile(chunk utils.ChunkResult, fileId string) (FileServerResult, error) {
-	path := filepath.Join(FILES_DIR, chunk.FileId)
-	err := os.MkdirAll(path, PERMISSIONS)
+// guards reference counts of shared chunks
+var chunksLock sync.Mutex
+
+// fileLocks serialize changes of file metadata, a file always maps to the same lock.
+// The backend owns its directory, so locks of the process are enough
+var fileLocks [64]sync.Mutex
+
+func lockFile(fileId string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(fileId))
+	lock := &fileLocks[hash.Sum32()%uint32(len(fileLocks))]
+	lock.Lock()
+	return lock.Unlock
+}
+
+func versionPath(fileId string, version int64) string {
+	return filepath.Join(fileDir(fileId), VERSIONS_DIR, strconv.FormatInt(version, 10))
+}
+
+// manifest lists chunk hashes of a version stored in dedup mode
+func manifestPath(fileId string, version int64) string {
+	return versionPath(fileId, version) + MANIFEST_SUFFIX
+}
+
+func chunkPath(hash string) string {
+	return filepath.Join(CHUNKS_DIR, hash[:2], hash)
+}
+
+func refsPath(hash string) string {
+	return chunkPath(hash) + ".refs"
+}
+
+func damagedError(fileId string) error {
+	return &FileServerError{
+		Code:   http.StatusInternalServerError,
+		Detail: fmt.Sprintf("%s: %s", "File is damaged", fileId),
+	}
+}
+
+func readMetadata(fileId string) (models.FileMetadata, error) {
+	metadataFile, err := os.ReadFile(filepath.Join(fileDir(fileId), METADATA_FILE))
 	if err != nil {
-		return FileServerResult{}, &FileServerError{
+		return models.FileMetadata{}, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: fmt.Sprintf("%s: %s", "File not found", fileId),
+		}
+	}
+	stored, err := decodeJson[models.StoredMetadata](metadataFile)
+	if err != nil {
+		return models.FileMetadata{}, damagedError(fileId)
+	}
+	return *stored.Metadata(), nil
+}
+
+// readActiveMetadata hides files that were moved to trash or expired
+func readActiveMetadata(fileId string) (models.FileMetadata, error) {
+	metadata, err := readMetadata(fileId)
+	if err != nil {
+		return metadata, err
+	}
+	if metadata.DeletedAt != 0 {
+		return models.FileMetadata{}, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: fmt.Sprintf("%s: %s", "File not found", fileId),
+		}
+	}
+	if isExpired(metadata, time.Now().Unix()) {
+		return models.FileMetadata{}, expiredError(fileId)
+	}
+	return metadata, nil
+}
+
+func isVisible(metadata models.FileMetadata, now int64) bool {
+	return metadata.DeletedAt == 0 && !isExpired(metadata, now)
+}
+
+func writeMetadata(metadata models.FileMetadata) error {
+	// the index is changed first, so that a change interrupted by a crash is among its last records
+	err := filesIndex.put(metadata)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(
+		filepath.Join(fileDir(metadata.FileId), METADATA_FILE),
+		utils.GetJsonData(models.NewStoredMetadata(&metadata)),
+	)
+	if err != nil {
+		filesIndex.refresh(metadata.FileId)
+		return &FileServerError{
 			Code:   http.StatusInternalServerError,
-			Detail: "Error creating file directory",
+			Detail: "Error writing metadata file",
 		}
 	}
-	outFile, err := os.OpenFile(filepath.Join(path, FILE_NAME), os.O_CREATE|os.O_WRONLY|os.O_APPEND, PERMISSIONS)
+	return nil
+}
+
+func readVersions(fileId string) ([]models.FileVersion, error) {
+	versionsFile, err := os.ReadFile(filepath.Join(fileDir(fileId), VERSIONS_FILE))
 	if err != nil {
-		return FileServerResult{}, &FileServerError{
+		return nil, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: fmt.Sprintf("%s: %s", "File not found", fileId),
+		}
+	}
+	versions, err := decodeJson[[]models.FileVersion](versionsFile)
+	if err != nil {
+		return nil, damagedError(fileId)
+	}
+	return versions, nil
+}
+
+func writeVersions(fileId string, versions []models.FileVersion) error {
+	err := writeFileAtomic(
+		filepath.Join(fileDir(fileId), VERSIONS_FILE),
+		utils.GetJsonData(versions),
+	)
+	if err != nil {
+		return &FileServerError{
 			Code:   http.StatusInternalServerError,
-			Detail: "Error saving file",
+			Detail: "Error writing versions file",
 		}
 	}
-	defer outFile.Close()
+	return nil
+}
+
+// findVersion returns a finished version, a version that is still being uploaded can not be read or restored
+func findVersion(versions []models.FileVersion, version int64) (models.FileVersion, error) {
+	for _, fileVersion := range versions {
+		if fileVersion.Version == version && !fileVersion.Pending {
+			return fileVersion, nil
+		}
+	}
+	return models.FileVersion{}, &FileServerError{
+		Code:   http.StatusNotFound,
+		Detail: fmt.Sprintf("version %d not found", version),
+	}
+}
 
-	err = os.WriteFile(filepath.Join(path, METADATA_FILE), chunk.JsonData, PERMISSIONS)
+// readManifest returns nil if version was stored without dedup
+func readManifest(fileId string, version int64) ([]string, error) {
+	manifestFile, err := os.ReadFile(manifestPath(fileId, version))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		return FileServerResult{}, &FileServerError{
+		return nil, &FileServerError{
 			Code:   http.StatusInternalServerError,
-			Detail: "Error writing metadata file",
+			Detail: "Error reading chunk list",
+		}
+	}
+	hashes, err := decodeJson[[]string](manifestFile)
+	if err != nil {
+		return nil, damagedError(fileId)
+	}
+	return hashes, nil
+}
+
+func writeManifest(fileId string, version int64, hashes []string) error {
+	err := writeFileAtomic(manifestPath(fileId, version), utils.GetJsonData(hashes))
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error writing chunk list",
+		}
+	}
+	return nil
+}
+
+func readRefs(hash string) (int64, error) {
+	refsFile, err := os.ReadFile(refsPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(refsFile)), 10, 64)
+}
+
+// changeChunkRefs adds delta references to a chunk, chunk data is written with the first reference
+// and removed with the last one
+func changeChunkRefs(hash string, data []byte, delta int64) error {
+	chunksLock.Lock()
+	defer chunksLock.Unlock()
+
+	refs, err := readRefs(hash)
+	if err != nil {
+		return err
+	}
+	refs += delta
+	if refs <= 0 {
+		err = os.Remove(chunkPath(hash))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.Remove(refsPath(hash))
+	}
+	if refs == delta {
+		if data == nil {
+			return fmt.Errorf("chunk %s not found", hash)
+		}
+		err = os.MkdirAll(filepath.Dir(chunkPath(hash)), PERMISSIONS)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(chunkPath(hash), data)
+		if err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(refsPath(hash), []byte(strconv.FormatInt(refs, 10)))
+}
+
+// releaseManifest drops references held by a version stored in dedup mode
+func releaseManifest(fileId string, version int64) error {
+	hashes, err := readManifest(fileId, version)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		err = changeChunkRefs(hash, nil, -1)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (fsb FileSystemBackend) appendChunk(fileId string, version int64, chunk utils.ChunkResult) error {
+	if fsb.Dedup {
+		return appendDedupChunk(fileId, version, chunk)
+	}
+
+	outFile, err := os.OpenFile(versionPath(fileId, version), os.O_CREATE|os.O_WRONLY|os.O_APPEND, PERMISSIONS)
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error saving file",
+		}
+	}
+	defer outFile.Close()
 
 	_, err = io.Copy(outFile, chunk.FormDataChunk)
+	if err == nil {
+		err = outFile.Sync()
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(outFile.Name()))
+	}
 	if err != nil {
-		return FileServerResult{}, &FileServerError{
+		return &FileServerError{
 			Code:   http.StatusInternalServerError,
 			Detail: "Error copying file",
 		}
 	}
-	return FileServerResult{FileId: fileId}, nil
+	return nil
 }
 
-func (fsb FileSystemBackend) GetFile(fileId string) (GetFileResult, error) {
-	filebytes, err := os.ReadFile(filepath.Join(FILES_DIR, fileId, FILE_NAME))
+func appendDedupChunk(fileId string, version int64, chunk utils.ChunkResult) error {
+	data := utils.ReadChunkBytes(chunk)
+	hash := chunkHash(data)
+	hashes, err := readManifest(fileId, version)
 	if err != nil {
-		return GetFileResult{}, &FileServerError{
-			Code:   http.StatusNotFound,
-			Detail: fmt.Sprintf("%s: %s", "File not found", fileId),
+		return err
+	}
+	err = changeChunkRefs(hash, data, 1)
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error saving chunk",
 		}
 	}
+	return writeManifest(fileId, version, append(hashes, hash))
+}
 
-	metadataFile, err := os.ReadFile(filepath.Join(FILES_DIR, fileId, METADATA_FILE))
+// readVersionData reads content of a version stored either as a single file or as a list of chunks
+func readVersionData(fileId string, version int64) ([]byte, error) {
+	notFoundErr := &FileServerError{
+		Code:   http.StatusNotFound,
+		Detail: fmt.Sprintf("version %d not found", version),
+	}
+	hashes, err := readManifest(fileId, version)
 	if err != nil {
-		return GetFileResult{}, &FileServerError{
-			Code:   http.StatusNotFound,
-			Detail: err.Error(),
+		return nil, err
+	}
+	if hashes == nil {
+		filebytes, err := os.ReadFile(versionPath(fileId, version))
+		if err != nil {
+			return nil, notFoundErr
+		}
+		return filebytes, nil
+	}
+
+	var filebytes []byte
+	for _, hash := range hashes {
+		chunkBytes, err := os.ReadFile(chunkPath(hash))
+		if err != nil {
+			return nil, notFoundErr
+		}
+		filebytes = append(filebytes, chunkBytes...)
+	}
+	return filebytes, nil
+}
+
+// writeVersionChunk appends chunk to the newest version of a file, first chunk starts a new version.
+// Returns metadata and versions with sizes already updated
+func (fsb FileSystemBackend) writeVersionChunk(fileId string, chunk utils.ChunkResult, metadata models.FileMetadata, versions []models.FileVersion) (models.FileMetadata, []models.FileVersion, error) {
+	if chunk.ChunkNumber == 1 {
+		var nextVersion int64 = 1
+		if len(versions) > 0 {
+			nextVersion = versions[len(versions)-1].Version + 1
+		}
+		versions = append(versions, models.FileVersion{
+			FileId:    fileId,
+			Version:   nextVersion,
+			CreatedAt: time.Now().Unix(),
+			Pending:   true,
+		})
+	}
+	if len(versions) == 0 {
+		return metadata, versions, &FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: "Upload must start with the first chunk",
 		}
 	}
-	metadata := utils.ReadJsonData[models.FileMetadata](metadataFile)
+
+	latest := &versions[len(versions)-1]
+	// data of a finished version may be shared with copies through hard links
+	if !latest.Pending {
+		return metadata, versions, versionFinishedError()
+	}
+	err := fsb.appendChunk(fileId, latest.Version, chunk)
+	if err != nil {
+		return metadata, versions, err
+	}
+	latest.Size += chunk.Size
+	latest.UpdatedAt = time.Now().Unix()
+	latest.Pending = !chunk.IsLastChunk
+
+	// new version becomes visible when its last chunk arrives
+	if chunk.IsLastChunk || latest.Version == 1 {
+		metadata.Version = latest.Version
+		metadata.Size = latest.Size
+	}
+	return metadata, versions, nil
+}
+
+func (fsb FileSystemBackend) UploadFile(chunk utils.ChunkResult, fileId string) (FileServerResult, error) {
+	defer lockFile(chunk.FileId)()
+	var metadata models.FileMetadata
+	var versions []models.FileVersion
+	var entry journal
+	var err error
+	if chunk.ChunkNumber == 1 {
+		err = createFileDir(chunk.FileId)
+		if err != nil {
+			return FileServerResult{}, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: "Error creating file directory",
+			}
+		}
+		stored := utils.ReadJsonData[models.StoredMetadata](chunk.JsonData)
+		metadata = *stored.Metadata()
+		metadata.Revision = 1
+		entry = journal{Op: journalUpload}
+	} else {
+		// chunk belongs to the same file
+		metadata, err = readActiveMetadata(chunk.FileId)
+		if err != nil {
+			return FileServerResult{}, err
+		}
+		versions, err = readVersions(chunk.FileId)
+		if err != nil {
+			return FileServerResult{}, err
+		}
+		entry, err = newJournal(journalUpload, chunk.FileId, &metadata, versions)
+		if err != nil {
+			return FileServerResult{}, err
+		}
+	}
+
+	err = journaled(chunk.FileId, entry, func() error {
+		metadata, versions, err = fsb.writeVersionChunk(chunk.FileId, chunk, metadata, versions)
+		if err != nil {
+			return err
+		}
+		err = writeVersions(chunk.FileId, versions)
+		if err != nil {
+			return err
+		}
+		return writeMetadata(metadata)
+	})
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	return FileServerResult{FileId: fileId}, nil
+}
+
+func (fsb FileSystemBackend) GetFile(fileId string) (GetFileResult, error) {
+	metadata, err := readActiveMetadata(fileId)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+	filebytes, err := readVersionData(fileId, metadata.Version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
 	return GetFileResult{File: filebytes, Metadata: metadata}, nil
 }
 
-func (fsb FileSystemBackend) GetFileMetadata(fileId string) (models.FileMetadata, error) {
-	metadataFile, err := os.ReadFile(filepath.Join(FILES_DIR, fileId, METADATA_FILE))
+func (fsb FileSystemBackend) GetFileVersion(fileId string, version int64) (GetFileResult, error) {
+	metadata, err := readActiveMetadata(fileId)
 	if err != nil {
-		return models.FileMetadata{}, &FileServerError{
+		return GetFileResult{}, err
+	}
+	versions, err := readVersions(fileId)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+	fileVersion, err := findVersion(versions, version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+	filebytes, err := readVersionData(fileId, version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+	metadata.Version = fileVersion.Version
+	metadata.Size = fileVersion.Size
+	return GetFileResult{File: filebytes, Metadata: metadata}, nil
+}
+
+func (fsb FileSystemBackend) GetFileVersions(fileId string) ([]models.FileVersion, error) {
+	return readVersions(fileId)
+}
+
+// copyVersionData copies content of a version, chunks of dedup versions are shared instead of copied
+func copyVersionData(fileId string, from int64, to int64) error {
+	hashes, err := readManifest(fileId, from)
+	if err != nil {
+		return err
+	}
+	if hashes != nil {
+		for _, hash := range hashes {
+			err = changeChunkRefs(hash, nil, 1)
+			if err != nil {
+				return &FileServerError{
+					Code:   http.StatusInternalServerError,
+					Detail: "Error saving chunk",
+				}
+			}
+		}
+		return writeManifest(fileId, to, hashes)
+	}
+
+	filebytes, err := os.ReadFile(versionPath(fileId, from))
+	if err != nil {
+		return &FileServerError{
 			Code:   http.StatusNotFound,
-			Detail: err.Error(),
+			Detail: fmt.Sprintf("version %d not found", from),
+		}
+	}
+	err = writeFileAtomic(versionPath(fileId, to), filebytes)
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error saving file",
 		}
 	}
-	return utils.ReadJsonData[models.FileMetadata](metadataFile), nil
+	return nil
 }
 
-func (fsb FileSystemBackend) GetAllFiles(page int, pageSize int) (PaginatedItems[models.FileMetadata], error) {
-	dir, err := os.Open(FILES_DIR)
+func (fsb FileSystemBackend) RestoreFileVersion(fileId string, version int64) (FileServerResult, error) {
+	defer lockFile(fileId)()
+	metadata, err := readActiveMetadata(fileId)
 	if err != nil {
-		return PaginatedItems[models.FileMetadata]{}, err
+		return FileServerResult{}, err
+	}
+	versions, err := readVersions(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	fileVersion, err := findVersion(versions, version)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	entry, err := newJournal(journalRestore, fileId, &metadata, versions)
+	if err != nil {
+		return FileServerResult{}, err
 	}
-	defer dir.Close()
 
-	// skip dirs
-	for range page - 1 {
-		dir.ReadDir(pageSize)
+	// restored content becomes a new version, old versions stay immutable
+	restored := models.FileVersion{
+		FileId:    fileId,
+		Version:   versions[len(versions)-1].Version + 1,
+		Size:      fileVersion.Size,
+		CreatedAt: time.Now().Unix(),
 	}
+	err = journaled(fileId, entry, func() error {
+		err := copyVersionData(fileId, version, restored.Version)
+		if err != nil {
+			return err
+		}
+		err = writeVersions(fileId, append(versions, restored))
+		if err != nil {
+			return err
+		}
+		metadata.Version = restored.Version
+		metadata.Size = restored.Size
+		metadata.Revision++
+		metadata.UpdatedAt = time.Now().Unix()
+		return writeMetadata(metadata)
+	})
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	return FileServerResult{FileId: fileId}, nil
+}
+
+func (fsb FileSystemBackend) GetFileMetadata(fileId string) (models.FileMetadata, error) {
+	return readActiveMetadata(fileId)
+}
 
-	// read for page
-	filesDir, err := dir.ReadDir(pageSize)
+func (fsb FileSystemBackend) GetUploadMetadata(fileId string) (models.FileMetadata, error) {
+	return readActiveMetadata(fileId)
+}
+
+// walkFiles calls fn with metadata of every stored file until it returns false
+func walkFiles(fn func(metadata models.FileMetadata) bool) error {
+	files, err := filesIndex.list()
 	if err != nil {
-		return PaginatedItems[models.FileMetadata]{}, err
+		return err
 	}
+	for _, metadata := range files {
+		if !fn(metadata) {
+			return nil
+		}
+	}
+	return nil
+}
 
+func (fsb FileSystemBackend) GetAllFiles(query FilesQuery) (PaginatedItems[models.FileMetadata], error) {
+	now := time.Now().Unix()
+	// directories have no order, only the smallest files up to the end of the page are kept while walking
+	keep := query.offset() + query.PageSize + 1
 	var filesMetadata []models.FileMetadata
-	for _, dirOrFile := range filesDir {
-		if dirOrFile.IsDir() {
-			metadataFile, err := os.ReadFile(filepath.Join(FILES_DIR, dirOrFile.Name(), METADATA_FILE))
+	// matching files are counted while walking, without a filter the index keeps the count
+	var totalItems int64
+	err := walkFiles(func(metadata models.FileMetadata) bool {
+		if !isVisible(metadata, now) || !query.Filter.matches(metadata) {
+			return true
+		}
+		totalItems++
+		if query.After != nil && query.compareFiles(metadata, query.After.metadata()) <= 0 {
+			return true
+		}
+		filesMetadata = append(filesMetadata, metadata)
+		if query.PageSize > 0 && len(filesMetadata) >= 2*keep {
+			slices.SortFunc(filesMetadata, query.compareFiles)
+			filesMetadata = filesMetadata[:keep]
+		}
+		return true
+	})
+	if err != nil {
+		return PaginatedItems[models.FileMetadata]{}, err
+	}
+	slices.SortFunc(filesMetadata, query.compareFiles)
+
+	skip := min(query.offset(), len(filesMetadata))
+	filesMetadata = filesMetadata[skip:]
+	nextPage := false
+	if query.PageSize > 0 && len(filesMetadata) > query.PageSize {
+		filesMetadata = filesMetadata[:query.PageSize]
+		nextPage = true
+	}
+
+	result := PaginatedItems[models.FileMetadata]{
+		Items:      filesMetadata,
+		Page:       int64(query.Page),
+		PageSize:   int64(query.PageSize),
+		IsNextPage: nextPage,
+		NextCursor: query.nextCursor(filesMetadata, nextPage),
+	}
+	if !query.SkipCount {
+		if query.Filter == (FileFilter{}) {
+			totalItems, err = filesIndex.countVisible(now)
 			if err != nil {
 				return PaginatedItems[models.FileMetadata]{}, err
 			}
+		}
+		result.setTotal(totalItems)
+	}
+	return result, nil
+}
 
-			metadata := utils.ReadJsonData[models.FileMetadata](metadataFile)
+func (fsb FileSystemBackend) GetDeletedFiles(deletedBefore int64) ([]models.FileMetadata, error) {
+	var filesMetadata []models.FileMetadata
+	err := walkFiles(func(metadata models.FileMetadata) bool {
+		if metadata.DeletedAt != 0 && metadata.DeletedAt < deletedBefore {
+			filesMetadata = append(filesMetadata, metadata)
+		}
+		return true
+	})
+	return filesMetadata, err
+}
+
+func (fsb FileSystemBackend) GetExpiredFiles(expiredBefore int64) ([]models.FileMetadata, error) {
+	var filesMetadata []models.FileMetadata
+	err := walkFiles(func(metadata models.FileMetadata) bool {
+		if isExpired(metadata, expiredBefore) {
 			filesMetadata = append(filesMetadata, metadata)
 		}
+		return true
+	})
+	return filesMetadata, err
+}
+
+func (fsb FileSystemBackend) GetStoredFiles() ([]models.FileMetadata, error) {
+	return filesIndex.list()
+}
+
+func (fsb FileSystemBackend) UpdateFile(chunk utils.ChunkResult, fileId string, metadataUpdate FileMetadataUpdate) (FileServerResult, error) {
+	defer lockFile(fileId)()
+	metadata, err := readActiveMetadata(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	// revision is compared when a new version starts and changes again when it becomes current
+	expected := metadataUpdate.Revision
+	if chunk.ChunkNumber <= 1 && expected != nil && *expected != metadata.Revision {
+		return FileServerResult{}, revisionConflictError(fileId, *expected)
+	}
+	if chunk.FormDataChunk == nil {
+		err = updateMetadata(chunk, metadata, metadataUpdate)
+		if err != nil {
+			return FileServerResult{}, err
+		}
+		return FileServerResult{FileId: fileId}, nil
 	}
 
-	if filesMetadata == nil {
-		return PaginatedItems[models.FileMetadata]{}, nil
+	// every content update goes into a new version
+	versions, err := readVersions(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	entry, err := newJournal(journalUpdate, fileId, &metadata, versions)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	err = journaled(fileId, entry, func() error {
+		metadata, versions, err = fsb.writeVersionChunk(fileId, chunk, metadata, versions)
+		if err != nil {
+			return err
+		}
+		err = writeVersions(fileId, versions)
+		if err != nil {
+			return err
+		}
+		return updateMetadata(chunk, metadata, metadataUpdate)
+	})
+	if err != nil {
+		return FileServerResult{}, err
 	}
+	return FileServerResult{FileId: fileId}, nil
+}
 
-	nextPage := false
-	_, err = dir.ReadDir(pageSize)
-	if err == nil {
-		nextPage = true
+// updateMetadata writes metadata of an updated file, requested changes are applied with the last chunk
+func updateMetadata(chunk utils.ChunkResult, metadata models.FileMetadata, metadataUpdate FileMetadataUpdate) error {
+	if chunk.ChunkNumber <= 1 || chunk.IsLastChunk {
+		metadata.Revision++
 	}
 
-	return PaginatedItems[models.FileMetadata]{
-		Items:      filesMetadata,
-		Page:       int64(page),
-		PageSize:   int64(pageSize),
-		IsNextPage: nextPage,
-	}, nil
+	if chunk.IsLastChunk {
+		if metadataUpdate.Filename != "" {
+			metadata.Filename = metadataUpdate.Filename
+		}
+		if metadataUpdate.ExpiresAt != nil {
+			metadata.ExpiresAt = *metadataUpdate.ExpiresAt
+		}
+		if metadataUpdate.LegalHold != nil {
+			metadata.LegalHold = *metadataUpdate.LegalHold
+		}
+		if metadataUpdate.RetainUntil != nil {
+			metadata.RetainUntil = *metadataUpdate.RetainUntil
+		}
+		if metadataUpdate.UserMetadata != nil {
+			metadata.UserMetadata = metadataUpdate.UserMetadata
+		}
+		if metadataUpdate.Tags != nil {
+			metadata.Tags = metadataUpdate.Tags
+		}
+		if metadataUpdate.FolderId != nil {
+			metadata.FolderId = *metadataUpdate.FolderId
+		}
+		metadata.UpdatedAt = time.Now().Unix()
+	}
+	return writeMetadata(metadata)
 }
 
-func (fsb FileSystemBackend) UpdateFile(chunk utils.ChunkResult, fileId string, metadataUpdate FileMetadataUpdate) (FileServerResult, error) {
-	result, err := fsb.UploadFile(chunk, fileId)
+// linkOrCopy hard links a finished version file, data is copied when the link fails,
+// for example on file systems without hard links
+func linkOrCopy(source string, target string) error {
+	err := os.Link(source, target)
+	if err == nil {
+		return syncDir(filepath.Dir(target))
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(target, data)
+}
+
+// CopyFile hard links data of the current version into the new file, in dedup mode
+// the chunk list is copied and shared chunks get one more reference
+func (fsb FileSystemBackend) CopyFile(fileId string, target models.FileMetadata) (FileServerResult, error) {
+	source, err := readActiveMetadata(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	versions, err := readVersions(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	_, err = findVersion(versions, source.Version)
+	if err != nil {
+		return FileServerResult{}, uploadPendingError(fileId)
+	}
+	hashes, err := readManifest(fileId, source.Version)
 	if err != nil {
 		return FileServerResult{}, err
 	}
+	defer lockFile(target.FileId)()
+	err = createFileDir(target.FileId)
+	if err != nil {
+		return FileServerResult{}, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error creating file directory",
+		}
+	}
 
-	if chunk.IsLastChunk && (metadataUpdate.Filename != "") {
-		metadataFile, err := os.ReadFile(filepath.Join(FILES_DIR, fileId, METADATA_FILE))
+	// an unfinished copy is removed together with references it took
+	err = journaled(target.FileId, journal{Op: journalCopy}, func() error {
+		var err error
+		if hashes != nil {
+			// references are taken before the chunk list that holds them is written
+			for i := 0; err == nil && i < len(hashes); i++ {
+				err = changeChunkRefs(hashes[i], nil, 1)
+				if err != nil {
+					for _, hash := range hashes[:i] {
+						changeChunkRefs(hash, nil, -1)
+					}
+				}
+			}
+			if err == nil {
+				err = writeManifest(target.FileId, 1, hashes)
+			}
+		} else {
+			err = linkOrCopy(versionPath(fileId, source.Version), versionPath(target.FileId, 1))
+		}
 		if err != nil {
-			return FileServerResult{}, &FileServerError{
+			return &FileServerError{
 				Code:   http.StatusInternalServerError,
-				Detail: err.Error(),
+				Detail: "Error copying file",
 			}
 		}
-		metadata := utils.ReadJsonData[models.FileMetadata](metadataFile)
-		metadata.Filename = metadataUpdate.Filename
-		metadata.UpdatedAt = time.Now().Unix()
-		path := filepath.Join(FILES_DIR, fileId)
-		jsonData := utils.GetJsonData(metadata)
-		err = os.WriteFile(filepath.Join(path, METADATA_FILE), jsonData, PERMISSIONS)
+
+		now := time.Now().Unix()
+		target.Size = source.Size
+		target.Version = 1
+		target.Revision = 1
+		target.CreatedAt, target.UpdatedAt = now, now
+		err = writeVersions(target.FileId, []models.FileVersion{
+			{FileId: target.FileId, Version: 1, Size: source.Size, CreatedAt: now},
+		})
 		if err != nil {
-			return FileServerResult{}, &FileServerError{
+			return err
+		}
+		return writeMetadata(target)
+	})
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	return FileServerResult{FileId: target.FileId}, nil
+}
+
+func (fsb FileSystemBackend) DeleteFile(fileId string, revision *int64) (bool, error) {
+	defer lockFile(fileId)()
+	metadata, err := readActiveMetadata(fileId)
+	if err != nil {
+		return false, err
+	}
+	// revision is compared under the lock of the file
+	if revision != nil && *revision != metadata.Revision {
+		return false, revisionConflictError(fileId, *revision)
+	}
+	metadata.DeletedAt = time.Now().Unix()
+	metadata.Revision++
+	err = writeMetadata(metadata)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApplyBatch is best effort, files are changed one by one and applied operations stay
+// when a later one fails
+func (fsb FileSystemBackend) ApplyBatch(operations []BatchOperation) []error {
+	errs := make([]error, len(operations))
+	for i, operation := range operations {
+		switch operation.Kind {
+		case BatchDelete:
+			_, errs[i] = fsb.DeleteFile(operation.FileId, nil)
+		case BatchUpdate:
+			_, errs[i] = fsb.UpdateFile(utils.ChunkResult{IsLastChunk: true}, operation.FileId, operation.Update)
+		}
+	}
+	return errs
+}
+
+func (fsb FileSystemBackend) UndeleteFile(fileId string) (bool, error) {
+	defer lockFile(fileId)()
+	metadata, err := readMetadata(fileId)
+	if err != nil {
+		return false, err
+	}
+	if metadata.DeletedAt == 0 {
+		return false, &FileServerError{
+			Code:   http.StatusConflict,
+			Detail: "File is not deleted",
+		}
+	}
+	metadata.DeletedAt = 0
+	metadata.Revision++
+	err = writeMetadata(metadata)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DiscardAbandonedVersions returns abandoned files to their state before the pending version
+// started, the way Recover rolls back an interrupted change. A new file is removed
+func (fsb FileSystemBackend) DiscardAbandonedVersions(now int64) ([]AbandonedVersion, error) {
+	files, err := filesIndex.list()
+	if err != nil {
+		return nil, err
+	}
+	var discarded []AbandonedVersion
+	for _, metadata := range files {
+		abandoned, found, err := discardAbandonedVersion(metadata.FileId, abandonedBefore(now))
+		if err != nil {
+			return discarded, err
+		}
+		if found {
+			discarded = append(discarded, abandoned)
+		}
+	}
+	return discarded, nil
+}
+
+func discardAbandonedVersion(fileId string, before int64) (AbandonedVersion, bool, error) {
+	defer lockFile(fileId)()
+	metadata, err := readMetadata(fileId)
+	if err != nil {
+		return AbandonedVersion{}, false, err
+	}
+	versions, err := readVersions(fileId)
+	if err != nil || len(versions) == 0 {
+		return AbandonedVersion{}, false, err
+	}
+	latest := versions[len(versions)-1]
+	// versions written before updatedAt was kept have only the time they started
+	if !latest.Pending || max(latest.CreatedAt, latest.UpdatedAt) >= before {
+		return AbandonedVersion{}, false, nil
+	}
+
+	abandoned := AbandonedVersion{
+		FileId:  fileId,
+		Version: latest.Version,
+		Size:    latest.Size,
+		Tenant:  metadata.Tenant,
+		Owner:   metadata.Owner,
+		Purged:  len(versions) == 1,
+	}
+	entry := journal{Op: journalDiscard, Versions: versions[:len(versions)-1]}
+	if !abandoned.Purged {
+		entry.Metadata = models.NewStoredMetadata(&metadata)
+	}
+	err = writeJournal(fileId, entry)
+	if err != nil {
+		return abandoned, false, err
+	}
+	return abandoned, true, rollback(fileId, entry)
+}
+
+func (fsb FileSystemBackend) PurgeFile(fileId string) (bool, error) {
+	defer lockFile(fileId)()
+	versions, err := readVersions(fileId)
+	if err != nil {
+		return false, err
+	}
+	// a purge interrupted by a crash is finished by Recover
+	err = writeJournal(fileId, journal{Op: journalPurge})
+	if err != nil {
+		return false, err
+	}
+	err = filesIndex.remove(fileId)
+	if err != nil {
+		return false, err
+	}
+	// shared chunks are removed once no version references them, a chunk list
+	// is removed first so that it never names a released chunk
+	for _, fileVersion := range versions {
+		hashes, err := readManifest(fileId, fileVersion.Version)
+		if err == nil && hashes != nil {
+			err = os.Remove(manifestPath(fileId, fileVersion.Version))
+		}
+		for i := 0; err == nil && i < len(hashes); i++ {
+			err = changeChunkRefs(hashes[i], nil, -1)
+		}
+		if err != nil {
+			filesIndex.refresh(fileId)
+			return false, &FileServerError{
 				Code:   http.StatusInternalServerError,
-				Detail: "Error writing metadata file",
+				Detail: "Error releasing chunks",
 			}
 		}
 	}
-	return result, nil
-}
 
-func (fsb FileSystemBackend) DeleteFile(fileId string) (bool, error) {
-	err := os.RemoveAll(filepath.Join(FILES_DIR, fileId))
+	err = removeFileDir(fileId)
 	if err != nil {
+		filesIndex.refresh(fileId)
 		return false, &FileServerError{
 			Code:   http.StatusInternalServerError,
 			Detail: "Error deleting file",
 		}
 	}
+	searchIndex.remove(fileId)
+	return true, nil
+}
+
+func (fsb FileSystemBackend) SetFileKey(fileId string, keyId string, wrappedKey string) (bool, error) {
+	defer lockFile(fileId)()
+	metadata, err := readMetadata(fileId)
+	if err != nil {
+		return false, err
+	}
+	metadata.KeyId = keyId
+	metadata.WrappedKey = wrappedKey
+	err = writeMetadata(metadata)
+	if err != nil {
+		return false, err
+	}
 	return true, nil
 }
@@ -0,0 +1,195 @@
+package backends
+
+import (
+	"errors"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkErrorCode(t *testing.T, err error, code int, action string) {
+	t.Helper()
+	var serverErr *FileServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != code {
+		t.Errorf("%s returned %v, expected %d", action, err, code)
+	}
+}
+
+func TestFinishedVersionsAreImmutable(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	uploadTestFile(t, fsb, "file-1", []byte("first"))
+	_, err := fsb.CopyFile("file-1", models.FileMetadata{FileId: "copy-1", Filename: "copy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the copy shares data of the finished version through a hard link
+	_, err = fsb.UploadFile(testChunk("file-1", 2, 2, []byte(" appended")), "file-1")
+	checkErrorCode(t, err, http.StatusConflict, "chunk of a finished file")
+	_, err = fsb.UpdateFile(testChunk("file-1", 2, 2, []byte(" appended")), "file-1", FileMetadataUpdate{})
+	checkErrorCode(t, err, http.StatusConflict, "chunk of a finished version")
+	checkContent(t, fsb, "file-1", []byte("first"), 1)
+	checkContent(t, fsb, "copy-1", []byte("first"), 1)
+}
+
+func TestPendingVersionsCanNotBeReadOrRestored(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	uploadTestFile(t, fsb, "file-1", []byte("first"))
+	_, err := fsb.UpdateFile(testChunk("file-1", 1, 2, []byte("second ")), "file-1", FileMetadataUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := fsb.GetFileVersions("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Pending || !versions[1].Pending {
+		t.Fatalf("file has versions %+v, expected the second one pending", versions)
+	}
+	_, err = fsb.GetFileVersion("file-1", 2)
+	checkErrorCode(t, err, http.StatusNotFound, "read of a pending version")
+	_, err = fsb.RestoreFileVersion("file-1", 2)
+	checkErrorCode(t, err, http.StatusNotFound, "restore of a pending version")
+
+	_, err = fsb.UpdateFile(testChunk("file-1", 2, 2, []byte("version")), "file-1", FileMetadataUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := fsb.GetFileVersion("file-1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.File) != "second version" {
+		t.Errorf("finished version has %q", result.File)
+	}
+}
+
+func TestPendingFileCanNotBeCopied(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	_, err := fsb.UploadFile(testChunk("file-1", 1, 2, []byte("first")), "file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fsb.CopyFile("file-1", models.FileMetadata{FileId: "copy-1", Filename: "copy"})
+	checkErrorCode(t, err, http.StatusConflict, "copy of a pending file")
+}
+
+func TestDeleteComparesRevision(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	uploadTestFile(t, fsb, "file-1", []byte("content"))
+
+	stale := int64(5)
+	_, err := fsb.DeleteFile("file-1", &stale)
+	checkErrorCode(t, err, http.StatusConflict, "delete of a changed file")
+	current := int64(1)
+	_, err = fsb.DeleteFile("file-1", &current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fsb.DeleteFile("file-1", nil)
+	checkErrorCode(t, err, http.StatusNotFound, "delete of a file in trash")
+}
+
+func TestAbandonedVersionsAreDiscarded(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		fsb := openTestBackend(t, dedup)
+		uploadTestFile(t, fsb, "file-1", []byte("first"))
+		_, err := fsb.UpdateFile(testChunk("file-1", 1, 2, []byte("abandoned ")), "file-1", FileMetadataUpdate{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fsb.UploadFile(testChunk("file-2", 1, 2, []byte("new file")), "file-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		discarded, err := fsb.DiscardAbandonedVersions(time.Now().Unix())
+		if err != nil || len(discarded) != 0 {
+			t.Fatalf("fresh uploads were discarded: %v, %v", discarded, err)
+		}
+		later := time.Now().Add(stagedUploadTimeout + time.Minute).Unix()
+		discarded, err = fsb.DiscardAbandonedVersions(later)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(discarded) != 2 {
+			t.Fatalf("discarded %+v, expected both uploads", discarded)
+		}
+		for _, version := range discarded {
+			if version.Purged != (version.FileId == "file-2") {
+				t.Errorf("dedup %v: %s discarded with purged %v", dedup, version.FileId, version.Purged)
+			}
+		}
+
+		result, err := fsb.GetFile("file-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions, err := fsb.GetFileVersions("file-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result.File) != "first" || len(versions) != 1 {
+			t.Errorf("dedup %v: file has %q in %d versions", dedup, result.File, len(versions))
+		}
+		stored, err := storedVersions("file-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 {
+			t.Errorf("dedup %v: %d versions are left on disk, expected 1", dedup, len(stored))
+		}
+		if dedup {
+			_, err = os.Stat(chunkPath(chunkHash([]byte("abandoned "))))
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("chunk of the discarded version is left: %v", err)
+			}
+		}
+		_, err = os.Stat(fileDir("file-2"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("directory of the abandoned new file is left: %v", err)
+		}
+		_, err = fsb.UpdateFile(testChunk("file-1", 2, 2, []byte("late")), "file-1", FileMetadataUpdate{})
+		checkErrorCode(t, err, http.StatusConflict, "chunk of a discarded version")
+	}
+}
+
+func TestKeyFieldsAreStoredButNotSent(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	chunk := testChunk("file-1", 1, 1, []byte("sealed"))
+	metadata := models.FileMetadata{FileId: "file-1", Filename: "test", KeyId: "key-1", WrappedKey: "wrapped"}
+	chunk.JsonData = utils.GetJsonData(models.NewStoredMetadata(&metadata))
+	_, err := fsb.UploadFile(chunk, "file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// key fields are read back from the metadata file and from the index log
+	restart()
+	files, err := fsb.GetStoredFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].KeyId != "key-1" || files[0].WrappedKey != "wrapped" {
+		t.Fatalf("index has %v, expected file-1 with its data key", files)
+	}
+	stored, err := readMetadata("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.KeyId != "key-1" || stored.WrappedKey != "wrapped" {
+		t.Errorf("metadata file has key %q wrapped as %q", stored.KeyId, stored.WrappedKey)
+	}
+
+	response := string(utils.GetJsonData(stored))
+	for _, field := range []string{"keyId", "wrappedKey", "keyFingerprint"} {
+		if strings.Contains(response, field) {
+			t.Errorf("%s is sent in %s", field, response)
+		}
+	}
+}
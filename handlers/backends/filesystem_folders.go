@@ -0,0 +1,146 @@
+package backends
+
+import (
+	"errors"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// every folder is a json file named by its id
+const FOLDERS_DIR = "folders"
+
+// guards sibling name checks of concurrent folder changes
+var foldersLock sync.Mutex
+
+func folderPath(folderId string) string {
+	return filepath.Join(FOLDERS_DIR, folderId+".json")
+}
+
+func readFolder(folderId string) (models.Folder, error) {
+	// ids come from urls, they must not leave the folders directory
+	if folderId == "" || strings.ContainsAny(folderId, `/\.`) {
+		return models.Folder{}, folderNotFoundError(folderId)
+	}
+	data, err := os.ReadFile(folderPath(folderId))
+	if err != nil {
+		return models.Folder{}, folderNotFoundError(folderId)
+	}
+	return utils.ReadJsonData[models.Folder](data), nil
+}
+
+func writeFolder(folder models.Folder) error {
+	err := os.MkdirAll(FOLDERS_DIR, PERMISSIONS)
+	if err == nil {
+		err = writeFileAtomic(folderPath(folder.FolderId), utils.GetJsonData(folder))
+	}
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error writing folder file",
+		}
+	}
+	return nil
+}
+
+func readFolders() ([]models.Folder, error) {
+	entries, err := os.ReadDir(FOLDERS_DIR)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]models.Folder, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		folder, err := readFolder(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// checkFolderName returns 409 if parent already has a folder with the name, other than the folder itself
+func checkFolderName(folder models.Folder) error {
+	folders, err := readFolders()
+	if err != nil {
+		return err
+	}
+	for _, sibling := range folders {
+		if sibling.ParentId == folder.ParentId && sibling.Name == folder.Name && sibling.FolderId != folder.FolderId {
+			return folderExistsError(folder.Name)
+		}
+	}
+	return nil
+}
+
+func (fsb FileSystemBackend) CreateFolder(folder models.Folder) error {
+	foldersLock.Lock()
+	defer foldersLock.Unlock()
+	err := checkFolderName(folder)
+	if err != nil {
+		return err
+	}
+	return writeFolder(folder)
+}
+
+func (fsb FileSystemBackend) GetFolder(folderId string) (models.Folder, error) {
+	return readFolder(folderId)
+}
+
+func (fsb FileSystemBackend) GetFolders(parentId string) ([]models.Folder, error) {
+	folders, err := readFolders()
+	if err != nil {
+		return nil, err
+	}
+	children := []models.Folder{}
+	for _, folder := range folders {
+		if folder.ParentId == parentId {
+			children = append(children, folder)
+		}
+	}
+	slices.SortFunc(children, func(a models.Folder, b models.Folder) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return children, nil
+}
+
+func (fsb FileSystemBackend) UpdateFolder(folder models.Folder) error {
+	foldersLock.Lock()
+	defer foldersLock.Unlock()
+	stored, err := readFolder(folder.FolderId)
+	if err != nil {
+		return err
+	}
+	err = checkFolderName(folder)
+	if err != nil {
+		return err
+	}
+	folder.CreatedAt = stored.CreatedAt
+	return writeFolder(folder)
+}
+
+func (fsb FileSystemBackend) DeleteFolder(folderId string) (bool, error) {
+	_, err := readFolder(folderId)
+	if err != nil {
+		return false, err
+	}
+	err = os.Remove(folderPath(folderId))
+	if err != nil {
+		return false, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error deleting folder",
+		}
+	}
+	return true, nil
+}
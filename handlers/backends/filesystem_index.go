@@ -0,0 +1,236 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// INDEX_FILE keeps metadata of all files as a log of changes, so listing never walks file directories.
+// Each line is a record with the new metadata of a file or without metadata for a removed file
+const INDEX_FILE = "index.log"
+
+// the log is rewritten with one record per file once it has this many extra records
+const indexCompactRecords = 10000
+
+type indexRecord struct {
+	FileId   string                 `json:"fileId"`
+	Metadata *models.StoredMetadata `json:"metadata,omitempty"`
+}
+
+type metadataIndex struct {
+	lock    sync.Mutex
+	loaded  bool
+	files   map[string]models.FileMetadata
+	log     *os.File
+	records int
+	// files that are not in trash and expiry of those that have one, so visible files are counted
+	// without walking all of them
+	live     int
+	expiring map[string]int64
+}
+
+var filesIndex = &metadataIndex{}
+
+func indexPath() string {
+	return filepath.Join(FILES_DIR, INDEX_FILE)
+}
+
+// loadLocked reads the log, or metadata of every file if there is no log yet, lock must be held.
+// Records are written before metadata files, a change interrupted by a crash can only be among
+// the last records, as every change holds its file lock. Files of these records are read again
+func (index *metadataIndex) loadLocked() error {
+	if index.loaded {
+		return nil
+	}
+	index.files = map[string]models.FileMetadata{}
+	index.live = 0
+	index.expiring = map[string]int64{}
+	data, err := os.ReadFile(indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		err = scanFileIds(shardLevels, func(fileId string) error {
+			index.readLocked(fileId)
+			return nil
+		})
+	} else if err == nil {
+		var tail []string
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			// the last record may be cut by a crash
+			record, err := decodeJson[indexRecord](scanner.Bytes())
+			if err != nil {
+				continue
+			}
+			index.applyLocked(record)
+			tail = append(tail, record.FileId)
+			if len(tail) > 2*len(fileLocks) {
+				tail = tail[len(tail)-len(fileLocks):]
+			}
+		}
+		for _, fileId := range tail {
+			index.readLocked(fileId)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = index.compactLocked()
+	if err != nil {
+		return err
+	}
+	index.loaded = true
+	return nil
+}
+
+// readLocked takes metadata of a file from its directory, lock must be held
+func (index *metadataIndex) readLocked(fileId string) {
+	metadata, err := readMetadata(fileId)
+	var serverErr *FileServerError
+	if errors.As(err, &serverErr) && serverErr.Code != http.StatusNotFound {
+		log.Printf("Skipping file %s: %v", fileId, err)
+	}
+	if err != nil {
+		index.setLocked(fileId, nil)
+		return
+	}
+	index.setLocked(fileId, &metadata)
+}
+
+func (index *metadataIndex) applyLocked(record indexRecord) {
+	index.setLocked(record.FileId, record.Metadata.Metadata())
+}
+
+// setLocked replaces metadata of a file, nil removes the file, lock must be held
+func (index *metadataIndex) setLocked(fileId string, metadata *models.FileMetadata) {
+	previous, found := index.files[fileId]
+	if found && previous.DeletedAt == 0 {
+		index.live--
+		delete(index.expiring, fileId)
+	}
+	if metadata == nil {
+		delete(index.files, fileId)
+		return
+	}
+	index.files[fileId] = *metadata
+	if metadata.DeletedAt == 0 {
+		index.live++
+		if metadata.ExpiresAt != 0 {
+			index.expiring[fileId] = metadata.ExpiresAt
+		}
+	}
+}
+
+// compactLocked replaces the log with one record per file, lock must be held
+func (index *metadataIndex) compactLocked() error {
+	var data []byte
+	for fileId, metadata := range index.files {
+		data = append(data, utils.GetJsonData(indexRecord{FileId: fileId, Metadata: models.NewStoredMetadata(&metadata)})...)
+		data = append(data, '\n')
+	}
+	if index.log != nil {
+		index.log.Close()
+		index.log = nil
+	}
+	err := writeFileAtomic(indexPath(), data)
+	if err != nil {
+		return err
+	}
+	index.log, err = os.OpenFile(indexPath(), os.O_WRONLY|os.O_APPEND, PERMISSIONS)
+	index.records = len(index.files)
+	return err
+}
+
+func (index *metadataIndex) appendLocked(record indexRecord) error {
+	line := append(utils.GetJsonData(record), '\n')
+	_, err := index.log.Write(line)
+	if err == nil {
+		err = index.log.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	index.records++
+	index.applyLocked(record)
+	if index.records > 2*len(index.files)+indexCompactRecords {
+		return index.compactLocked()
+	}
+	return nil
+}
+
+func (index *metadataIndex) change(fileId string, metadata *models.FileMetadata) error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	err := index.loadLocked()
+	if err == nil {
+		err = index.appendLocked(indexRecord{FileId: fileId, Metadata: models.NewStoredMetadata(metadata)})
+	}
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error writing metadata index",
+		}
+	}
+	return nil
+}
+
+func (index *metadataIndex) put(metadata models.FileMetadata) error {
+	return index.change(metadata.FileId, &metadata)
+}
+
+func (index *metadataIndex) remove(fileId string) error {
+	return index.change(fileId, nil)
+}
+
+// refresh takes metadata of a file from its directory again after a failed change
+func (index *metadataIndex) refresh(fileId string) {
+	metadata, err := readMetadata(fileId)
+	if err == nil {
+		err = index.put(metadata)
+	} else {
+		err = index.remove(fileId)
+	}
+	if err != nil {
+		log.Printf("Failed to refresh metadata index of %s: %v", fileId, err)
+	}
+}
+
+// list returns metadata of all files in no particular order
+func (index *metadataIndex) list() ([]models.FileMetadata, error) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	err := index.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]models.FileMetadata, 0, len(index.files))
+	for _, metadata := range index.files {
+		files = append(files, metadata)
+	}
+	return files, nil
+}
+
+// countVisible returns the number of files that are neither in trash nor expired,
+// only files with an expiry are looked at
+func (index *metadataIndex) countVisible(now int64) (int64, error) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	err := index.loadLocked()
+	if err != nil {
+		return 0, err
+	}
+	visible := index.live
+	for _, expiresAt := range index.expiring {
+		if expiresAt <= now {
+			visible--
+		}
+	}
+	return int64(visible), nil
+}
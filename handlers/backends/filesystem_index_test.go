@@ -0,0 +1,56 @@
+package backends
+
+import (
+	"hybrid-storage/utils"
+	"testing"
+	"time"
+)
+
+func checkTotal(t *testing.T, fsb FileSystemBackend, expected int64) {
+	t.Helper()
+	files, err := fsb.GetAllFiles(FilesQuery{Page: 1, PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files.TotalItems == nil || *files.TotalItems != expected {
+		t.Errorf("listed total %v, expected %d", files.TotalItems, expected)
+	}
+}
+
+func TestIndexCountsVisibleFiles(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	for _, fileId := range []string{"file-1", "file-2", "file-3", "file-4"} {
+		uploadTestFile(t, fsb, fileId, []byte(fileId))
+	}
+	checkTotal(t, fsb, 4)
+
+	_, err := fsb.DeleteFile("file-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Unix() - 10
+	future := time.Now().Unix() + 3600
+	_, err = fsb.UpdateFile(utils.ChunkResult{IsLastChunk: true}, "file-2", FileMetadataUpdate{ExpiresAt: &past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fsb.UpdateFile(utils.ChunkResult{IsLastChunk: true}, "file-3", FileMetadataUpdate{ExpiresAt: &future})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotal(t, fsb, 2)
+
+	_, err = fsb.UndeleteFile("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fsb.PurgeFile("file-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotal(t, fsb, 3)
+
+	// the count is built again when the index is loaded from its log
+	restart()
+	checkTotal(t, fsb, 3)
+}
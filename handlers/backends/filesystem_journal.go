@@ -0,0 +1,407 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JOURNAL_FILE exists only while a change of several steps is in progress,
+// it holds the state the file is rolled back to if the change does not finish
+const JOURNAL_FILE = "journal.json"
+
+const TEMP_SUFFIX = ".tmp"
+
+const (
+	journalUpload  = "upload"
+	journalUpdate  = "update"
+	journalRestore = "restore"
+	journalCopy    = "copy"
+	journalPurge   = "purge"
+	// drops an abandoned pending version, finished by rolling back to the state it names
+	journalDiscard = "discard"
+)
+
+type journal struct {
+	Op string `json:"op"`
+	// state before the change, nil metadata marks a file created by the change
+	Metadata *models.StoredMetadata `json:"metadata,omitempty"`
+	Versions []models.FileVersion   `json:"versions,omitempty"`
+	// newest version and its length before the change, in bytes of data or in hashes of its chunk list
+	Version int64 `json:"version,omitempty"`
+	Length  int64 `json:"length,omitempty"`
+}
+
+func journalPath(fileId string) string {
+	return filepath.Join(fileDir(fileId), JOURNAL_FILE)
+}
+
+// writeFileAtomic replaces a file with data written to a temporary file first,
+// readers see either the old or the new content even after a crash
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tempFile, err := os.CreateTemp(dir, filepath.Base(path)+".*"+TEMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFile.Name(), PERMISSIONS)
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes created, renamed and removed entries of a directory durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func decodeJson[T any](data []byte) (T, error) {
+	var item T
+	err := json.Unmarshal(data, &item)
+	return item, err
+}
+
+// versionLength is the number of bytes or chunk hashes stored for a version
+func versionLength(fileId string, version int64) (int64, error) {
+	hashes, err := readManifest(fileId, version)
+	if err != nil || hashes != nil {
+		return int64(len(hashes)), err
+	}
+	info, err := os.Stat(versionPath(fileId, version))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// newJournal takes a snapshot of a file before a change, nil metadata marks a new file
+func newJournal(op string, fileId string, metadata *models.FileMetadata, versions []models.FileVersion) (journal, error) {
+	entry := journal{Op: op, Versions: slices.Clone(versions), Metadata: models.NewStoredMetadata(metadata)}
+	if len(versions) > 0 {
+		entry.Version = versions[len(versions)-1].Version
+		length, err := versionLength(fileId, entry.Version)
+		if err != nil {
+			return entry, err
+		}
+		entry.Length = length
+	}
+	return entry, nil
+}
+
+func writeJournal(fileId string, entry journal) error {
+	err := writeFileAtomic(journalPath(fileId), utils.GetJsonData(entry))
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error writing journal",
+		}
+	}
+	return nil
+}
+
+func removeJournal(fileId string) error {
+	err := os.Remove(journalPath(fileId))
+	if err == nil {
+		err = syncDir(fileDir(fileId))
+	}
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error removing journal",
+		}
+	}
+	return nil
+}
+
+// journaled runs a change of several steps, a failed change is rolled back at once
+// and a change interrupted by a crash is rolled back by Recover
+func journaled(fileId string, entry journal, change func() error) error {
+	err := writeJournal(fileId, entry)
+	if err != nil {
+		return err
+	}
+	err = change()
+	if err != nil {
+		rollbackErr := rollback(fileId, entry)
+		if rollbackErr != nil {
+			log.Printf("Failed to roll back %s of %s: %v", entry.Op, fileId, rollbackErr)
+		}
+		return err
+	}
+	return removeJournal(fileId)
+}
+
+// storedVersions lists versions that have data or a chunk list on disk
+func storedVersions(fileId string) ([]int64, error) {
+	entries, err := os.ReadDir(filepath.Join(fileDir(fileId), VERSIONS_DIR))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []int64
+	for _, entry := range entries {
+		version, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), MANIFEST_SUFFIX), 10, 64)
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+// truncateVersion cuts a version back to its length before the change,
+// chunk lists hold references of their chunks so dropped hashes are released
+func truncateVersion(fileId string, version int64, length int64) error {
+	hashes, err := readManifest(fileId, version)
+	if err != nil {
+		return err
+	}
+	if hashes == nil {
+		err = os.Truncate(versionPath(fileId, version), length)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if int64(len(hashes)) <= length {
+		return nil
+	}
+	err = writeManifest(fileId, version, hashes[:length])
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes[length:] {
+		err = changeChunkRefs(hash, nil, -1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback returns a file to the state recorded in its journal. Versions written by the change
+// are dropped, a new file is removed and an interrupted purge is finished
+func rollback(fileId string, entry journal) error {
+	kept := map[int64]bool{}
+	if entry.Op != journalPurge {
+		for _, fileVersion := range entry.Versions {
+			kept[fileVersion.Version] = true
+		}
+	}
+	versions, err := storedVersions(fileId)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if kept[version] {
+			continue
+		}
+		err = releaseManifest(fileId, version)
+		if err != nil {
+			return err
+		}
+		for _, path := range []string{manifestPath(fileId, version), versionPath(fileId, version)} {
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	if entry.Op == journalPurge || entry.Metadata == nil {
+		searchIndex.remove(fileId)
+		err = filesIndex.remove(fileId)
+		if err != nil {
+			return err
+		}
+		return removeFileDir(fileId)
+	}
+	if entry.Version > 0 {
+		err = truncateVersion(fileId, entry.Version, entry.Length)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeVersions(fileId, entry.Versions)
+	if err != nil {
+		return err
+	}
+	err = writeMetadata(*entry.Metadata.Metadata())
+	if err != nil {
+		return err
+	}
+	return removeJournal(fileId)
+}
+
+// removeTempFiles deletes leftovers of atomic writes interrupted by a crash
+func removeTempFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), TEMP_SUFFIX) {
+			err = os.Remove(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Recover rolls back changes interrupted by a crash, removes leftovers of interrupted writes and
+// migrates files stored before versions existed. It must run before the backend serves requests,
+// returns the number of recovered files
+func (fsb FileSystemBackend) Recover() (int, error) {
+	for _, dir := range []string{FILES_DIR, FOLDERS_DIR, CHUNKS_DIR} {
+		err := removeTempFiles(dir)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := migrateLegacyFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	err = scanFileIds(shardLevels, func(fileId string) error {
+		for _, dir := range []string{fileDir(fileId), filepath.Join(fileDir(fileId), VERSIONS_DIR)} {
+			err := removeTempFiles(dir)
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err := os.ReadFile(journalPath(fileId))
+		if errors.Is(err, os.ErrNotExist) {
+			// directory of a new file created right before a crash
+			_, err = os.Stat(filepath.Join(fileDir(fileId), METADATA_FILE))
+			if errors.Is(err, os.ErrNotExist) {
+				recovered++
+				err = filesIndex.remove(fileId)
+				if err == nil {
+					err = removeFileDir(fileId)
+				}
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := decodeJson[journal](data)
+		if err != nil {
+			return err
+		}
+		recovered++
+		return rollback(fileId, entry)
+	})
+	if err == nil && recovered > 0 {
+		err = rebuildChunkRefs()
+	}
+	return recovered, err
+}
+
+// rebuildChunkRefs counts references of shared chunks from chunk lists of all versions.
+// A crash may leave a reference without a chunk list, such chunks are removed here
+func rebuildChunkRefs() error {
+	chunksLock.Lock()
+	defer chunksLock.Unlock()
+
+	refs := map[string]int64{}
+	err := scanFileIds(shardLevels, func(fileId string) error {
+		versions, err := storedVersions(fileId)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			hashes, err := readManifest(fileId, version)
+			if err != nil {
+				return err
+			}
+			for _, hash := range hashes {
+				refs[hash]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	prefixDirs, err := os.ReadDir(CHUNKS_DIR)
+	if errors.Is(err, os.ErrNotExist) {
+		prefixDirs = nil
+	} else if err != nil {
+		return err
+	}
+	for _, prefixDir := range prefixDirs {
+		dir := filepath.Join(CHUNKS_DIR, prefixDir.Name())
+		err = removeTempFiles(dir)
+		if err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			hash := entry.Name()
+			if strings.HasSuffix(hash, ".refs") {
+				continue
+			}
+			if refs[hash] == 0 {
+				err = os.Remove(chunkPath(hash))
+				if err == nil {
+					err = os.Remove(refsPath(hash))
+				}
+			} else {
+				err = writeFileAtomic(refsPath(hash), []byte(strconv.FormatInt(refs[hash], 10)))
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			delete(refs, hash)
+		}
+	}
+	for hash := range refs {
+		log.Printf("Chunk %s is referenced but missing", hash)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempDir moves to a new working directory, files are stored relative to it
+func useTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		restart()
+		os.Chdir(dir)
+	})
+	restart()
+}
+
+func openTestBackend(t *testing.T, dedup bool) FileSystemBackend {
+	useTempDir(t)
+	_, err := NewFileSystemBackend(DEFAULT_SHARD_LEVELS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FileSystemBackend{Dedup: dedup}
+}
+
+// restart drops state kept in memory, as if the server was restarted
+func restart() {
+	if filesIndex.log != nil {
+		filesIndex.log.Close()
+	}
+	filesIndex = &metadataIndex{}
+	searchIndex = invertedIndex{}
+}
+
+func testChunk(fileId string, chunkNumber int, totalChunks int, data []byte) utils.ChunkResult {
+	return utils.ChunkResult{
+		FormDataChunk: utils.NewMemoryChunk(data),
+		ChunkNumber:   chunkNumber,
+		FileId:        fileId,
+		Size:          int64(len(data)),
+		IsLastChunk:   chunkNumber == totalChunks,
+		JsonData:      utils.GetJsonData(models.FileMetadata{FileId: fileId, Filename: "test"}),
+	}
+}
+
+func uploadTestFile(t *testing.T, fsb FileSystemBackend, fileId string, chunks ...[]byte) {
+	for i, data := range chunks {
+		_, err := fsb.UploadFile(testChunk(fileId, i+1, len(chunks), data), fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// interruptChange leaves a change of a file the way a crash after its data was written leaves it
+func interruptChange(t *testing.T, fsb FileSystemBackend, op string, fileId string, chunk utils.ChunkResult) {
+	metadata, err := readMetadata(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := readVersions(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := newJournal(op, fileId, &metadata, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeJournal(fileId, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, versions, err = fsb.writeVersionChunk(fileId, chunk, metadata, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeVersions(fileId, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Revision++
+	err = writeMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recoverBackend(t *testing.T, fsb FileSystemBackend, expected int) {
+	restart()
+	recovered, err := fsb.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != expected {
+		t.Fatalf("recovered %d files, expected %d", recovered, expected)
+	}
+}
+
+func checkContent(t *testing.T, fsb FileSystemBackend, fileId string, expected []byte, expectedVersions int) {
+	result, err := fsb.GetFile(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.File, expected) {
+		t.Errorf("file has %q, expected %q", result.File, expected)
+	}
+	if result.Metadata.Revision != 1 {
+		t.Errorf("file has revision %d, expected 1", result.Metadata.Revision)
+	}
+	versions, err := fsb.GetFileVersions(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != expectedVersions {
+		t.Errorf("file has %d versions, expected %d", len(versions), expectedVersions)
+	}
+	_, err = os.Stat(journalPath(fileId))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("journal of %s is left: %v", fileId, err)
+	}
+}
+
+func TestRecoverRollsBackInterruptedUpdate(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		fsb := openTestBackend(t, dedup)
+		uploadTestFile(t, fsb, "file-1", []byte("first "), []byte("version"))
+
+		interruptChange(t, fsb, journalUpdate, "file-1", testChunk("file-1", 1, 1, []byte("second version")))
+		recoverBackend(t, fsb, 1)
+
+		checkContent(t, fsb, "file-1", []byte("first version"), 1)
+		stored, err := storedVersions("file-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 {
+			t.Errorf("dedup %v: %d versions are left on disk, expected 1", dedup, len(stored))
+		}
+	}
+}
+
+func TestRecoverTruncatesInterruptedChunk(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		fsb := openTestBackend(t, dedup)
+		uploadTestFile(t, fsb, "file-1", []byte("first chunk"))
+		// the file is uploaded in three chunks, the second one is cut by a crash
+		_, err := fsb.UploadFile(testChunk("file-2", 1, 3, []byte("first chunk")), "file-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		interruptChange(t, fsb, journalUpload, "file-2", testChunk("file-2", 2, 3, []byte(" second chunk")))
+		recoverBackend(t, fsb, 1)
+
+		checkContent(t, fsb, "file-2", []byte("first chunk"), 1)
+		_, err = fsb.UploadFile(testChunk("file-2", 2, 2, []byte(" last chunk")), "file-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := fsb.GetFile("file-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result.File) != "first chunk last chunk" {
+			t.Errorf("dedup %v: file has %q after the upload was resumed", dedup, result.File)
+		}
+		// both files share the first chunk, references are counted again after recovery
+		if dedup {
+			refs, err := readRefs(chunkHash([]byte("first chunk")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refs != 2 {
+				t.Errorf("shared chunk has %d references, expected 2", refs)
+			}
+			_, err = os.Stat(chunkPath(chunkHash([]byte(" second chunk"))))
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("chunk written by the interrupted change is left: %v", err)
+			}
+		}
+	}
+}
+
+func TestRecoverRemovesInterruptedNewFile(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	uploadTestFile(t, fsb, "file-1", []byte("kept"))
+
+	// journal of a new file is written before its first chunk
+	err := createFileDir("file-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeJournal("file-2", journal{Op: journalUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(versionPath("file-2", 1), []byte("partial"), PERMISSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash may also come before the journal is written
+	err = createFileDir("file-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover := filepath.Join(fileDir("file-1"), METADATA_FILE+".123"+TEMP_SUFFIX)
+	err = os.WriteFile(leftover, []byte("{"), PERMISSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recoverBackend(t, fsb, 2)
+
+	for _, fileId := range []string{"file-2", "file-3"} {
+		_, err = os.Stat(fileDir(fileId))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("directory of %s is left: %v", fileId, err)
+		}
+	}
+	_, err = os.Stat(leftover)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+	files, err := fsb.GetStoredFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].FileId != "file-1" {
+		t.Errorf("index has %v, expected only file-1", files)
+	}
+	checkContent(t, fsb, "file-1", []byte("kept"), 1)
+}
+
+func TestFailedChangeIsRolledBack(t *testing.T) {
+	fsb := openTestBackend(t, false)
+	uploadTestFile(t, fsb, "file-1", []byte("content"))
+	metadata, err := readMetadata("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := readVersions("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := newJournal(journalUpdate, "file-1", &metadata, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changeErr := errors.New("disk is full")
+	err = journaled("file-1", entry, func() error {
+		updated, versions, err := fsb.writeVersionChunk("file-1", testChunk("file-1", 1, 1, []byte("new content")), metadata, versions)
+		if err != nil {
+			return err
+		}
+		err = writeVersions("file-1", versions)
+		if err != nil {
+			return err
+		}
+		updated.Revision++
+		err = writeMetadata(updated)
+		if err != nil {
+			return err
+		}
+		return changeErr
+	})
+	if err != changeErr {
+		t.Fatalf("journaled returned %v, expected error of the change", err)
+	}
+
+	checkContent(t, fsb, "file-1", []byte("content"), 1)
+	files, err := fsb.GetStoredFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Revision != 1 {
+		t.Errorf("index has %v, expected file-1 with revision 1", files)
+	}
+}
@@ -0,0 +1,353 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LAYOUT_FILE records how file directories are spread over shard directories
+const LAYOUT_FILE = "layout.json"
+
+// every shard level is a directory named by the next two characters of the file id,
+// with four levels the first eight characters of an uuid are used
+const MAX_SHARD_LEVELS = 4
+const DEFAULT_SHARD_LEVELS = 2
+const shardNameLength = 2
+
+// content of files stored before versions existed, it becomes version 1
+const LEGACY_FILE_NAME = "file"
+
+type layout struct {
+	Levels int `json:"levels"`
+	// set while files are moved to another number of levels
+	MigrateTo *int `json:"migrateTo,omitempty"`
+}
+
+// shardLevels is the layout of the files directory. The backend owns its directory,
+// so the layout is shared by the package
+var shardLevels int
+
+func fileDir(fileId string) string {
+	return fileDirIn(shardLevels, fileId)
+}
+
+func fileDirIn(levels int, fileId string) string {
+	// short ids are padded, so that every file gets all levels
+	padded := fileId + strings.Repeat("_", max(0, levels*shardNameLength-len(fileId)))
+	parts := []string{FILES_DIR}
+	for level := 0; level < levels; level++ {
+		parts = append(parts, padded[level*shardNameLength:(level+1)*shardNameLength])
+	}
+	return filepath.Join(append(parts, fileId)...)
+}
+
+// createFileDir creates directories of a new file, new shard directories are made durable too
+func createFileDir(fileId string) error {
+	dir := fileDir(fileId)
+	err := os.MkdirAll(filepath.Join(dir, VERSIONS_DIR), PERMISSIONS)
+	for err == nil && dir != FILES_DIR {
+		dir = filepath.Dir(dir)
+		err = syncDir(dir)
+	}
+	return err
+}
+
+func removeFileDir(fileId string) error {
+	err := os.RemoveAll(fileDir(fileId))
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fileDir(fileId)))
+}
+
+// scanFileIds calls fn with id of every file directory of a layout. Shard directories have
+// two character names and file ids are longer, so files of another layout are skipped
+func scanFileIds(levels int, fn func(fileId string) error) error {
+	return scanShard(FILES_DIR, levels, fn)
+}
+
+func scanShard(dir string, levels int, fn func(fileId string) error) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		isShard := len(entry.Name()) == shardNameLength
+		switch {
+		case levels > 0 && isShard:
+			err = scanShard(filepath.Join(dir, entry.Name()), levels-1, fn)
+		case levels == 0 && !isShard:
+			err = fn(entry.Name())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLayout() (layout, bool, error) {
+	data, err := os.ReadFile(filepath.Join(FILES_DIR, LAYOUT_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return layout{}, false, nil
+	}
+	if err != nil {
+		return layout{}, false, err
+	}
+	stored, err := decodeJson[layout](data)
+	return stored, true, err
+}
+
+func writeLayout(stored layout) error {
+	err := os.MkdirAll(FILES_DIR, PERMISSIONS)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(FILES_DIR, LAYOUT_FILE), utils.GetJsonData(stored))
+}
+
+func checkShardLevels(levels int) error {
+	if levels < 0 || levels > MAX_SHARD_LEVELS {
+		return fmt.Errorf("shard levels must be from 0 to %d, got %d", MAX_SHARD_LEVELS, levels)
+	}
+	return nil
+}
+
+// NewFileSystemBackend opens the files directory with the stored layout, negative levels accept
+// any stored layout. Files stored before layouts existed are kept in a single directory
+func NewFileSystemBackend(levels int) (FileSystemBackend, error) {
+	stored, found, err := readLayout()
+	if err != nil {
+		return FileSystemBackend{}, err
+	}
+	if !found {
+		entries, err := os.ReadDir(FILES_DIR)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return FileSystemBackend{}, err
+		}
+		stored.Levels = levels
+		if len(entries) > 0 {
+			stored.Levels = 0
+		} else if levels < 0 {
+			stored.Levels = DEFAULT_SHARD_LEVELS
+		}
+	}
+	if levels < 0 {
+		levels = stored.Levels
+	}
+	err = checkShardLevels(levels)
+	if err != nil {
+		return FileSystemBackend{}, err
+	}
+	if stored.MigrateTo != nil {
+		return FileSystemBackend{}, fmt.Errorf("migration of files to %d shard levels is not finished, run migrate-layout again", *stored.MigrateTo)
+	}
+	if stored.Levels != levels {
+		return FileSystemBackend{}, fmt.Errorf("files are stored with %d shard levels, run migrate-layout to use %d", stored.Levels, levels)
+	}
+	if !found {
+		err = writeLayout(stored)
+		if err != nil {
+			return FileSystemBackend{}, err
+		}
+	}
+	shardLevels = levels
+	return FileSystemBackend{}, nil
+}
+
+// MigrateLayout moves file directories to another number of shard levels and returns the number
+// of moved files. The server must be stopped, an interrupted migration is finished by running it again
+func MigrateLayout(levels int) (int, error) {
+	err := checkShardLevels(levels)
+	if err != nil {
+		return 0, err
+	}
+	stored, _, err := readLayout()
+	if err != nil {
+		return 0, err
+	}
+	if stored.MigrateTo != nil && *stored.MigrateTo != levels {
+		return 0, fmt.Errorf("migration of files to %d shard levels is not finished", *stored.MigrateTo)
+	}
+	if stored.MigrateTo == nil {
+		// interrupted changes are rolled back while paths of the old layout are still valid
+		_, err = NewFileSystemBackend(-1)
+		if err != nil {
+			return 0, err
+		}
+		if shardLevels == levels {
+			return 0, nil
+		}
+		_, err = FileSystemBackend{}.Recover()
+		if err != nil {
+			return 0, err
+		}
+		stored = layout{Levels: shardLevels, MigrateTo: &levels}
+		err = writeLayout(stored)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	moved := 0
+	err = scanFileIds(stored.Levels, func(fileId string) error {
+		target := fileDirIn(levels, fileId)
+		err := os.MkdirAll(filepath.Dir(target), PERMISSIONS)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(fileDirIn(stored.Levels, fileId), target)
+		if err != nil {
+			return err
+		}
+		moved++
+		err = syncDir(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(fileDirIn(stored.Levels, fileId)))
+	})
+	if err != nil {
+		return moved, err
+	}
+	err = removeEmptyShards(FILES_DIR, stored.Levels)
+	if err != nil {
+		return moved, err
+	}
+	err = writeLayout(layout{Levels: levels})
+	if err != nil {
+		return moved, err
+	}
+	shardLevels = levels
+	return moved, nil
+}
+
+// removeEmptyShards removes shard directories left empty by a migration
+func removeEmptyShards(dir string, levels int) error {
+	if levels == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) != shardNameLength {
+			continue
+		}
+		shard := filepath.Join(dir, entry.Name())
+		err = removeEmptyShards(shard, levels-1)
+		if err != nil {
+			return err
+		}
+		shardEntries, err := os.ReadDir(shard)
+		if err != nil {
+			return err
+		}
+		if len(shardEntries) == 0 {
+			err = os.Remove(shard)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLegacyFiles moves content of files stored before versions existed to version 1.
+// It runs before the metadata index is loaded, so the index is built from migrated metadata
+func migrateLegacyFiles() error {
+	migrated := 0
+	err := scanFileIds(shardLevels, func(fileId string) error {
+		found, err := migrateLegacyFile(fileId)
+		if found {
+			migrated++
+		}
+		return err
+	})
+	if migrated > 0 {
+		log.Printf("Migrated %d files stored without versions", migrated)
+	}
+	return err
+}
+
+// migrateLegacyFile writes versions file last, a migration interrupted by a crash is repeated
+func migrateLegacyFile(fileId string) (bool, error) {
+	dir := fileDir(fileId)
+	for _, name := range []string{VERSIONS_FILE, JOURNAL_FILE} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	metadataFile, err := os.ReadFile(filepath.Join(dir, METADATA_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	stored, err := decodeJson[models.StoredMetadata](metadataFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse metadata of %s: %w", fileId, err)
+	}
+	metadata := stored.Metadata()
+
+	err = os.MkdirAll(filepath.Join(dir, VERSIONS_DIR), PERMISSIONS)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(filepath.Join(dir, LEGACY_FILE_NAME), versionPath(fileId, 1))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	info, err := os.Stat(versionPath(fileId, 1))
+	if errors.Is(err, os.ErrNotExist) {
+		// metadata without content is a new file interrupted by a crash, Recover removes it
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = syncDir(filepath.Join(dir, VERSIONS_DIR))
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// files of that time were shared by everyone and had a single version
+	metadata.Version = 1
+	metadata.Size = info.Size()
+	metadata.Revision = max(metadata.Revision, 1)
+	if metadata.Tenant == "" {
+		metadata.Tenant = utils.DefaultTenant
+	}
+	if metadata.Owner == "" {
+		metadata.Owner = utils.DefaultUser
+	}
+	err = writeFileAtomic(filepath.Join(dir, METADATA_FILE), utils.GetJsonData(models.NewStoredMetadata(metadata)))
+	if err != nil {
+		return false, err
+	}
+	versions := []models.FileVersion{{
+		FileId:    fileId,
+		Version:   1,
+		Size:      info.Size(),
+		CreatedAt: metadata.CreatedAt,
+	}}
+	return true, writeFileAtomic(filepath.Join(dir, VERSIONS_FILE), utils.GetJsonData(versions))
+}
@@ -0,0 +1,77 @@
+package backends
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverMigratesFilesWithoutVersions(t *testing.T) {
+	useTempDir(t)
+	// files stored before versions existed keep content next to metadata
+	dir := filepath.Join(FILES_DIR, "legacy-file")
+	err := os.MkdirAll(dir, PERMISSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, LEGACY_FILE_NAME), []byte("old content"), PERMISSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := `{"fileId":"legacy-file","filename":"report","extension":".txt","createdAt":100,"updatedAt":200}`
+	err = os.WriteFile(filepath.Join(dir, METADATA_FILE), []byte(metadata), PERMISSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsb, err := NewFileSystemBackend(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shardLevels != 0 {
+		t.Fatalf("files without layout got %d shard levels", shardLevels)
+	}
+	_, err = fsb.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := fsb.GetFile("legacy-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.File) != "old content" {
+		t.Errorf("file has %q", result.File)
+	}
+	migrated := result.Metadata
+	if migrated.Version != 1 || migrated.Revision != 1 || migrated.Size != int64(len("old content")) {
+		t.Errorf("metadata has version %d, revision %d and size %d", migrated.Version, migrated.Revision, migrated.Size)
+	}
+	versions, err := fsb.GetFileVersions("legacy-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Version != 1 || versions[0].CreatedAt != 100 {
+		t.Errorf("file has versions %v", versions)
+	}
+	files, err := fsb.GetAllFiles(FilesQuery{Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files.Items) != 1 || files.Items[0].Version != 1 {
+		t.Errorf("list has %v", files.Items)
+	}
+
+	// the migrated file is updated like any other
+	_, err = fsb.UpdateFile(testChunk("legacy-file", 1, 1, []byte("new content")), "legacy-file", FileMetadataUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err = fsb.GetFileVersions("legacy-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("file has %d versions after update, expected 2", len(versions))
+	}
+}
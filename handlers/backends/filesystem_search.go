@@ -0,0 +1,185 @@
+package backends
+
+import (
+	"cmp"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// weighted term frequencies of a file, kept next to its metadata
+const SEARCH_FILE = "search.json"
+
+// invertedIndex maps terms to files, it is built from search files on first use
+type invertedIndex struct {
+	lock   sync.Mutex
+	loaded bool
+	// term -> file id -> weighted frequency of the term in the file
+	postings map[string]map[string]float64
+	// file id -> terms of the file
+	terms map[string][]string
+}
+
+var searchIndex invertedIndex
+
+func documentFrequencies(document SearchDocument) map[string]float64 {
+	frequencies := map[string]float64{}
+	for _, field := range []struct {
+		text   string
+		weight float64
+	}{
+		{document.Filename, filenameWeight},
+		{document.Metadata, metadataWeight},
+		{document.Content, contentWeight},
+	} {
+		for _, token := range searchTokens(field.text) {
+			frequencies[token] += field.weight
+		}
+	}
+	return frequencies
+}
+
+// loadLocked reads search files of every stored file, lock must be held
+func (index *invertedIndex) loadLocked() error {
+	if index.loaded {
+		return nil
+	}
+	index.postings = map[string]map[string]float64{}
+	index.terms = map[string][]string{}
+	err := walkFiles(func(metadata models.FileMetadata) bool {
+		data, err := os.ReadFile(filepath.Join(fileDir(metadata.FileId), SEARCH_FILE))
+		if err != nil {
+			return true
+		}
+		frequencies, err := decodeJson[map[string]float64](data)
+		if err == nil {
+			index.addLocked(metadata.FileId, frequencies)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	index.loaded = true
+	return nil
+}
+
+func (index *invertedIndex) addLocked(fileId string, frequencies map[string]float64) {
+	terms := make([]string, 0, len(frequencies))
+	for term, frequency := range frequencies {
+		if index.postings[term] == nil {
+			index.postings[term] = map[string]float64{}
+		}
+		index.postings[term][fileId] = frequency
+		terms = append(terms, term)
+	}
+	index.terms[fileId] = terms
+}
+
+func (index *invertedIndex) removeLocked(fileId string) {
+	for _, term := range index.terms[fileId] {
+		delete(index.postings[term], fileId)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+	delete(index.terms, fileId)
+}
+
+func (index *invertedIndex) remove(fileId string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if index.loaded {
+		index.removeLocked(fileId)
+	}
+}
+
+// scores returns files containing every term, scored by tf-idf
+func (index *invertedIndex) scores(terms []string) (map[string]float64, error) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	err := index.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	scores := map[string]float64{}
+	for i, term := range terms {
+		postings := index.postings[term]
+		idf := math.Log(1 + float64(len(index.terms))/float64(max(len(postings), 1)))
+		next := map[string]float64{}
+		for fileId, frequency := range postings {
+			score, ok := scores[fileId]
+			if i == 0 || ok {
+				next[fileId] = score + frequency*idf
+			}
+		}
+		scores = next
+	}
+	return scores, nil
+}
+
+func (fsb FileSystemBackend) IndexFile(document SearchDocument) error {
+	frequencies := documentFrequencies(document)
+	searchIndex.lock.Lock()
+	defer searchIndex.lock.Unlock()
+	err := writeFileAtomic(
+		filepath.Join(fileDir(document.FileId), SEARCH_FILE),
+		utils.GetJsonData(frequencies),
+	)
+	if err != nil {
+		return &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "Error writing search file",
+		}
+	}
+	if searchIndex.loaded {
+		searchIndex.removeLocked(document.FileId)
+		searchIndex.addLocked(document.FileId, frequencies)
+	}
+	return nil
+}
+
+func (fsb FileSystemBackend) SearchFiles(query SearchQuery) (PaginatedItems[models.SearchResult], error) {
+	result := PaginatedItems[models.SearchResult]{
+		Items:    []models.SearchResult{},
+		Page:     int64(query.Page),
+		PageSize: int64(query.PageSize),
+	}
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return result, nil
+	}
+	scores, err := searchIndex.scores(terms)
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now().Unix()
+	var found []models.SearchResult
+	for fileId, score := range scores {
+		// file may be purged meanwhile
+		metadata, err := readMetadata(fileId)
+		if err == nil && isVisible(metadata, now) {
+			found = append(found, models.SearchResult{FileMetadata: metadata, Score: score})
+		}
+	}
+	slices.SortFunc(found, func(a models.SearchResult, b models.SearchResult) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.FileId, b.FileId))
+	})
+
+	skip := min((query.Page-1)*query.PageSize, len(found))
+	found = found[skip:]
+	if query.PageSize > 0 && len(found) > query.PageSize {
+		found = found[:query.PageSize]
+		result.IsNextPage = true
+	}
+	result.Items = append(result.Items, found...)
+	return result, nil
+}
@@ -1,12 +1,19 @@
 package backends
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"hybrid-storage/models"
 	"hybrid-storage/utils"
+	"net/http"
+	"time"
 )
 
 type FileServerResult struct {
 	FileId string `json:"fileId"`
+	// revision of an updated file
+	Revision int64 `json:"revision,omitempty"`
 }
 
 type FileServerError struct {
@@ -18,8 +25,95 @@ func (e *FileServerError) Error() string {
 	return e.Detail
 }
 
+// pending uploads not written to for this long are abandoned
+const stagedUploadTimeout = 24 * time.Hour
+
+// abandonedBefore is the time of the last write of an upload abandoned by now
+func abandonedBefore(now int64) int64 {
+	return now - int64(stagedUploadTimeout.Seconds())
+}
+
+func isExpired(metadata models.FileMetadata, now int64) bool {
+	return metadata.ExpiresAt != 0 && metadata.ExpiresAt <= now
+}
+
+func folderExistsError(name string) error {
+	return &FileServerError{
+		Code:   http.StatusConflict,
+		Detail: fmt.Sprintf("folder %q already exists", name),
+	}
+}
+
+func folderNotFoundError(folderId string) error {
+	return &FileServerError{
+		Code:   http.StatusNotFound,
+		Detail: fmt.Sprintf("folder not found: %s", folderId),
+	}
+}
+
+func revisionConflictError(fileId string, revision int64) error {
+	return &FileServerError{
+		Code:   http.StatusConflict,
+		Detail: fmt.Sprintf("file %s was changed after revision %d", fileId, revision),
+	}
+}
+
+// revisionStep is how much the revision changes when the last chunk of a new version arrives,
+// a version of a single chunk already changed it when it started
+func revisionStep(chunk utils.ChunkResult) int64 {
+	if chunk.ChunkNumber <= 1 {
+		return 0
+	}
+	return 1
+}
+
+func expiredError(fileId string) error {
+	return &FileServerError{
+		Code:   http.StatusGone,
+		Detail: fmt.Sprintf("file expired: %s", fileId),
+	}
+}
+
+// versionFinishedError rejects a chunk for a version whose last chunk was already written,
+// finished versions are immutable
+func versionFinishedError() error {
+	return &FileServerError{
+		Code:   http.StatusConflict,
+		Detail: "upload of the version is already finished",
+	}
+}
+
+// uploadPendingError rejects copying a file whose current version is still being uploaded
+func uploadPendingError(fileId string) error {
+	return &FileServerError{
+		Code:   http.StatusConflict,
+		Detail: fmt.Sprintf("upload of file %s is not finished", fileId),
+	}
+}
+
+// chunkHash identifies chunk content in dedup mode
+func chunkHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
 type FileMetadataUpdate struct {
 	Filename string `json:"filename"`
+	// unix time, 0 removes expiry
+	ExpiresAt *int64 `json:"expiresAt"`
+	// seconds from now, converted to ExpiresAt by the handler
+	Ttl *int64 `json:"ttl"`
+	// replace all user metadata and tags, nil keeps them
+	UserMetadata map[string]string `json:"userMetadata"`
+	Tags         []string          `json:"tags"`
+	// move file to another folder, empty string is the root folder
+	FolderId *string `json:"folderId"`
+	// set only through retention endpoint
+	LegalHold   *bool  `json:"-"`
+	RetainUntil *int64 `json:"-"`
+	// revision the client has seen, the update fails with 409 if the file changed since.
+	// Handlers require it from clients, nil updates unconditionally and is reserved for internal callers
+	Revision *int64 `json:"revision"`
 }
 
 type PaginatedItems[T any] struct {
@@ -27,6 +121,32 @@ type PaginatedItems[T any] struct {
 	Page       int64 `json:"page"`
 	PageSize   int64 `json:"pageSize"`
 	IsNextPage bool  `json:"isNextPage"`
+	// opaque token of the next page, passed back as cursor query parameter
+	NextCursor string `json:"nextCursor,omitempty"`
+	// omitted when counting was skipped
+	TotalItems *int64 `json:"totalItems,omitempty"`
+	TotalPages *int64 `json:"totalPages,omitempty"`
+}
+
+func (p *PaginatedItems[T]) setTotal(totalItems int64) {
+	totalPages := min(totalItems, 1)
+	if p.PageSize > 0 {
+		totalPages = (totalItems + p.PageSize - 1) / p.PageSize
+	}
+	p.TotalItems = &totalItems
+	p.TotalPages = &totalPages
+}
+
+// AbandonedVersion is a pending version removed by DiscardAbandonedVersions,
+// its size is released from the owner of the file
+type AbandonedVersion struct {
+	FileId  string
+	Version int64
+	Size    int64
+	Tenant  string
+	Owner   string
+	// the file had no finished version and was purged with it
+	Purged bool
 }
 
 type GetFileResult struct {
@@ -38,7 +158,44 @@ type FileServerBackend interface {
 	UploadFile(chunk utils.ChunkResult, fileId string) (FileServerResult, error)
 	UpdateFile(chunk utils.ChunkResult, fileId string, metadataUpdate FileMetadataUpdate) (FileServerResult, error)
 	GetFile(fileId string) (GetFileResult, error)
+	GetFileVersion(fileId string, version int64) (GetFileResult, error)
+	GetFileVersions(fileId string) ([]models.FileVersion, error)
+	RestoreFileVersion(fileId string, version int64) (FileServerResult, error)
 	GetFileMetadata(fileId string) (models.FileMetadata, error)
-	GetAllFiles(page int, pageSize int) (PaginatedItems[models.FileMetadata], error)
-	DeleteFile(fileId string) (bool, error)
+	// GetUploadMetadata returns metadata of a file whose upload may be still in progress,
+	// later chunks are encoded with its codec and key
+	GetUploadMetadata(fileId string) (models.FileMetadata, error)
+	GetAllFiles(query FilesQuery) (PaginatedItems[models.FileMetadata], error)
+	// CopyFile stores the current version of a file as the first version of a new file
+	// described by target, data is copied as stored without decoding
+	CopyFile(fileId string, target models.FileMetadata) (FileServerResult, error)
+	// DeleteFile moves file to trash, PurgeFile removes it permanently. The delete fails with 409
+	// when revision is given and the file changed since, nil is reserved for internal callers
+	DeleteFile(fileId string, revision *int64) (bool, error)
+	UndeleteFile(fileId string) (bool, error)
+	PurgeFile(fileId string) (bool, error)
+	GetDeletedFiles(deletedBefore int64) ([]models.FileMetadata, error)
+	GetExpiredFiles(expiredBefore int64) ([]models.FileMetadata, error)
+	// DiscardAbandonedVersions removes pending versions not written to for stagedUploadTimeout by now.
+	// New files the SQL backend keeps pending are returned by GetExpiredFiles instead
+	DiscardAbandonedVersions(now int64) ([]AbandonedVersion, error)
+	// GetStoredFiles returns every stored file whatever its visibility, including files in trash,
+	// expired files and files whose upload is not finished
+	GetStoredFiles() ([]models.FileMetadata, error)
+	// SetFileKey replaces wrapped data key of any stored file, including files in trash
+	SetFileKey(fileId string, keyId string, wrappedKey string) (bool, error)
+	// IndexFile replaces searchable text of a file, PurgeFile also removes it from the index
+	IndexFile(document SearchDocument) error
+	// SearchFiles returns visible files containing every term of the query, most relevant first
+	SearchFiles(query SearchQuery) (PaginatedItems[models.SearchResult], error)
+	// folder names are unique among siblings, conflicts return 409
+	CreateFolder(folder models.Folder) error
+	GetFolder(folderId string) (models.Folder, error)
+	GetFolders(parentId string) ([]models.Folder, error)
+	// UpdateFolder renames or moves a folder, the caller prevents cycles
+	UpdateFolder(folder models.Folder) error
+	DeleteFolder(folderId string) (bool, error)
+	// ApplyBatch runs operations in order and returns an error for each of them, nil on success.
+	// A failed operation does not stop the others
+	ApplyBatch(operations []BatchOperation) []error
 }
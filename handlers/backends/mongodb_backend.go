@@ -8,6 +8,7 @@ import (
 	"hybrid-storage/utils"
 	"log"
 	"net/http"
+	"regexp"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -20,12 +21,34 @@ type MongoDBBackend struct {
 	db       *mongo.Database
 	metadata *mongo.Collection
 	files    *mongo.Collection
+	versions *mongo.Collection
+	chunks   *mongo.Collection
+	search   *mongo.Collection
+	folders  *mongo.Collection
+	// store chunks once by content hash in chunks collection
+	Dedup bool
 }
 
 type BSONFileChunk struct {
-	FileId string `bson:"fileId"`
-	Chunk  int    `bson:"chunk"`
-	Data   []byte `bson:"data"`
+	FileId  string `bson:"fileId"`
+	Version int64  `bson:"version"`
+	Chunk   int    `bson:"chunk"`
+	Data    []byte `bson:"data"`
+	// set instead of data in dedup mode
+	Hash string `bson:"hash,omitempty"`
+}
+
+type BSONSearchDocument struct {
+	FileId   string `bson:"_id"`
+	Filename string `bson:"filename"`
+	Metadata string `bson:"metadata"`
+	Content  string `bson:"content"`
+}
+
+type BSONChunk struct {
+	Hash     string `bson:"_id"`
+	Data     []byte `bson:"data"`
+	RefCount int64  `bson:"refCount"`
 }
 
 func NewMongoDBBackend(
@@ -41,11 +64,26 @@ func NewMongoDBBackend(
 	db.Drop(context.Background())
 	metadataCollection := db.Collection("metadata")
 	filesCollection := db.Collection("file_chunks")
+	versionsCollection := db.Collection("versions")
+	chunksCollection := db.Collection("chunks")
+	searchCollection := db.Collection("search")
+	foldersCollection := db.Collection("folders")
 
 	_, err = filesCollection.Indexes().CreateOne(
 		context.Background(),
 		mongo.IndexModel{
-			Keys:    bson.D{{Key: "fileId", Value: 1}, {Key: "chunk", Value: 1}},
+			Keys:    bson.D{{Key: "fileId", Value: 1}, {Key: "version", Value: 1}, {Key: "chunk", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+
+	_, err = versionsCollection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "fileId", Value: 1}, {Key: "version", Value: 1}},
 			Options: options.Index().SetUnique(true),
 		},
 	)
@@ -53,11 +91,58 @@ func NewMongoDBBackend(
 		return nil, fmt.Errorf("failed to create index: %w", err)
 	}
 
+	_, err = metadataCollection.Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "tags", Value: 1}}},
+			{Keys: bson.D{{Key: "folderId", Value: 1}}},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+
+	_, err = foldersCollection.Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "folderId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "parentId", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+
+	// documents are normalized already, so stemming and stop words are disabled
+	_, err = searchCollection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "filename", Value: "text"},
+				{Key: "metadata", Value: "text"},
+				{Key: "content", Value: "text"},
+			},
+			Options: options.Index().
+				SetDefaultLanguage("none").
+				SetWeights(bson.M{"filename": filenameWeight, "metadata": metadataWeight, "content": contentWeight}),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create text index: %w", err)
+	}
+
+	// expired files are removed only by the purger, TTL indexes would bypass retention,
+	// quotas, search documents and references of shared chunks
+
 	return &MongoDBBackend{
 		client:   client,
 		db:       db,
 		metadata: metadataCollection,
 		files:    filesCollection,
+		versions: versionsCollection,
+		chunks:   chunksCollection,
+		search:   searchCollection,
+		folders:  foldersCollection,
 	}, nil
 }
 
@@ -71,13 +156,30 @@ func (b *MongoDBBackend) UploadFile(
 	now := time.Now().Unix()
 
 	if chunk.ChunkNumber == 1 {
-		metadata := utils.ReadJsonData[models.FileMetadata](chunk.JsonData)
+		stored := utils.ReadJsonData[models.StoredMetadata](chunk.JsonData)
+		metadata := stored.Metadata()
 		_, err := b.metadata.InsertOne(context.Background(), bson.M{
-			"fileId":    fileId,
-			"filename":  metadata.Filename,
-			"extension": metadata.Extension,
-			"createdAt": now,
-			"updatedAt": now,
+			"fileId":         fileId,
+			"filename":       metadata.Filename,
+			"extension":      metadata.Extension,
+			"tenant":         metadata.Tenant,
+			"owner":          metadata.Owner,
+			"size":           0,
+			"version":        1,
+			"revision":       1,
+			"createdAt":      now,
+			"updatedAt":      now,
+			"deletedAt":      0,
+			"expiresAt":      metadata.ExpiresAt,
+			"legalHold":      false,
+			"retainUntil":    0,
+			"compression":    metadata.Compression,
+			"keyId":          metadata.KeyId,
+			"wrappedKey":     metadata.WrappedKey,
+			"keyFingerprint": metadata.KeyFingerprint,
+			"userMetadata":   metadata.UserMetadata,
+			"tags":           metadata.Tags,
+			"folderId":       metadata.FolderId,
 		})
 		if err != nil {
 			log.Println(err.Error())
@@ -87,39 +189,194 @@ func (b *MongoDBBackend) UploadFile(
 		fileId = chunk.FileId
 	}
 
-	_, err := b.files.InsertOne(context.Background(), BSONFileChunk{
-		FileId: fileId,
-		Chunk:  chunk.ChunkNumber,
-		Data:   utils.ReadChunkBytes(chunk),
-	})
+	err := b.writeVersionChunk(fileId, chunk)
 	if err != nil {
-		log.Println(err.Error())
-		return FileServerResult{}, errors.New("failed to insert file chunk")
+		return FileServerResult{}, err
 	}
 
 	return FileServerResult{FileId: fileId}, nil
 }
 
-func (b *MongoDBBackend) GetFile(fileId string) (GetFileResult, error) {
-	var metadata models.FileMetadata
-	err := b.metadata.FindOne(context.Background(), bson.M{"fileId": fileId}).Decode(&metadata)
+func (b *MongoDBBackend) latestVersion(fileId string) (models.FileVersion, error) {
+	var fileVersion models.FileVersion
+	err := b.versions.FindOne(
+		context.Background(),
+		bson.M{"fileId": fileId},
+		options.FindOne().SetSort(bson.M{"version": -1}),
+	).Decode(&fileVersion)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fileVersion, fmt.Errorf("failed to query versions: %w", err)
+	}
+	return fileVersion, nil
+}
+
+// writeVersionChunk stores chunk into the newest version of a file, first chunk starts a new pending version.
+// New version becomes current and immutable when its last chunk arrives
+func (b *MongoDBBackend) writeVersionChunk(fileId string, chunk utils.ChunkResult) error {
+	latest, err := b.latestVersion(fileId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return GetFileResult{}, &FileServerError{
-				Code:   http.StatusNotFound,
-				Detail: "metadata not found",
-			}
+		return err
+	}
+	version := latest.Version
+	if chunk.ChunkNumber == 1 {
+		version++
+		_, err = b.versions.InsertOne(context.Background(), bson.M{
+			"fileId":    fileId,
+			"version":   version,
+			"size":      0,
+			"createdAt": time.Now().Unix(),
+			"updatedAt": time.Now().Unix(),
+			"pending":   true,
+		})
+		if err != nil {
+			log.Println(err.Error())
+			return errors.New("failed to insert version")
+		}
+	} else if version == 0 {
+		return &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: "file not found",
 		}
-		return GetFileResult{}, fmt.Errorf("failed to query metadata: %w", err)
+	} else if !latest.Pending {
+		return versionFinishedError()
 	}
 
+	fileChunk := BSONFileChunk{
+		FileId:  fileId,
+		Version: version,
+		Chunk:   chunk.ChunkNumber,
+		Data:    utils.ReadChunkBytes(chunk),
+	}
+	if b.Dedup {
+		fileChunk.Hash = chunkHash(fileChunk.Data)
+		err = b.retainChunk(fileChunk.Hash, fileChunk.Data)
+		if err != nil {
+			log.Println(err.Error())
+			return errors.New("failed to insert chunk")
+		}
+		// data is kept only in chunks collection
+		fileChunk.Data = nil
+	}
+	insertResult, err := b.files.InsertOne(context.Background(), fileChunk)
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("failed to insert file chunk")
+	}
+
+	// the version is matched only while pending, a concurrent last chunk may have finished it
+	var fileVersion models.FileVersion
+	err = b.versions.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"fileId": fileId, "version": version, "pending": true},
+		bson.M{
+			"$inc": bson.M{"size": chunk.Size},
+			"$set": bson.M{"updatedAt": time.Now().Unix(), "pending": !chunk.IsLastChunk},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&fileVersion)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		inserted := bson.M{"_id": insertResult.InsertedID}
+		err = b.changeChunkRefs(inserted, -1)
+		if err == nil {
+			_, err = b.files.DeleteOne(context.Background(), inserted)
+		}
+		if err != nil {
+			log.Printf("Failed to remove chunk of finished version %d of %s: %v", version, fileId, err)
+		}
+		return versionFinishedError()
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("failed to update version")
+	}
+
+	if chunk.IsLastChunk || version == 1 {
+		_, err = b.metadata.UpdateOne(
+			context.Background(),
+			bson.M{"fileId": fileId},
+			bson.M{"$set": bson.M{"version": version, "size": fileVersion.Size}},
+		)
+		if err != nil {
+			log.Println(err.Error())
+			return errors.New("failed to update metadata")
+		}
+	}
+	return nil
+}
+
+// retainChunk adds a reference to a shared chunk, data is inserted only for a new chunk
+func (b *MongoDBBackend) retainChunk(hash string, data []byte) error {
+	updateResult, err := b.chunks.UpdateOne(
+		context.Background(),
+		bson.M{"_id": hash},
+		bson.M{"$inc": bson.M{"refCount": 1}},
+	)
+	if err != nil || updateResult.MatchedCount > 0 {
+		return err
+	}
+	// concurrent upload of the same chunk may insert it first
+	_, err = b.chunks.UpdateOne(
+		context.Background(),
+		bson.M{"_id": hash},
+		bson.M{"$inc": bson.M{"refCount": 1}, "$setOnInsert": bson.M{"data": data}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// changeChunkRefs adds delta references to every shared chunk of matching file chunks
+// and removes chunks that are no longer referenced
+func (b *MongoDBBackend) changeChunkRefs(filter bson.M, delta int64) error {
 	cursor, err := b.files.Find(
 		context.Background(),
-		bson.M{"fileId": fileId},
+		bson.M{"$and": bson.A{filter, bson.M{"hash": bson.M{"$exists": true}}}},
+		options.Find().SetProjection(bson.M{"hash": 1}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query file chunks: %w", err)
+	}
+	var fileChunks []BSONFileChunk
+	err = cursor.All(context.Background(), &fileChunks)
+	if err != nil {
+		return fmt.Errorf("failed to decode file chunks: %w", err)
+	}
+
+	refs := make(map[string]int64)
+	for _, fileChunk := range fileChunks {
+		refs[fileChunk.Hash] += delta
+	}
+	hashes := bson.A{}
+	for hash, refDelta := range refs {
+		_, err = b.chunks.UpdateOne(
+			context.Background(),
+			bson.M{"_id": hash},
+			bson.M{"$inc": bson.M{"refCount": refDelta}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update chunk references: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if delta < 0 && len(hashes) > 0 {
+		_, err = b.chunks.DeleteMany(
+			context.Background(),
+			bson.M{"_id": bson.M{"$in": hashes}, "refCount": bson.M{"$lte": 0}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete chunks: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *MongoDBBackend) getVersionData(fileId string, version int64) ([]byte, error) {
+	cursor, err := b.files.Find(
+		context.Background(),
+		bson.M{"fileId": fileId, "version": version},
 		options.Find().SetSort(bson.M{"chunk": 1}),
 	)
 	if err != nil {
-		return GetFileResult{}, fmt.Errorf("failed to query file chunks: %w", err)
+		return nil, fmt.Errorf("failed to query file chunks: %w", err)
 	}
 	defer cursor.Close(context.Background())
 
@@ -128,31 +385,205 @@ func (b *MongoDBBackend) GetFile(fileId string) (GetFileResult, error) {
 		var chunk BSONFileChunk
 		err := cursor.Decode(&chunk)
 		if err != nil {
-			return GetFileResult{}, fmt.Errorf("failed to decode file chunk: %w", err)
+			return nil, fmt.Errorf("failed to decode file chunk: %w", err)
+		}
+		if chunk.Hash != "" {
+			var sharedChunk BSONChunk
+			err = b.chunks.FindOne(context.Background(), bson.M{"_id": chunk.Hash}).Decode(&sharedChunk)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query chunk %s: %w", chunk.Hash, err)
+			}
+			chunk.Data = sharedChunk.Data
 		}
 		fileData = append(fileData, chunk.Data...)
 	}
 
 	if err := cursor.Err(); err != nil {
-		return GetFileResult{}, fmt.Errorf("cursor error: %w", err)
+		return nil, fmt.Errorf("cursor error: %w", err)
 	}
 
 	if len(fileData) == 0 {
-		return GetFileResult{}, &FileServerError{
+		return nil, &FileServerError{
 			Code:   http.StatusNotFound,
 			Detail: "file data not found",
 		}
 	}
+	return fileData, nil
+}
+
+func (b *MongoDBBackend) GetFile(fileId string) (GetFileResult, error) {
+	metadata, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+
+	fileData, err := b.getVersionData(fileId, metadata.Version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+
+	return GetFileResult{File: fileData, Metadata: metadata}, nil
+}
+
+func (b *MongoDBBackend) getVersion(fileId string, version int64) (models.FileVersion, error) {
+	var fileVersion models.FileVersion
+	// a version that is still being uploaded can not be read or restored
+	err := b.versions.FindOne(
+		context.Background(),
+		bson.M{"fileId": fileId, "version": version, "pending": bson.M{"$ne": true}},
+	).Decode(&fileVersion)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fileVersion, &FileServerError{
+				Code:   http.StatusNotFound,
+				Detail: fmt.Sprintf("version %d not found", version),
+			}
+		}
+		return fileVersion, fmt.Errorf("failed to query version: %w", err)
+	}
+	return fileVersion, nil
+}
 
+func (b *MongoDBBackend) GetFileVersion(fileId string, version int64) (GetFileResult, error) {
+	metadata, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+	fileVersion, err := b.getVersion(fileId, version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+
+	fileData, err := b.getVersionData(fileId, version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+
+	metadata.Version = fileVersion.Version
+	metadata.Size = fileVersion.Size
 	return GetFileResult{File: fileData, Metadata: metadata}, nil
 }
 
+func (b *MongoDBBackend) GetFileVersions(fileId string) ([]models.FileVersion, error) {
+	cursor, err := b.versions.Find(
+		context.Background(),
+		bson.M{"fileId": fileId},
+		options.Find().SetSort(bson.M{"version": 1}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query versions: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	var versions []models.FileVersion
+	err = cursor.All(context.Background(), &versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode versions: %w", err)
+	}
+	if len(versions) == 0 {
+		return nil, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: "file not found",
+		}
+	}
+	return versions, nil
+}
+
+func (b *MongoDBBackend) RestoreFileVersion(fileId string, version int64) (FileServerResult, error) {
+	_, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	fileVersion, err := b.getVersion(fileId, version)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	latest, err := b.latestVersion(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+
+	// restored content becomes a new version, old versions stay immutable
+	now := time.Now().Unix()
+	restored := models.FileVersion{
+		FileId:    fileId,
+		Version:   latest.Version + 1,
+		Size:      fileVersion.Size,
+		CreatedAt: now,
+	}
+	_, err = b.versions.InsertOne(context.Background(), bson.M{
+		"fileId":    restored.FileId,
+		"version":   restored.Version,
+		"size":      restored.Size,
+		"createdAt": restored.CreatedAt,
+	})
+	if err != nil {
+		return FileServerResult{}, fmt.Errorf("failed to insert version: %w", err)
+	}
+
+	cursor, err := b.files.Aggregate(context.Background(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"fileId": fileId, "version": version}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":     0,
+			"fileId":  1,
+			"chunk":   1,
+			"data":    1,
+			"hash":    1,
+			"version": bson.M{"$literal": restored.Version},
+		}}},
+		{{Key: "$merge", Value: bson.M{"into": b.files.Name()}}},
+	})
+	if err != nil {
+		return FileServerResult{}, fmt.Errorf("failed to copy file chunks: %w", err)
+	}
+	cursor.Close(context.Background())
+	// restored version shares chunks of the original one
+	err = b.changeChunkRefs(bson.M{"fileId": fileId, "version": restored.Version}, 1)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+
+	_, err = b.metadata.UpdateOne(
+		context.Background(),
+		bson.M{"fileId": fileId},
+		bson.M{
+			"$set": bson.M{
+				"version":   restored.Version,
+				"size":      restored.Size,
+				"updatedAt": now,
+			},
+			"$inc": bson.M{"revision": 1},
+		},
+	)
+	if err != nil {
+		return FileServerResult{}, fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	return FileServerResult{FileId: fileId}, nil
+}
+
+// visibleFilesFilter hides files that were moved to trash or expired
+func visibleFilesFilter() bson.M {
+	return bson.M{
+		"deletedAt": 0,
+		"$or": bson.A{
+			bson.M{"expiresAt": 0},
+			bson.M{"expiresAt": bson.M{"$gt": time.Now().Unix()}},
+		},
+	}
+}
+
+// activeFileFilter matches a file that is not in trash
+func activeFileFilter(fileId string) bson.M {
+	return bson.M{"fileId": fileId, "deletedAt": 0}
+}
+
 func (b *MongoDBBackend) GetFileMetadata(fileId string) (
 	models.FileMetadata,
 	error,
 ) {
 	var metadata models.FileMetadata
-	err := b.metadata.FindOne(context.Background(), bson.M{"fileId": fileId}).
+	err := b.metadata.FindOne(context.Background(), activeFileFilter(fileId)).
 		Decode(&metadata)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
@@ -163,20 +594,105 @@ func (b *MongoDBBackend) GetFileMetadata(fileId string) (
 		}
 		return models.FileMetadata{}, fmt.Errorf("failed to query metadata: %w", err)
 	}
+	if isExpired(metadata, time.Now().Unix()) {
+		return models.FileMetadata{}, expiredError(fileId)
+	}
 	return metadata, nil
 }
 
-func (b *MongoDBBackend) GetAllFiles(page int, pageSize int) (
+func (b *MongoDBBackend) GetUploadMetadata(fileId string) (models.FileMetadata, error) {
+	return b.GetFileMetadata(fileId)
+}
+
+// filesFilter adds conditions of a files query to visibleFilesFilter
+func filesFilter(query FilesQuery) bson.M {
+	filter := query.Filter
+	conditions := visibleFilesFilter()
+	// both filename conditions are regular expressions on the same field
+	// and cursor condition needs its own $or
+	var andConditions bson.A
+	if filter.Filename != "" {
+		andConditions = append(andConditions, bson.M{"filename": bson.M{
+			"$regex":   regexp.QuoteMeta(filter.Filename),
+			"$options": "i",
+		}})
+	}
+	if filter.FilenamePrefix != "" {
+		andConditions = append(andConditions, bson.M{"filename": bson.M{
+			"$regex":   "^" + regexp.QuoteMeta(filter.FilenamePrefix),
+			"$options": "i",
+		}})
+	}
+	if query.After != nil {
+		comparison := "$gt"
+		if query.Descending {
+			comparison = "$lt"
+		}
+		field := query.sortField()
+		value := query.After.value()
+		andConditions = append(andConditions, bson.M{"$or": bson.A{
+			bson.M{field: bson.M{comparison: value}},
+			bson.M{field: value, "fileId": bson.M{comparison: query.After.FileId}},
+		}})
+	}
+	if len(andConditions) > 0 {
+		conditions["$and"] = andConditions
+	}
+	if filter.Extension != "" {
+		conditions["extension"] = bson.M{
+			"$regex":   "^" + regexp.QuoteMeta(filter.normalizedExtension()) + "$",
+			"$options": "i",
+		}
+	}
+	if filter.Name != "" {
+		conditions["filename"], conditions["extension"] = splitName(filter.Name)
+	}
+	if filter.FolderId != nil {
+		conditions["folderId"] = *filter.FolderId
+	}
+	if filter.Tag != "" {
+		conditions["tags"] = filter.Tag
+	}
+	for field, bounds := range map[string][2]int64{
+		"createdAt": {filter.CreatedAfter, filter.CreatedBefore},
+		"updatedAt": {filter.UpdatedAfter, filter.UpdatedBefore},
+		"size":      {filter.MinSize, filter.MaxSize},
+	} {
+		condition := bson.M{}
+		if bounds[0] != 0 {
+			condition["$gte"] = bounds[0]
+		}
+		if bounds[1] != 0 {
+			condition["$lte"] = bounds[1]
+		}
+		if len(condition) > 0 {
+			conditions[field] = condition
+		}
+	}
+	return conditions
+}
+
+func filesSort(query FilesQuery) bson.D {
+	direction := 1
+	if query.Descending {
+		direction = -1
+	}
+	return bson.D{{Key: query.sortField(), Value: direction}, {Key: "fileId", Value: direction}}
+}
+
+func (b *MongoDBBackend) GetAllFiles(query FilesQuery) (
 	PaginatedItems[models.FileMetadata],
 	error,
 ) {
-	skip := int64((page - 1) * pageSize)
+	page, pageSize := query.Page, query.PageSize
+	skip := int64(query.offset())
 	limit := int64(pageSize)
+	filter := filesFilter(query)
 
 	cursor, err := b.metadata.Find(
 		context.Background(),
-		bson.M{},
-		options.Find().SetSkip(skip).SetLimit(limit),
+		filter,
+		options.Find().SetSort(filesSort(query)).SetSkip(skip).SetLimit(limit),
 	)
 	if err != nil {
 		return PaginatedItems[models.FileMetadata]{}, &FileServerError{
@@ -205,15 +721,19 @@ func (b *MongoDBBackend) GetAllFiles(page int, pageSize int) (
 		}
 	}
 
-	count, err := b.metadata.CountDocuments(
-		context.Background(),
-		bson.M{},
-		options.Count().SetSkip(skip+limit).SetLimit(1),
-	)
-	if err != nil {
-		return PaginatedItems[models.FileMetadata]{}, &FileServerError{
-			Code:   http.StatusInternalServerError,
-			Detail: fmt.Sprintf("failed to query next page: %s", err.Error()),
+	// zero limit returns every file at once
+	var count int64
+	if limit > 0 {
+		count, err = b.metadata.CountDocuments(
+			context.Background(),
+			filter,
+			options.Count().SetSkip(skip+limit).SetLimit(1),
+		)
+		if err != nil {
+			return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: fmt.Sprintf("failed to query next page: %s", err.Error()),
+			}
 		}
 	}
 
@@ -222,6 +742,20 @@ func (b *MongoDBBackend) GetAllFiles(page int, pageSize int) (
 		Page:       int64(page),
 		PageSize:   int64(pageSize),
 		IsNextPage: count > 0,
+		NextCursor: query.nextCursor(files, count > 0),
+	}
+	if !query.SkipCount {
+		// the whole listing, regardless of the cursor
+		withoutCursor := query
+		withoutCursor.After = nil
+		totalItems, err := b.metadata.CountDocuments(context.Background(), filesFilter(withoutCursor))
+		if err != nil {
+			return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: fmt.Sprintf("failed to count files: %s", err.Error()),
+			}
+		}
+		result.setTotal(totalItems)
 	}
 	return result, nil
 }
@@ -234,38 +768,490 @@ func (b *MongoDBBackend) UpdateFile(
 	FileServerResult,
 	error,
 ) {
+	_, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+
 	// update only metadata
 	if chunk.FormDataChunk == nil {
-		update := bson.M{
-			"$set": bson.M{
-				"filename":   data.Filename,
-				"updated_at": time.Now().Unix(),
-			},
+		err = b.changeRevision(fileId, data.Revision, metadataSet(data))
+		if err != nil {
+			return FileServerResult{}, err
 		}
-		_, err := b.metadata.UpdateOne(
-			context.Background(),
-			bson.M{"fileId": fileId},
-			update,
-		)
+	} else { // else store new content as the next version
+		// revision is compared when a new version starts and changes again when it becomes current
+		if chunk.ChunkNumber <= 1 {
+			err = b.changeRevision(fileId, data.Revision, bson.M{})
+			if err != nil {
+				return FileServerResult{}, err
+			}
+		}
+		err = b.writeVersionChunk(fileId, chunk)
 		if err != nil {
-			return FileServerResult{}, fmt.Errorf("failed to update metadata: %w", err)
+			return FileServerResult{}, err
 		}
-	} else { // else delete old file and upload new with same fileId
-		if chunk.ChunkNumber == 1 {
-			b.DeleteFile(fileId)
+		if chunk.IsLastChunk {
+			_, err = b.metadata.UpdateOne(
+				context.Background(),
+				bson.M{"fileId": fileId},
+				bson.M{
+					"$set": bson.M{"updatedAt": time.Now().Unix()},
+					"$inc": bson.M{"revision": revisionStep(chunk)},
+				},
+			)
+			if err != nil {
+				return FileServerResult{}, fmt.Errorf("failed to update metadata: %w", err)
+			}
 		}
-		b.UploadFile(chunk, fileId)
 	}
 
 	return FileServerResult{FileId: fileId}, nil
 }
 
-func (b *MongoDBBackend) DeleteFile(fileId string) (bool, error) {
-	_, err := b.files.DeleteMany(context.Background(), bson.M{"fileId": fileId})
+// changeRevision sets fields of a file that is not in trash and increments its revision,
+// the filter on the expected revision makes it a compare and swap
+func (b *MongoDBBackend) changeRevision(fileId string, revision *int64, set bson.M) error {
+	filter := activeFileFilter(fileId)
+	if revision != nil {
+		filter["revision"] = *revision
+	}
+	update := bson.M{"$inc": bson.M{"revision": 1}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	updateResult, err := b.metadata.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	if updateResult.MatchedCount > 0 {
+		return nil
+	}
+	if revision != nil {
+		count, err := b.metadata.CountDocuments(context.Background(), activeFileFilter(fileId))
+		if err != nil {
+			return fmt.Errorf("failed to query metadata: %w", err)
+		}
+		if count > 0 {
+			return revisionConflictError(fileId, *revision)
+		}
+	}
+	return &FileServerError{
+		Code:   http.StatusNotFound,
+		Detail: "file not found",
+	}
+}
+
+// metadataSet returns fields changed by a metadata update
+func metadataSet(data FileMetadataUpdate) bson.M {
+	set := bson.M{"updatedAt": time.Now().Unix()}
+	if data.Filename != "" {
+		set["filename"] = data.Filename
+	}
+	if data.ExpiresAt != nil {
+		set["expiresAt"] = *data.ExpiresAt
+	}
+	if data.LegalHold != nil {
+		set["legalHold"] = *data.LegalHold
+	}
+	if data.RetainUntil != nil {
+		set["retainUntil"] = *data.RetainUntil
+	}
+	if data.UserMetadata != nil {
+		set["userMetadata"] = data.UserMetadata
+	}
+	if data.Tags != nil {
+		set["tags"] = data.Tags
+	}
+	if data.FolderId != nil {
+		set["folderId"] = *data.FolderId
+	}
+	return set
+}
+
+// CopyFile copies chunks of the current version with an aggregation merged into
+// the same collection, a partially copied file is purged
+func (b *MongoDBBackend) CopyFile(fileId string, target models.FileMetadata) (FileServerResult, error) {
+	source, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	_, err = b.getVersion(fileId, source.Version)
+	var serverErr *FileServerError
+	if errors.As(err, &serverErr) && serverErr.Code == http.StatusNotFound {
+		return FileServerResult{}, uploadPendingError(fileId)
+	}
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	now := time.Now().Unix()
+	_, err = b.metadata.InsertOne(context.Background(), bson.M{
+		"fileId":         target.FileId,
+		"filename":       target.Filename,
+		"extension":      target.Extension,
+		"tenant":         target.Tenant,
+		"owner":          target.Owner,
+		"size":           source.Size,
+		"version":        1,
+		"revision":       1,
+		"createdAt":      now,
+		"updatedAt":      now,
+		"deletedAt":      0,
+		"expiresAt":      target.ExpiresAt,
+		"legalHold":      false,
+		"retainUntil":    0,
+		"compression":    target.Compression,
+		"keyId":          target.KeyId,
+		"wrappedKey":     target.WrappedKey,
+		"keyFingerprint": target.KeyFingerprint,
+		"userMetadata":   target.UserMetadata,
+		"tags":           target.Tags,
+		"folderId":       target.FolderId,
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return FileServerResult{}, errors.New("failed to insert metadata")
+	}
+
+	err = b.copyChunks(source, target.FileId, now)
+	if err != nil {
+		_, purgeErr := b.PurgeFile(target.FileId)
+		if purgeErr != nil {
+			log.Printf("Failed to purge partial copy %s: %v", target.FileId, purgeErr)
+		}
+		return FileServerResult{}, err
+	}
+	return FileServerResult{FileId: target.FileId}, nil
+}
+
+func (b *MongoDBBackend) copyChunks(source models.FileMetadata, fileId string, now int64) error {
+	_, err := b.versions.InsertOne(context.Background(), bson.M{
+		"fileId":    fileId,
+		"version":   1,
+		"size":      source.Size,
+		"createdAt": now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert version: %w", err)
+	}
+	cursor, err := b.files.Aggregate(context.Background(), bson.A{
+		bson.M{"$match": bson.M{"fileId": source.FileId, "version": source.Version}},
+		bson.M{"$project": bson.M{
+			"_id":     0,
+			"fileId":  bson.M{"$literal": fileId},
+			"version": bson.M{"$literal": 1},
+			"chunk":   1,
+			"data":    1,
+			"hash":    1,
+		}},
+		bson.M{"$merge": bson.M{"into": b.files.Name(), "whenMatched": "fail", "whenNotMatched": "insert"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy file chunks: %w", err)
+	}
+	cursor.Close(context.Background())
+	return b.changeChunkRefs(bson.M{"fileId": fileId}, 1)
+}
+
+func (b *MongoDBBackend) DeleteFile(fileId string, revision *int64) (bool, error) {
+	err := b.changeRevision(fileId, revision, bson.M{"deletedAt": time.Now().Unix()})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApplyBatch sends all operations in one ordered bulk write. Files missing or changed
+// before the write are reported without sending their operations, every write is filtered
+// by the revision the file should have so changes of other clients are not overwritten
+func (b *MongoDBBackend) ApplyBatch(operations []BatchOperation) []error {
+	errs := make([]error, len(operations))
+	fileIds := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		fileIds = append(fileIds, operation.FileId)
+	}
+	cursor, err := b.metadata.Find(
+		context.Background(),
+		bson.M{"fileId": bson.M{"$in": fileIds}, "deletedAt": 0},
+		options.Find().SetProjection(bson.M{"fileId": 1, "revision": 1}),
+	)
+	var found []models.FileMetadata
+	if err == nil {
+		err = cursor.All(context.Background(), &found)
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("failed to query metadata: %w", err)
+		}
+		return errs
+	}
+	active := map[string]bool{}
+	revisions := map[string]int64{}
+	for _, metadata := range found {
+		active[metadata.FileId] = true
+		revisions[metadata.FileId] = metadata.Revision
+	}
+
+	now := time.Now().Unix()
+	var writes []mongo.WriteModel
+	// index of the operation of every write
+	var indexes []int
+	for i, operation := range operations {
+		if !active[operation.FileId] {
+			errs[i] = &FileServerError{
+				Code:   http.StatusNotFound,
+				Detail: "file not found",
+			}
+			continue
+		}
+		var set bson.M
+		switch operation.Kind {
+		case BatchDelete:
+			set = bson.M{"deletedAt": now}
+			// later operations of the batch do not see the file
+			active[operation.FileId] = false
+		case BatchUpdate:
+			expected := operation.Update.Revision
+			if expected != nil && *expected != revisions[operation.FileId] {
+				errs[i] = revisionConflictError(operation.FileId, *expected)
+				continue
+			}
+			set = metadataSet(operation.Update)
+		default:
+			continue
+		}
+		filter := activeFileFilter(operation.FileId)
+		filter["revision"] = revisions[operation.FileId]
+		revisions[operation.FileId]++
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{"$set": set, "$inc": bson.M{"revision": 1}}))
+		indexes = append(indexes, i)
+	}
+	if len(writes) == 0 {
+		return errs
+	}
+
+	bulkResult, err := b.metadata.BulkWrite(context.Background(), writes, options.BulkWrite().SetOrdered(true))
+	if err == nil && bulkResult.MatchedCount < int64(len(writes)) {
+		b.reportBatchConflicts(operations, indexes, revisions, errs)
+	}
+	if err != nil {
+		// ordered write stops at the first failed operation
+		failed := 0
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+			failed = bulkErr.WriteErrors[0].Index
+		}
+		for k := failed; k < len(writes); k++ {
+			errs[indexes[k]] = fmt.Errorf("failed to apply batch: %w", err)
+		}
+	}
+	return errs
+}
+
+// reportBatchConflicts marks operations on files changed by another client during
+// a bulk write, their revision differs from the one the batch should have left
+func (b *MongoDBBackend) reportBatchConflicts(operations []BatchOperation, indexes []int, revisions map[string]int64, errs []error) {
+	fileIds := make([]string, 0, len(revisions))
+	for fileId := range revisions {
+		fileIds = append(fileIds, fileId)
+	}
+	cursor, err := b.metadata.Find(
+		context.Background(),
+		bson.M{"fileId": bson.M{"$in": fileIds}},
+		options.Find().SetProjection(bson.M{"fileId": 1, "revision": 1}),
+	)
+	var found []models.FileMetadata
+	if err == nil {
+		err = cursor.All(context.Background(), &found)
+	}
+	if err != nil {
+		log.Printf("Failed to check batch revisions: %v", err)
+		return
+	}
+	changed := map[string]bool{}
+	for _, metadata := range found {
+		changed[metadata.FileId] = metadata.Revision != revisions[metadata.FileId]
+	}
+	for _, i := range indexes {
+		if changed[operations[i].FileId] {
+			errs[i] = &FileServerError{
+				Code:   http.StatusConflict,
+				Detail: fmt.Sprintf("file %s was changed during the batch", operations[i].FileId),
+			}
+		}
+	}
+}
+
+func (b *MongoDBBackend) UndeleteFile(fileId string) (bool, error) {
+	updateResult, err := b.metadata.UpdateOne(
+		context.Background(),
+		bson.M{"fileId": fileId, "deletedAt": bson.M{"$ne": 0}},
+		bson.M{
+			"$set": bson.M{"deletedAt": 0},
+			"$inc": bson.M{"revision": 1},
+		},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to undelete file: %w", err)
+	}
+	if updateResult.MatchedCount == 0 {
+		return false, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: "deleted file not found",
+		}
+	}
+	return true, nil
+}
+
+func (b *MongoDBBackend) GetDeletedFiles(deletedBefore int64) ([]models.FileMetadata, error) {
+	cursor, err := b.metadata.Find(
+		context.Background(),
+		bson.M{"deletedAt": bson.M{"$ne": 0, "$lt": deletedBefore}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deleted files: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	var files []models.FileMetadata
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode deleted files: %w", err)
+	}
+	return files, nil
+}
+
+func (b *MongoDBBackend) GetStoredFiles() ([]models.FileMetadata, error) {
+	cursor, err := b.metadata.Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	var files []models.FileMetadata
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode files: %w", err)
+	}
+	return files, nil
+}
+
+func (b *MongoDBBackend) GetExpiredFiles(expiredBefore int64) ([]models.FileMetadata, error) {
+	cursor, err := b.metadata.Find(
+		context.Background(),
+		bson.M{"expiresAt": bson.M{"$ne": 0, "$lte": expiredBefore}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired files: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	var files []models.FileMetadata
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode expired files: %w", err)
+	}
+	return files, nil
+}
+
+// abandonedFilter matches pending versions not written to since before,
+// versions written before updatedAt was kept have only the time they started
+func abandonedFilter(before int64) bson.M {
+	return bson.M{
+		"pending": true,
+		"$or": bson.A{
+			bson.M{"updatedAt": bson.M{"$lt": before}},
+			bson.M{"updatedAt": bson.M{"$exists": false}, "createdAt": bson.M{"$lt": before}},
+		},
+	}
+}
+
+// DiscardAbandonedVersions removes abandoned versions with their chunks, a file without
+// a finished version is purged
+func (b *MongoDBBackend) DiscardAbandonedVersions(now int64) ([]AbandonedVersion, error) {
+	before := abandonedBefore(now)
+	cursor, err := b.versions.Find(context.Background(), abandonedFilter(before))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query abandoned versions: %w", err)
+	}
+	var versions []models.FileVersion
+	err = cursor.All(context.Background(), &versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode abandoned versions: %w", err)
+	}
+
+	var discarded []AbandonedVersion
+	for _, fileVersion := range versions {
+		var metadata models.FileMetadata
+		err = b.metadata.FindOne(context.Background(), bson.M{"fileId": fileVersion.FileId}).Decode(&metadata)
+		if err != nil {
+			return discarded, fmt.Errorf("failed to query metadata: %w", err)
+		}
+		abandoned := AbandonedVersion{
+			FileId:  fileVersion.FileId,
+			Version: fileVersion.Version,
+			Size:    fileVersion.Size,
+			Tenant:  metadata.Tenant,
+			Owner:   metadata.Owner,
+			Purged:  fileVersion.Version == 1,
+		}
+
+		// the version is matched again, so one written to meanwhile is kept
+		filter := abandonedFilter(before)
+		filter["fileId"] = fileVersion.FileId
+		filter["version"] = fileVersion.Version
+		deleteResult, err := b.versions.DeleteOne(context.Background(), filter)
+		if err != nil {
+			return discarded, fmt.Errorf("failed to delete version: %w", err)
+		}
+		if deleteResult.DeletedCount == 0 {
+			continue
+		}
+		if abandoned.Purged {
+			_, err = b.PurgeFile(fileVersion.FileId)
+			if err != nil {
+				return discarded, err
+			}
+			discarded = append(discarded, abandoned)
+			continue
+		}
+		chunks := bson.M{"fileId": fileVersion.FileId, "version": fileVersion.Version}
+		err = b.changeChunkRefs(chunks, -1)
+		if err != nil {
+			return discarded, err
+		}
+		_, err = b.files.DeleteMany(context.Background(), chunks)
+		if err != nil {
+			return discarded, fmt.Errorf("failed to delete file chunks: %w", err)
+		}
+		discarded = append(discarded, abandoned)
+	}
+	return discarded, nil
+}
+
+func (b *MongoDBBackend) PurgeFile(fileId string) (bool, error) {
+	err := b.changeChunkRefs(bson.M{"fileId": fileId}, -1)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = b.files.DeleteMany(context.Background(), bson.M{"fileId": fileId})
 	if err != nil {
 		return false, fmt.Errorf("failed to delete file chunks: %w", err)
 	}
 
+	_, err = b.versions.DeleteMany(context.Background(), bson.M{"fileId": fileId})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete versions: %w", err)
+	}
+
+	_, err = b.search.DeleteOne(context.Background(), bson.M{"_id": fileId})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete search document: %w", err)
+	}
+
 	deleteResult, err := b.metadata.DeleteOne(context.Background(), bson.M{"fileId": fileId})
 	if err != nil {
 		return false, fmt.Errorf("failed to delete metadata: %w", err)
@@ -281,6 +1267,175 @@ func (b *MongoDBBackend) DeleteFile(fileId string) (bool, error) {
 	return true, nil
 }
 
+func (b *MongoDBBackend) SetFileKey(fileId string, keyId string, wrappedKey string) (bool, error) {
+	updateResult, err := b.metadata.UpdateOne(
+		context.Background(),
+		bson.M{"fileId": fileId},
+		bson.M{"$set": bson.M{"keyId": keyId, "wrappedKey": wrappedKey}},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update file key: %w", err)
+	}
+	if updateResult.MatchedCount == 0 {
+		return false, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: "file not found",
+		}
+	}
+	return true, nil
+}
+
 func (b *MongoDBBackend) Close() error {
 	return b.client.Disconnect(context.Background())
 }
+
+func (b *MongoDBBackend) IndexFile(document SearchDocument) error {
+	_, err := b.search.ReplaceOne(
+		context.Background(),
+		bson.M{"_id": document.FileId},
+		BSONSearchDocument{
+			FileId:   document.FileId,
+			Filename: document.Filename,
+			Metadata: document.Metadata,
+			Content:  document.Content,
+		},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to index file: %w", err)
+	}
+	return nil
+}
+
+func (b *MongoDBBackend) SearchFiles(query SearchQuery) (PaginatedItems[models.SearchResult], error) {
+	result := PaginatedItems[models.SearchResult]{
+		Items:    []models.SearchResult{},
+		Page:     int64(query.Page),
+		PageSize: int64(query.PageSize),
+	}
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return result, nil
+	}
+
+	// visibility is checked on metadata joined to matched documents
+	visible := bson.M{
+		"file.deletedAt": 0,
+		"$or": bson.A{
+			bson.M{"file.expiresAt": 0},
+			bson.M{"file.expiresAt": bson.M{"$gt": time.Now().Unix()}},
+		},
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$text": bson.M{"$search": quotedTerms(terms)}}}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         b.metadata.Name(),
+			"localField":   "_id",
+			"foreignField": "fileId",
+			"as":           "file",
+		}}},
+		{{Key: "$unwind", Value: "$file"}},
+		{{Key: "$match", Value: visible}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: int64((query.Page - 1) * query.PageSize)}},
+	}
+	if query.PageSize > 0 {
+		// one more document tells if there is a next page
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: int64(query.PageSize + 1)}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$replaceWith", Value: bson.M{
+		"$mergeObjects": bson.A{"$file", bson.M{"score": "$score"}},
+	}}})
+
+	cursor, err := b.search.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return result, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: fmt.Sprintf("failed to search files: %s", err.Error()),
+		}
+	}
+	defer cursor.Close(context.Background())
+	err = cursor.All(context.Background(), &result.Items)
+	if err != nil {
+		return result, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: fmt.Sprintf("failed to scan file metadata: %s", err.Error()),
+		}
+	}
+	if query.PageSize > 0 && len(result.Items) > query.PageSize {
+		result.Items = result.Items[:query.PageSize]
+		result.IsNextPage = true
+	}
+	return result, nil
+}
+
+func (b *MongoDBBackend) CreateFolder(folder models.Folder) error {
+	_, err := b.folders.InsertOne(context.Background(), folder)
+	if mongo.IsDuplicateKeyError(err) {
+		return folderExistsError(folder.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert folder: %w", err)
+	}
+	return nil
+}
+
+func (b *MongoDBBackend) GetFolder(folderId string) (models.Folder, error) {
+	var folder models.Folder
+	err := b.folders.FindOne(context.Background(), bson.M{"folderId": folderId}).Decode(&folder)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return folder, folderNotFoundError(folderId)
+	}
+	if err != nil {
+		return folder, fmt.Errorf("failed to query folder: %w", err)
+	}
+	return folder, nil
+}
+
+func (b *MongoDBBackend) GetFolders(parentId string) ([]models.Folder, error) {
+	cursor, err := b.folders.Find(
+		context.Background(),
+		bson.M{"parentId": parentId},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query folders: %w", err)
+	}
+	defer cursor.Close(context.Background())
+	folders := []models.Folder{}
+	err = cursor.All(context.Background(), &folders)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode folders: %w", err)
+	}
+	return folders, nil
+}
+
+func (b *MongoDBBackend) UpdateFolder(folder models.Folder) error {
+	result, err := b.folders.UpdateOne(
+		context.Background(),
+		bson.M{"folderId": folder.FolderId},
+		bson.M{"$set": bson.M{"name": folder.Name, "parentId": folder.ParentId, "updatedAt": folder.UpdatedAt}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return folderExistsError(folder.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update folder: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return folderNotFoundError(folder.FolderId)
+	}
+	return nil
+}
+
+func (b *MongoDBBackend) DeleteFolder(folderId string) (bool, error) {
+	result, err := b.folders.DeleteOne(context.Background(), bson.M{"folderId": folderId})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete folder: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return false, folderNotFoundError(folderId)
+	}
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package backends
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	// most terms of a search query, the rest is ignored
+	maxSearchTerms = 32
+	// relevance of a term found in filename, user metadata and content
+	filenameWeight = 10
+	metadataWeight = 5
+	contentWeight  = 1
+)
+
+// SearchDocument is the searchable text of a file, every field is normalized by SearchText
+type SearchDocument struct {
+	FileId string
+	// filename with extension
+	Filename string
+	// user metadata keys and values and tags
+	Metadata string
+	// text extracted from content, empty for binary or encrypted files
+	Content string
+}
+
+type SearchQuery struct {
+	Text     string
+	Page     int
+	PageSize int
+}
+
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchText normalizes text to lowercase words separated by spaces,
+// so every backend splits documents and queries into the same terms
+func SearchText(text string) string {
+	return strings.Join(searchTokens(text), " ")
+}
+
+// searchTerms returns unique terms of a query, a file matches when it contains all of them
+func searchTerms(text string) []string {
+	var terms []string
+	for _, token := range searchTokens(text) {
+		if len(terms) == maxSearchTerms {
+			break
+		}
+		if !slices.Contains(terms, token) {
+			terms = append(terms, token)
+		}
+	}
+	return terms
+}
+
+// quotedTerms joins terms as quoted phrases, SQLite FTS and MongoDB
+// require every quoted phrase to be present
+func quotedTerms(terms []string) string {
+	return `"` + strings.Join(terms, `" "`) + `"`
+}
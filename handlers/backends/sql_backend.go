@@ -2,33 +2,49 @@ package backends
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hybrid-storage/models"
 	"hybrid-storage/utils"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqlExecutor runs statements on the database or inside a transaction
+type sqlExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 type SQLBackend struct {
 	db    *sql.DB
 	query utils.Query
+	// SQLite search table uses FTS5 when built with sqlite_fts5 tag and FTS4 otherwise
+	fts5 bool
+	// store chunks once by content hash in chunks table
+	Dedup bool
 }
 
 func createTables(db *sql.DB, query utils.Query) error {
 	var fileType string
 	var idType string
+	var jsonType string
 	switch query.Type {
 	case utils.SQLite:
 		fileType = "BLOB"
 		idType = "INTEGER PRIMARY KEY AUTOINCREMENT"
+		jsonType = "TEXT"
 	case utils.PostgreSQL:
 		fileType = "BYTEA"
 		idType = "SERIAL PRIMARY KEY"
+		jsonType = "JSONB"
 	default:
 		panic(errors.New("unknown query type"))
 	}
@@ -36,31 +52,104 @@ func createTables(db *sql.DB, query utils.Query) error {
 		`CREATE TABLE IF NOT EXISTS files (
 			id %s,
 			file_id TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1,
 			chunk INTEGER NOT NULL,
 			data %s NOT NULL,
+			hash TEXT,
 			FOREIGN KEY (file_id) REFERENCES metadata (file_id)
 		)`,
 		idType,
 		fileType,
 	)
+	// chunks shared between files in dedup mode
+	createChunksQuery := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS chunks (
+			hash TEXT PRIMARY KEY,
+			data %s NOT NULL,
+			ref_count INTEGER NOT NULL DEFAULT 0
+		)`,
+		fileType,
+	)
 	queries := []string{
 		`--sql
 		DROP TABLE IF EXISTS files
 		`,
 		`--sql
+		DROP TABLE IF EXISTS versions
+		`,
+		`--sql
+		DROP TABLE IF EXISTS tags
+		`,
+		`--sql
 		DROP TABLE IF EXISTS metadata
 		`,
+		`--sql
+		DROP TABLE IF EXISTS chunks
+		`,
+		`--sql
+		DROP TABLE IF EXISTS search
+		`,
+		`--sql
+		DROP TABLE IF EXISTS folders
+		`,
 		`CREATE TABLE IF NOT EXISTS metadata (
 			file_id TEXT PRIMARY KEY,
 			filename TEXT NOT NULL,
 			extension TEXT NOT NULL,
+			tenant TEXT NOT NULL DEFAULT '',
+			owner TEXT NOT NULL DEFAULT '',
+			size INTEGER NOT NULL DEFAULT 0,
+			version INTEGER NOT NULL DEFAULT 1,
+			revision INTEGER NOT NULL DEFAULT 1,
 			created_at INTEGER NOT NULL,
-			updated_at INTEGER NOT NULL
+			updated_at INTEGER NOT NULL,
+			deleted_at INTEGER NOT NULL DEFAULT 0,
+			expires_at INTEGER NOT NULL DEFAULT 0,
+			legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+			retain_until INTEGER NOT NULL DEFAULT 0,
+			compression TEXT NOT NULL DEFAULT '',
+			key_id TEXT NOT NULL DEFAULT '',
+			wrapped_key TEXT NOT NULL DEFAULT '',
+			key_fingerprint TEXT NOT NULL DEFAULT '',
+			user_metadata ` + jsonType + ` NOT NULL DEFAULT '{}',
+			folder_id TEXT NOT NULL DEFAULT '',
+			pending BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`--sql
+		CREATE INDEX IF NOT EXISTS idx_metadata_folder_id ON metadata (folder_id);
+		`,
+		`CREATE TABLE IF NOT EXISTS folders (
+			folder_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			parent_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			UNIQUE (parent_id, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS tags (
+			file_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (file_id, tag),
+			FOREIGN KEY (file_id) REFERENCES metadata (file_id)
+		)`,
+		`--sql
+		CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags (tag);
+		`,
+		`CREATE TABLE IF NOT EXISTS versions (
+			file_id TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			size INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL DEFAULT 0,
+			pending BOOLEAN NOT NULL DEFAULT FALSE,
+			PRIMARY KEY (file_id, version),
+			FOREIGN KEY (file_id) REFERENCES metadata (file_id)
 		)`,
 		createFilesQuery,
+		createChunksQuery,
 		`--sql
-		CREATE UNIQUE INDEX idx_files_file_id_chunk
-		ON files (file_id, chunk);
+		CREATE UNIQUE INDEX idx_files_file_id_version_chunk
+		ON files (file_id, version, chunk);
 		`,
 	}
 	for _, tableCreateScript := range queries {
@@ -72,8 +161,41 @@ func createTables(db *sql.DB, query utils.Query) error {
 	return nil
 }
 
+// createSearchTable creates full text index of files, on SQLite it tells if FTS5 is available
+func createSearchTable(db *sql.DB, query utils.Query) (bool, error) {
+	if query.Type == utils.PostgreSQL {
+		for _, createQuery := range []string{
+			`CREATE TABLE IF NOT EXISTS search (
+				file_id TEXT PRIMARY KEY,
+				document TSVECTOR NOT NULL
+			)`,
+			`--sql
+			CREATE INDEX IF NOT EXISTS idx_search_document ON search USING GIN (document);
+			`,
+		} {
+			_, err := db.Exec(createQuery)
+			if err != nil {
+				return false, fmt.Errorf("failed to create search table: %w", err)
+			}
+		}
+		return false, nil
+	}
+
+	_, err := db.Exec(`CREATE VIRTUAL TABLE search USING fts5(file_id UNINDEXED, filename, metadata, content)`)
+	if err == nil {
+		return true, nil
+	}
+	_, err = db.Exec(`CREATE VIRTUAL TABLE search USING fts4(file_id, filename, metadata, content, notindexed=file_id)`)
+	if err != nil {
+		return false, fmt.Errorf("failed to create search table: %w", err)
+	}
+	return false, nil
+}
+
 func NewSQLiteBackend(dbPath string) (*SQLBackend, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// transactions take the write lock at once, a read lock upgraded later
+	// fails with "database is locked" instead of waiting
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -83,8 +205,12 @@ func NewSQLiteBackend(dbPath string) (*SQLBackend, error) {
 	if err != nil {
 		return nil, err
 	}
+	fts5, err := createSearchTable(db, sqliteQuery)
+	if err != nil {
+		return nil, err
+	}
 
-	return &SQLBackend{db: db, query: sqliteQuery}, nil
+	return &SQLBackend{db: db, query: sqliteQuery, fts5: fts5}, nil
 }
 
 func NewPostgresBackend(
@@ -117,6 +243,10 @@ func NewPostgresBackend(
 	if err != nil {
 		return nil, err
 	}
+	_, err = createSearchTable(db, postgresQuery)
+	if err != nil {
+		return nil, err
+	}
 
 	return &SQLBackend{db: db, query: postgresQuery}, nil
 }
@@ -126,43 +256,283 @@ func (b *SQLBackend) UploadFile(
 	fileId string,
 ) (FileServerResult, error) {
 	now := time.Now().Unix()
+	tx, err := b.db.Begin()
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	defer tx.Rollback()
 
 	if chunk.ChunkNumber == 1 {
-		metadata := utils.ReadJsonData[models.FileMetadata](chunk.JsonData)
-		_, err := b.db.Exec(b.query.GetCachedQuery(`
-			INSERT INTO metadata (file_id, filename, extension,  created_at, updated_at)
-			VALUES (?, ?, ?, ?, ?)
+		// new file stays pending and invisible until its last chunk is written
+		stored := utils.ReadJsonData[models.StoredMetadata](chunk.JsonData)
+		metadata := stored.Metadata()
+		_, err := tx.Exec(b.query.GetCachedQuery(`
+			INSERT INTO metadata (
+				file_id, filename, extension, tenant, owner, size, version,
+				created_at, updated_at, expires_at, compression, key_id, wrapped_key, key_fingerprint,
+				user_metadata, folder_id, pending
+			)
+			VALUES (?, ?, ?, ?, ?, 0, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, TRUE)
 		`),
 			fileId,
 			metadata.Filename,
 			metadata.Extension,
+			metadata.Tenant,
+			metadata.Owner,
 			now,
 			now,
+			metadata.ExpiresAt,
+			metadata.Compression,
+			metadata.KeyId,
+			metadata.WrappedKey,
+			metadata.KeyFingerprint,
+			userMetadataJson(metadata.UserMetadata),
+			metadata.FolderId,
 		)
 		if err != nil {
 			log.Println(err.Error())
 			return FileServerResult{}, errors.New("failed to insert metadata")
 		}
+		err = b.replaceTags(tx, fileId, metadata.Tags)
+		if err != nil {
+			return FileServerResult{}, err
+		}
 	} else {
 		// chunk belongs to the same file
 		fileId = chunk.FileId
 	}
 
+	err = b.writeVersionChunk(tx, fileId, chunk)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return FileServerResult{}, err
+	}
+
+	return FileServerResult{FileId: fileId}, nil
+}
+
+func userMetadataJson(userMetadata map[string]string) string {
+	if userMetadata == nil {
+		return "{}"
+	}
+	data, _ := json.Marshal(userMetadata)
+	return string(data)
+}
+
+// replaceTags replaces the tag set of a file
+func (b *SQLBackend) replaceTags(exec sqlExecutor, fileId string, tags []string) error {
+	_, err := exec.Exec(b.query.GetCachedQuery(`
+		DELETE FROM tags
+		WHERE file_id = ?
+	`),
+		fileId,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("failed to delete tags")
+	}
+	for _, tag := range tags {
+		_, err = exec.Exec(b.query.GetCachedQuery(`
+			INSERT INTO tags (file_id, tag)
+			VALUES (?, ?)
+		`),
+			fileId,
+			tag,
+		)
+		if err != nil {
+			log.Println(err.Error())
+			return errors.New("failed to insert tags")
+		}
+	}
+	return nil
+}
+
+// writeVersionChunk stores chunk into the newest version of a file, first chunk starts a new pending version.
+// On the last chunk the version and a new file are published, all inside the caller's transaction
+func (b *SQLBackend) writeVersionChunk(tx *sql.Tx, fileId string, chunk utils.ChunkResult) error {
+	var version int64
+	var pending bool
+	err := tx.QueryRow(b.query.GetCachedQuery(`
+		SELECT version, pending FROM versions WHERE file_id = ? ORDER BY version DESC LIMIT 1
+	`),
+		fileId,
+	).Scan(&version, &pending)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to query versions: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if chunk.ChunkNumber == 1 {
+		version++
+		_, err = tx.Exec(b.query.GetCachedQuery(`
+			INSERT INTO versions (file_id, version, size, created_at, updated_at, pending)
+			VALUES (?, ?, 0, ?, ?, TRUE)
+		`),
+			fileId,
+			version,
+			now,
+			now,
+		)
+		if err != nil {
+			log.Println(err.Error())
+			return errors.New("failed to insert version")
+		}
+	} else if version == 0 {
+		return &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: "file not found",
+		}
+	} else if !pending {
+		return versionFinishedError()
+	}
+
 	fileData := utils.ReadChunkBytes(chunk)
-	_, err := b.db.Exec(b.query.GetCachedQuery(`
-		INSERT INTO files (file_id, chunk, data)
-		VALUES (?, ?, ?)
+	var hash sql.NullString
+	if b.Dedup {
+		hash = sql.NullString{String: chunkHash(fileData), Valid: true}
+		err = b.retainChunk(tx, hash.String, fileData)
+		if err != nil {
+			log.Println(err.Error())
+			return errors.New("failed to insert chunk")
+		}
+		// data is kept only in chunks table
+		fileData = []byte{}
+	}
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		INSERT INTO files (file_id, version, chunk, data, hash)
+		VALUES (?, ?, ?, ?, ?)
 	`),
 		fileId,
+		version,
 		chunk.ChunkNumber,
 		fileData,
+		hash,
 	)
 	if err != nil {
 		log.Println(err.Error())
-		return FileServerResult{}, errors.New("failed to insert file")
+		return errors.New("failed to insert file")
 	}
 
-	return FileServerResult{FileId: fileId}, nil
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		UPDATE versions
+		SET size = size + ?, updated_at = ?, pending = ?
+		WHERE file_id = ? AND version = ?
+	`),
+		chunk.Size,
+		now,
+		!chunk.IsLastChunk,
+		fileId,
+		version,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("failed to update version")
+	}
+
+	// a pending file is touched by every chunk, so only abandoned uploads get stale
+	query := `
+		UPDATE metadata
+		SET updated_at = ?
+		WHERE file_id = ? AND pending = TRUE
+	`
+	args := []any{now, fileId}
+	if chunk.IsLastChunk {
+		query = `
+			UPDATE metadata
+			SET version = ?, size = (
+				SELECT size FROM versions WHERE file_id = ? AND version = ?
+			), pending = FALSE
+			WHERE file_id = ?
+		`
+		args = []any{version, fileId, version, fileId}
+	}
+	_, err = tx.Exec(b.query.GetCachedQuery(query), args...)
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("failed to update metadata")
+	}
+	return nil
+}
+
+const metadataColumns = "file_id, filename, extension, tenant, owner, size, version, revision, created_at, updated_at, deleted_at, expires_at, legal_hold, retain_until, compression, key_id, wrapped_key, key_fingerprint, user_metadata, folder_id"
+
+// metadataSelect selects metadataColumns of metadata table and tags of a file as a json array
+func (b *SQLBackend) metadataSelect() string {
+	tagsColumn := "(SELECT json_group_array(tag) FROM tags WHERE tags.file_id = metadata.file_id)"
+	if b.query.Type == utils.PostgreSQL {
+		tagsColumn = "(SELECT COALESCE(json_agg(tag), '[]')::TEXT FROM tags WHERE tags.file_id = metadata.file_id)"
+	}
+	return metadataColumns + ", " + tagsColumn
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMetadata(row rowScanner, metadata *models.FileMetadata) error {
+	var userMetadata, tags string
+	err := row.Scan(
+		&metadata.FileId,
+		&metadata.Filename,
+		&metadata.Extension,
+		&metadata.Tenant,
+		&metadata.Owner,
+		&metadata.Size,
+		&metadata.Version,
+		&metadata.Revision,
+		&metadata.CreatedAt,
+		&metadata.UpdatedAt,
+		&metadata.DeletedAt,
+		&metadata.ExpiresAt,
+		&metadata.LegalHold,
+		&metadata.RetainUntil,
+		&metadata.Compression,
+		&metadata.KeyId,
+		&metadata.WrappedKey,
+		&metadata.KeyFingerprint,
+		&userMetadata,
+		&metadata.FolderId,
+		&tags,
+	)
+	if err != nil {
+		return err
+	}
+	metadata.UserMetadata = utils.ReadJsonData[map[string]string]([]byte(userMetadata))
+	metadata.Tags = utils.ReadJsonData[[]string]([]byte(tags))
+	// tags table has no order
+	slices.Sort(metadata.Tags)
+	return nil
+}
+
+// retainChunk adds a reference to a shared chunk, data is inserted only for a new chunk
+func (b *SQLBackend) retainChunk(exec sqlExecutor, hash string, data []byte) error {
+	result, err := exec.Exec(b.query.GetCachedQuery(`
+		UPDATE chunks
+		SET ref_count = ref_count + 1
+		WHERE hash = ?
+	`),
+		hash,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+	// concurrent upload of the same chunk may insert it first
+	_, err = exec.Exec(b.query.GetCachedQuery(`
+		INSERT INTO chunks (hash, data, ref_count)
+		VALUES (?, ?, 1)
+		ON CONFLICT (hash) DO UPDATE SET ref_count = chunks.ref_count + 1
+	`),
+		hash,
+		data,
+	)
+	return err
 }
 
 func handleScanErrors(errs []error) error {
@@ -186,35 +556,24 @@ func handleScanErrors(errs []error) error {
 	return nil
 }
 
-func (b *SQLBackend) GetFile(fileId string) (GetFileResult, error) {
-	metadataRow := b.db.QueryRow(b.query.GetCachedQuery(`
-		SELECT file_id, filename, extension,  created_at, updated_at
-		FROM metadata
-		WHERE file_id = ?
-	`),
-		fileId,
-	)
-	var metadata models.FileMetadata
-	metadataScanErr := metadataRow.Scan(
-		&metadata.FileId,
-		&metadata.Filename,
-		&metadata.Extension,
-		&metadata.CreatedAt,
-		&metadata.UpdatedAt,
-	)
-
+func (b *SQLBackend) getVersionData(fileId string, version int64) ([]byte, error) {
 	fileDataRows, err := b.db.Query(b.query.GetCachedQuery(`
-		SELECT data FROM files WHERE file_id = ?
+		SELECT COALESCE(chunks.data, files.data)
+		FROM files
+		LEFT JOIN chunks ON chunks.hash = files.hash
+		WHERE files.file_id = ? AND files.version = ?
+		ORDER BY files.chunk
 	`),
 		fileId,
+		version,
 	)
 	if err != nil {
-		return GetFileResult{}, err
+		return nil, err
 	}
 	defer fileDataRows.Close()
 
 	var fileData []byte
-	scanErrors := []error{metadataScanErr}
+	scanErrors := []error{nil}
 	for fileDataRows.Next() {
 		var chunkData []byte
 		fileDataScanErr := fileDataRows.Scan(&chunkData)
@@ -224,7 +583,16 @@ func (b *SQLBackend) GetFile(fileId string) (GetFileResult, error) {
 		// constuct file from its chunks
 		fileData = append(fileData, chunkData...)
 	}
-	err = handleScanErrors(scanErrors)
+	return fileData, handleScanErrors(scanErrors)
+}
+
+func (b *SQLBackend) GetFile(fileId string) (GetFileResult, error) {
+	metadata, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return GetFileResult{}, err
+	}
+
+	fileData, err := b.getVersionData(fileId, metadata.Version)
 	if err != nil {
 		return GetFileResult{}, err
 	}
@@ -232,150 +600,1210 @@ func (b *SQLBackend) GetFile(fileId string) (GetFileResult, error) {
 	return GetFileResult{File: fileData, Metadata: metadata}, nil
 }
 
-func (b *SQLBackend) GetFileMetadata(fileId string) (
-	models.FileMetadata,
-	error,
-) {
-	row := b.db.QueryRow(b.query.GetCachedQuery(`
-		SELECT file_id, filename, extension, created_at, updated_at
-		FROM metadata
-		WHERE file_id = ?
+func (b *SQLBackend) getVersion(exec sqlExecutor, fileId string, version int64) (models.FileVersion, error) {
+	var fileVersion models.FileVersion
+	err := exec.QueryRow(b.query.GetCachedQuery(`
+		SELECT file_id, version, size, created_at
+		FROM versions
+		WHERE file_id = ? AND version = ? AND pending = FALSE
 	`),
 		fileId,
+		version,
+	).Scan(
+		&fileVersion.FileId,
+		&fileVersion.Version,
+		&fileVersion.Size,
+		&fileVersion.CreatedAt,
 	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fileVersion, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: fmt.Sprintf("version %d not found", version),
+		}
+	}
+	return fileVersion, handleScanErrors([]error{err})
+}
 
-	var metadata models.FileMetadata
-	err := row.Scan(
-		&metadata.FileId,
-		&metadata.Filename,
-		&metadata.Extension,
-		&metadata.CreatedAt,
-		&metadata.UpdatedAt,
-	)
-	err = handleScanErrors([]error{err})
+func (b *SQLBackend) GetFileVersion(fileId string, version int64) (GetFileResult, error) {
+	metadata, err := b.GetFileMetadata(fileId)
 	if err != nil {
-		return models.FileMetadata{}, err
+		return GetFileResult{}, err
+	}
+	fileVersion, err := b.getVersion(b.db, fileId, version)
+	if err != nil {
+		return GetFileResult{}, err
 	}
 
-	return metadata, nil
-}
+	fileData, err := b.getVersionData(fileId, version)
+	if err != nil {
+		return GetFileResult{}, err
+	}
 
-func paginateQuery(query string, limit int, offset int) string {
-	return query + fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	metadata.Version = fileVersion.Version
+	metadata.Size = fileVersion.Size
+	return GetFileResult{File: fileData, Metadata: metadata}, nil
 }
 
-func (b *SQLBackend) GetAllFiles(page int, pageSize int) (
-	PaginatedItems[models.FileMetadata],
-	error,
-) {
-	offset := (page - 1) * pageSize
-
-	selectQuery := `
-		SELECT file_id, filename, extension, created_at, updated_at
-		FROM metadata
-	`
-	query := paginateQuery(selectQuery, pageSize, offset)
-
-	rows, err := b.db.Query(query)
+func (b *SQLBackend) GetFileVersions(fileId string) ([]models.FileVersion, error) {
+	rows, err := b.db.Query(b.query.GetCachedQuery(`
+		SELECT file_id, version, size, created_at, updated_at, pending
+		FROM versions
+		WHERE file_id = ?
+		ORDER BY version
+	`),
+		fileId,
+	)
 	if err != nil {
-		return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+		return nil, &FileServerError{
 			Code:   http.StatusInternalServerError,
-			Detail: fmt.Sprintf("failed to query all files: %s", err.Error()),
+			Detail: fmt.Sprintf("failed to query versions: %s", err.Error()),
 		}
 	}
 	defer rows.Close()
 
-	var files []models.FileMetadata
+	var versions []models.FileVersion
 	for rows.Next() {
-		var metadata models.FileMetadata
+		var fileVersion models.FileVersion
 		err := rows.Scan(
-			&metadata.FileId,
-			&metadata.Filename,
-			&metadata.Extension,
-			&metadata.CreatedAt,
-			&metadata.UpdatedAt,
+			&fileVersion.FileId,
+			&fileVersion.Version,
+			&fileVersion.Size,
+			&fileVersion.CreatedAt,
+			&fileVersion.UpdatedAt,
+			&fileVersion.Pending,
 		)
 		if err != nil {
-			return PaginatedItems[models.FileMetadata]{}, &FileServerError{
-				Code:   http.StatusInternalServerError,
-				Detail: fmt.Sprintf("failed to scan file metadata: %s", err.Error()),
-			}
+			return nil, handleScanErrors([]error{err})
 		}
-		files = append(files, metadata)
+		versions = append(versions, fileVersion)
 	}
-
-	futureQuery := paginateQuery(selectQuery, 1, offset+pageSize)
-	futureRow, err := b.db.Query(futureQuery)
-	if err != nil {
-		return PaginatedItems[models.FileMetadata]{}, &FileServerError{
-			Code:   http.StatusInternalServerError,
-			Detail: fmt.Sprintf("failed to query next page: %s", err.Error()),
+	if len(versions) == 0 {
+		return nil, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: "file not found",
 		}
 	}
-	defer futureRow.Close()
-
-	result := PaginatedItems[models.FileMetadata]{
-		Items:      files,
-		Page:       int64(page),
-		PageSize:   int64(pageSize),
-		IsNextPage: futureRow.Next(),
-	}
-	return result, nil
+	return versions, nil
 }
 
-func (b *SQLBackend) UpdateFile(
-	chunk utils.ChunkResult,
-	fileId string,
-	data FileMetadataUpdate,
-) (
-	FileServerResult,
-	error,
-) {
-	var query string
-	var args []interface{}
-
-	// update only metadata
-	if chunk.FormDataChunk == nil {
-		query = b.query.GetCachedQuery(`
-			UPDATE metadata
-			SET filename = ?, updated_at = ?
-			WHERE file_id = ?
-		`)
-		args = []any{data.Filename, time.Now().Unix(), fileId}
-		_, err := b.db.Exec(query, args...)
-		if err != nil {
-			return FileServerResult{}, err
-		}
-	} else { // else delete old file and upload new with same file_id
-		if chunk.ChunkNumber == 1 {
-			b.DeleteFile(fileId)
-		}
-		b.UploadFile(chunk, fileId)
+// RestoreFileVersion copies chunks of the version into a new one in a single transaction,
+// revision of the file is compared and swapped first, so concurrent changes of the file are rejected
+func (b *SQLBackend) RestoreFileVersion(fileId string, version int64) (FileServerResult, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return FileServerResult{}, err
 	}
+	defer tx.Rollback()
 
-	return FileServerResult{FileId: fileId}, nil
-}
-
-func (b *SQLBackend) DeleteFile(fileId string) (bool, error) {
-	_, err := b.db.Exec(b.query.GetCachedQuery(`
-		DELETE FROM files
-		WHERE file_id = ?
+	var revision int64
+	err = tx.QueryRow(b.query.GetCachedQuery(`
+		SELECT revision
+		FROM metadata
+		WHERE file_id = ? AND deleted_at = 0 AND pending = FALSE
 	`),
 		fileId,
-	)
+	).Scan(&revision)
 	if err != nil {
-		return false, err
+		return FileServerResult{}, handleScanErrors([]error{err})
 	}
-
-	_, err = b.db.Exec(b.query.GetCachedQuery(`
-		DELETE FROM metadata
+	err = b.changeRevision(tx, fileId, &revision)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	fileVersion, err := b.getVersion(tx, fileId, version)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+
+	// restored content becomes a new version, old versions stay immutable
+	var restoredVersion int64
+	err = tx.QueryRow(b.query.GetCachedQuery(`
+		SELECT MAX(version) + 1 FROM versions WHERE file_id = ?
+	`),
+		fileId,
+	).Scan(&restoredVersion)
+	if err != nil {
+		return FileServerResult{}, handleScanErrors([]error{err})
+	}
+
+	now := time.Now().Unix()
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		{
+			`INSERT INTO versions (file_id, version, size, created_at)
+			VALUES (?, ?, ?, ?)`,
+			[]any{fileId, restoredVersion, fileVersion.Size, now},
+		},
+		{
+			`INSERT INTO files (file_id, version, chunk, data, hash)
+			SELECT file_id, ?, chunk, data, hash
+			FROM files
+			WHERE file_id = ? AND version = ?`,
+			[]any{restoredVersion, fileId, version},
+		},
+		{
+			// restored version shares chunks of the original one
+			`UPDATE chunks
+			SET ref_count = ref_count + (
+				SELECT COUNT(*) FROM files
+				WHERE files.hash = chunks.hash AND files.file_id = ? AND files.version = ?
+			)
+			WHERE hash IN (SELECT hash FROM files WHERE file_id = ? AND version = ?)`,
+			[]any{fileId, version, fileId, version},
+		},
+		{
+			`UPDATE metadata
+			SET version = ?, size = ?, updated_at = ?
+			WHERE file_id = ?`,
+			[]any{restoredVersion, fileVersion.Size, now, fileId},
+		},
+	}
+	for _, query := range queries {
+		_, err = tx.Exec(b.query.GetCachedQuery(query.query), query.args...)
+		if err != nil {
+			log.Println(err.Error())
+			return FileServerResult{}, errors.New("failed to restore version")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	return FileServerResult{FileId: fileId}, nil
+}
+
+func (b *SQLBackend) GetFileMetadata(fileId string) (
+	models.FileMetadata,
+	error,
+) {
+	return b.getMetadata(fileId, "deleted_at = 0 AND pending = FALSE")
+}
+
+// GetUploadMetadata also returns a new file that is still pending
+func (b *SQLBackend) GetUploadMetadata(fileId string) (models.FileMetadata, error) {
+	return b.getMetadata(fileId, "deleted_at = 0")
+}
+
+func (b *SQLBackend) getMetadata(fileId string, condition string) (models.FileMetadata, error) {
+	row := b.db.QueryRow(b.query.GetCachedQuery(`
+		SELECT `+b.metadataSelect()+`
+		FROM metadata
+		WHERE file_id = ? AND `+condition+`
+	`),
+		fileId,
+	)
+
+	var metadata models.FileMetadata
+	err := scanMetadata(row, &metadata)
+	err = handleScanErrors([]error{err})
+	if err != nil {
+		return models.FileMetadata{}, err
+	}
+	if isExpired(metadata, time.Now().Unix()) {
+		return models.FileMetadata{}, expiredError(fileId)
+	}
+
+	return metadata, nil
+}
+
+// paginateQuery limits query to a page, zero limit selects all rows like in other backends
+func paginateQuery(query string, limit int, offset int) string {
+	if limit == 0 && offset == 0 {
+		return query
+	}
+	return query + fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+}
+
+var sortColumns = map[string]string{
+	SortByFilename:  "filename",
+	SortByExtension: "extension",
+	SortByCreatedAt: "created_at",
+	SortByUpdatedAt: "updated_at",
+	SortBySize:      "size",
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// filesConditions builds WHERE conditions of a files query and their arguments,
+// deleted and expired files are hidden
+func filesConditions(filter FileFilter, now int64) ([]string, []any) {
+	conditions := []string{"deleted_at = 0", "pending = FALSE", "(expires_at = 0 OR expires_at > ?)"}
+	args := []any{now}
+	if filter.Filename != "" {
+		conditions = append(conditions, `LOWER(filename) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(filter.Filename))+"%")
+	}
+	if filter.FilenamePrefix != "" {
+		conditions = append(conditions, `LOWER(filename) LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(strings.ToLower(filter.FilenamePrefix))+"%")
+	}
+	if filter.Extension != "" {
+		conditions = append(conditions, "LOWER(extension) = ?")
+		args = append(args, strings.ToLower(filter.normalizedExtension()))
+	}
+	if filter.Name != "" {
+		filename, extension := splitName(filter.Name)
+		conditions = append(conditions, "filename = ? AND extension = ?")
+		args = append(args, filename, extension)
+	}
+	if filter.FolderId != nil {
+		conditions = append(conditions, "folder_id = ?")
+		args = append(args, *filter.FolderId)
+	}
+	if filter.Tag != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM tags WHERE tags.file_id = metadata.file_id AND tags.tag = ?)")
+		args = append(args, filter.Tag)
+	}
+	for _, bound := range []struct {
+		condition string
+		value     int64
+	}{
+		{"created_at >= ?", filter.CreatedAfter},
+		{"created_at <= ?", filter.CreatedBefore},
+		{"updated_at >= ?", filter.UpdatedAfter},
+		{"updated_at <= ?", filter.UpdatedBefore},
+		{"size >= ?", filter.MinSize},
+		{"size <= ?", filter.MaxSize},
+	} {
+		if bound.value != 0 {
+			conditions = append(conditions, bound.condition)
+			args = append(args, bound.value)
+		}
+	}
+	return conditions, args
+}
+
+func filesOrder(query FilesQuery) string {
+	direction := "ASC"
+	if query.Descending {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("%s %s, file_id %s", sortColumns[query.sortField()], direction, direction)
+}
+
+func (b *SQLBackend) GetAllFiles(query FilesQuery) (
+	PaginatedItems[models.FileMetadata],
+	error,
+) {
+	page, pageSize := query.Page, query.PageSize
+	offset := query.offset()
+
+	conditions, args := filesConditions(query.Filter, time.Now().Unix())
+	var totalItems int64
+	if !query.SkipCount {
+		err := b.db.QueryRow(b.query.GetCachedQuery(`
+			SELECT COUNT(*)
+			FROM metadata
+			WHERE `+strings.Join(conditions, " AND ")+`
+		`),
+			args...,
+		).Scan(&totalItems)
+		if err != nil {
+			return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: fmt.Sprintf("failed to count files: %s", err.Error()),
+			}
+		}
+	}
+	if query.After != nil {
+		// row values seek straight to the cursor along the sort order
+		comparison := ">"
+		if query.Descending {
+			comparison = "<"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, file_id) %s (?, ?)", sortColumns[query.sortField()], comparison))
+		args = append(args, query.After.value(), query.After.FileId)
+	}
+	selectQuery := b.query.GetCachedQuery(`
+		SELECT ` + b.metadataSelect() + `
+		FROM metadata
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ` + filesOrder(query) + `
+	`)
+	sqlQuery := paginateQuery(selectQuery, pageSize, offset)
+
+	rows, err := b.db.Query(sqlQuery, args...)
+	if err != nil {
+		return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: fmt.Sprintf("failed to query all files: %s", err.Error()),
+		}
+	}
+	defer rows.Close()
+
+	var files []models.FileMetadata
+	for rows.Next() {
+		var metadata models.FileMetadata
+		err := scanMetadata(rows, &metadata)
+		if err != nil {
+			return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: fmt.Sprintf("failed to scan file metadata: %s", err.Error()),
+			}
+		}
+		files = append(files, metadata)
+	}
+
+	isNextPage := false
+	if pageSize > 0 {
+		futureQuery := paginateQuery(selectQuery, 1, offset+pageSize)
+		futureRow, err := b.db.Query(futureQuery, args...)
+		if err != nil {
+			return PaginatedItems[models.FileMetadata]{}, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: fmt.Sprintf("failed to query next page: %s", err.Error()),
+			}
+		}
+		defer futureRow.Close()
+		isNextPage = futureRow.Next()
+	}
+	result := PaginatedItems[models.FileMetadata]{
+		Items:      files,
+		Page:       int64(page),
+		PageSize:   int64(pageSize),
+		IsNextPage: isNextPage,
+		NextCursor: query.nextCursor(files, isNextPage),
+	}
+	if !query.SkipCount {
+		result.setTotal(totalItems)
+	}
+	return result, nil
+}
+
+func (b *SQLBackend) UpdateFile(
+	chunk utils.ChunkResult,
+	fileId string,
+	data FileMetadataUpdate,
+) (
+	FileServerResult,
+	error,
+) {
+	_, err := b.GetFileMetadata(fileId)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+
+	// update only metadata
+	if chunk.FormDataChunk == nil {
+		err = b.updateMetadata(b.db, fileId, data)
+		if err != nil {
+			return FileServerResult{}, err
+		}
+	} else { // else store new content as the next version
+		err = b.writeContentChunk(fileId, chunk, data.Revision)
+		if err != nil {
+			return FileServerResult{}, err
+		}
+	}
+
+	return FileServerResult{FileId: fileId}, nil
+}
+
+// writeContentChunk writes a chunk of a new version in a single transaction, so the
+// current version is swapped only together with its last chunk
+func (b *SQLBackend) writeContentChunk(fileId string, chunk utils.ChunkResult, revision *int64) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// revision is compared when a new version starts and changes again when it becomes current
+	if chunk.ChunkNumber <= 1 {
+		err = b.changeRevision(tx, fileId, revision)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.writeVersionChunk(tx, fileId, chunk)
+	if err != nil {
+		return err
+	}
+	if chunk.IsLastChunk {
+		_, err = tx.Exec(b.query.GetCachedQuery(`
+			UPDATE metadata
+			SET updated_at = ?, revision = revision + ?
+			WHERE file_id = ?
+		`),
+			time.Now().Unix(),
+			revisionStep(chunk),
+			fileId,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// changeRevision increments revision of a file that is not in trash, compare and swap
+// when the expected revision is given
+func (b *SQLBackend) changeRevision(exec sqlExecutor, fileId string, revision *int64) error {
+	query := `
+		UPDATE metadata
+		SET revision = revision + 1
+		WHERE file_id = ? AND deleted_at = 0
+	`
+	args := []any{fileId}
+	if revision != nil {
+		query += " AND revision = ?"
+		args = append(args, *revision)
+	}
+	result, err := exec.Exec(b.query.GetCachedQuery(query), args...)
+	if err != nil {
+		return err
+	}
+	return b.checkRevision(exec, result, fileId, revision)
+}
+
+// checkRevision tells a file changed by another client from a missing one
+// when a conditional update matched no rows
+func (b *SQLBackend) checkRevision(exec sqlExecutor, result sql.Result, fileId string, revision *int64) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+	var count int64
+	if revision != nil {
+		err = exec.QueryRow(b.query.GetCachedQuery(`
+			SELECT COUNT(*) FROM metadata WHERE file_id = ? AND deleted_at = 0
+		`),
+			fileId,
+		).Scan(&count)
+		if err != nil {
+			return handleScanErrors([]error{err})
+		}
+	}
+	if count > 0 {
+		return revisionConflictError(fileId, *revision)
+	}
+	return &FileServerError{
+		Code:   http.StatusNotFound,
+		Detail: "file not found",
+	}
+}
+
+// updateMetadata changes metadata of a file that is not in trash
+func (b *SQLBackend) updateMetadata(exec sqlExecutor, fileId string, data FileMetadataUpdate) error {
+	setClauses := []string{"updated_at = ?", "revision = revision + 1"}
+	args := []any{time.Now().Unix()}
+	if data.Filename != "" {
+		setClauses = append(setClauses, "filename = ?")
+		args = append(args, data.Filename)
+	}
+	if data.ExpiresAt != nil {
+		setClauses = append(setClauses, "expires_at = ?")
+		args = append(args, *data.ExpiresAt)
+	}
+	if data.LegalHold != nil {
+		setClauses = append(setClauses, "legal_hold = ?")
+		args = append(args, *data.LegalHold)
+	}
+	if data.RetainUntil != nil {
+		setClauses = append(setClauses, "retain_until = ?")
+		args = append(args, *data.RetainUntil)
+	}
+	if data.UserMetadata != nil {
+		setClauses = append(setClauses, "user_metadata = ?")
+		args = append(args, userMetadataJson(data.UserMetadata))
+	}
+	if data.FolderId != nil {
+		setClauses = append(setClauses, "folder_id = ?")
+		args = append(args, *data.FolderId)
+	}
+	args = append(args, fileId)
+	query := `
+		UPDATE metadata
+		SET ` + strings.Join(setClauses, ", ") + `
+		WHERE file_id = ? AND deleted_at = 0
+	`
+	if data.Revision != nil {
+		query += " AND revision = ?"
+		args = append(args, *data.Revision)
+	}
+	result, err := exec.Exec(b.query.GetCachedQuery(query), args...)
+	if err != nil {
+		return err
+	}
+	err = b.checkRevision(exec, result, fileId, data.Revision)
+	if err != nil {
+		return err
+	}
+	if data.Tags != nil {
+		return b.replaceTags(exec, fileId, data.Tags)
+	}
+	return nil
+}
+
+// CopyFile copies chunks of the current version with INSERT ... SELECT in a single transaction,
+// shared chunks of dedup mode get one more reference per copied chunk
+func (b *SQLBackend) CopyFile(fileId string, target models.FileMetadata) (FileServerResult, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	defer tx.Rollback()
+
+	var version, size int64
+	err = tx.QueryRow(b.query.GetCachedQuery(`
+		SELECT version, size
+		FROM metadata
+		WHERE file_id = ? AND deleted_at = 0 AND pending = FALSE
+	`),
+		fileId,
+	).Scan(&version, &size)
+	if err != nil {
+		return FileServerResult{}, handleScanErrors([]error{err})
+	}
+
+	now := time.Now().Unix()
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		INSERT INTO metadata (
+			file_id, filename, extension, tenant, owner, size, version,
+			created_at, updated_at, expires_at, compression, key_id, wrapped_key, key_fingerprint,
+			user_metadata, folder_id
+		)
+		VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`),
+		target.FileId,
+		target.Filename,
+		target.Extension,
+		target.Tenant,
+		target.Owner,
+		size,
+		now,
+		now,
+		target.ExpiresAt,
+		target.Compression,
+		target.KeyId,
+		target.WrappedKey,
+		target.KeyFingerprint,
+		userMetadataJson(target.UserMetadata),
+		target.FolderId,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return FileServerResult{}, errors.New("failed to insert metadata")
+	}
+	err = b.replaceTags(tx, target.FileId, target.Tags)
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		INSERT INTO versions (file_id, version, size, created_at)
+		VALUES (?, 1, ?, ?)
+	`),
+		target.FileId,
+		size,
+		now,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return FileServerResult{}, errors.New("failed to insert version")
+	}
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		INSERT INTO files (file_id, version, chunk, data, hash)
+		SELECT ?, 1, chunk, data, hash
+		FROM files
+		WHERE file_id = ? AND version = ?
+	`),
+		target.FileId,
+		fileId,
+		version,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return FileServerResult{}, errors.New("failed to copy file chunks")
+	}
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		UPDATE chunks
+		SET ref_count = ref_count + (
+			SELECT COUNT(*) FROM files
+			WHERE files.hash = chunks.hash AND files.file_id = ?
+		)
+		WHERE hash IN (SELECT hash FROM files WHERE file_id = ?)
+	`),
+		target.FileId,
+		target.FileId,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return FileServerResult{}, errors.New("failed to update chunk references")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return FileServerResult{}, err
+	}
+	return FileServerResult{FileId: target.FileId}, nil
+}
+
+func (b *SQLBackend) DeleteFile(fileId string, revision *int64) (bool, error) {
+	return b.deleteFile(b.db, fileId, revision)
+}
+
+// deleteFile moves a file to trash, compare and swap when the expected revision is given
+func (b *SQLBackend) deleteFile(exec sqlExecutor, fileId string, revision *int64) (bool, error) {
+	query := `
+		UPDATE metadata
+		SET deleted_at = ?, revision = revision + 1
+		WHERE file_id = ? AND deleted_at = 0
+	`
+	args := []any{time.Now().Unix(), fileId}
+	if revision != nil {
+		query += " AND revision = ?"
+		args = append(args, *revision)
+	}
+	result, err := exec.Exec(b.query.GetCachedQuery(query), args...)
+	if err != nil {
+		return false, err
+	}
+	err = b.checkRevision(exec, result, fileId, revision)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApplyBatch runs all operations in a single transaction, every operation has its own
+// savepoint so a failed one is rolled back without the rest
+func (b *SQLBackend) ApplyBatch(operations []BatchOperation) []error {
+	errs := make([]error, len(operations))
+	fail := func(err error) []error {
+		log.Println(err.Error())
+		for i := range errs {
+			errs[i] = &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: "failed to apply batch",
+			}
+		}
+		return errs
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	for i, operation := range operations {
+		_, err = tx.Exec("SAVEPOINT batch_operation")
+		if err != nil {
+			return fail(err)
+		}
+		switch operation.Kind {
+		case BatchDelete:
+			_, errs[i] = b.deleteFile(tx, operation.FileId, nil)
+		case BatchUpdate:
+			errs[i] = b.updateMetadata(tx, operation.FileId, operation.Update)
+		}
+		if errs[i] != nil {
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT batch_operation")
+			if err != nil {
+				return fail(err)
+			}
+		}
+		_, err = tx.Exec("RELEASE SAVEPOINT batch_operation")
+		if err != nil {
+			return fail(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fail(err)
+	}
+	return errs
+}
+
+func (b *SQLBackend) UndeleteFile(fileId string) (bool, error) {
+	result, err := b.db.Exec(b.query.GetCachedQuery(`
+		UPDATE metadata
+		SET deleted_at = 0, revision = revision + 1
+		WHERE file_id = ? AND deleted_at != 0
+	`),
+		fileId,
+	)
+	if err != nil {
+		return false, err
+	}
+	return checkAffected(result, "deleted file not found")
+}
+
+func (b *SQLBackend) SetFileKey(fileId string, keyId string, wrappedKey string) (bool, error) {
+	result, err := b.db.Exec(b.query.GetCachedQuery(`
+		UPDATE metadata
+		SET key_id = ?, wrapped_key = ?
 		WHERE file_id = ?
 	`),
+		keyId,
+		wrappedKey,
 		fileId,
 	)
 	if err != nil {
 		return false, err
 	}
+	return checkAffected(result, "file not found")
+}
 
+func checkAffected(result sql.Result, notFoundDetail string) (bool, error) {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, &FileServerError{
+			Code:   http.StatusNotFound,
+			Detail: notFoundDetail,
+		}
+	}
 	return true, nil
 }
+
+// queryFiles runs a query selecting metadataSelect and scans all rows
+func (b *SQLBackend) queryFiles(query string, args ...any) ([]models.FileMetadata, error) {
+	rows, err := b.db.Query(b.query.GetCachedQuery(query), args...)
+	if err != nil {
+		return nil, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: fmt.Sprintf("failed to query files: %s", err.Error()),
+		}
+	}
+	defer rows.Close()
+
+	var files []models.FileMetadata
+	for rows.Next() {
+		var metadata models.FileMetadata
+		err := scanMetadata(rows, &metadata)
+		if err != nil {
+			return nil, handleScanErrors([]error{err})
+		}
+		files = append(files, metadata)
+	}
+	return files, nil
+}
+
+func (b *SQLBackend) GetDeletedFiles(deletedBefore int64) ([]models.FileMetadata, error) {
+	return b.queryFiles(`
+		SELECT `+b.metadataSelect()+`
+		FROM metadata
+		WHERE deleted_at != 0 AND deleted_at < ?
+	`,
+		deletedBefore,
+	)
+}
+
+func (b *SQLBackend) GetStoredFiles() ([]models.FileMetadata, error) {
+	return b.queryFiles(`
+		SELECT ` + b.metadataSelect() + `
+		FROM metadata
+	`)
+}
+
+// GetExpiredFiles also returns new files whose upload was abandoned, so they are purged the same way
+func (b *SQLBackend) GetExpiredFiles(expiredBefore int64) ([]models.FileMetadata, error) {
+	return b.queryFiles(`
+		SELECT `+b.metadataSelect()+`
+		FROM metadata
+		WHERE (expires_at != 0 AND expires_at <= ?) OR (pending = TRUE AND updated_at < ?)
+	`,
+		expiredBefore,
+		abandonedBefore(expiredBefore),
+	)
+}
+
+// DiscardAbandonedVersions removes abandoned versions of published files with their chunks
+// in a single transaction, a chunk written meanwhile keeps its version
+func (b *SQLBackend) DiscardAbandonedVersions(now int64) ([]AbandonedVersion, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(b.query.GetCachedQuery(`
+		SELECT versions.file_id, versions.version, versions.size, metadata.tenant, metadata.owner
+		FROM versions
+		JOIN metadata ON metadata.file_id = versions.file_id
+		WHERE versions.pending = TRUE AND versions.updated_at < ? AND metadata.pending = FALSE
+	`),
+		abandonedBefore(now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var abandoned []AbandonedVersion
+	for rows.Next() {
+		var version AbandonedVersion
+		err = rows.Scan(&version.FileId, &version.Version, &version.Size, &version.Tenant, &version.Owner)
+		if err != nil {
+			rows.Close()
+			return nil, handleScanErrors([]error{err})
+		}
+		abandoned = append(abandoned, version)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	var discarded []AbandonedVersion
+	for _, version := range abandoned {
+		// the version is matched again, so one written to meanwhile is kept
+		result, err := tx.Exec(b.query.GetCachedQuery(`
+			DELETE FROM versions
+			WHERE file_id = ? AND version = ? AND pending = TRUE AND updated_at < ?
+		`),
+			version.FileId,
+			version.Version,
+			abandonedBefore(now),
+		)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if affected == 0 {
+			continue
+		}
+		_, err = tx.Exec(b.query.GetCachedQuery(`
+			UPDATE chunks
+			SET ref_count = ref_count - (
+				SELECT COUNT(*) FROM files
+				WHERE files.hash = chunks.hash AND files.file_id = ? AND files.version = ?
+			)
+			WHERE hash IN (SELECT hash FROM files WHERE file_id = ? AND version = ?)
+		`),
+			version.FileId,
+			version.Version,
+			version.FileId,
+			version.Version,
+		)
+		if err == nil {
+			_, err = tx.Exec(b.query.GetCachedQuery(`
+				DELETE FROM files
+				WHERE file_id = ? AND version = ?
+			`),
+				version.FileId,
+				version.Version,
+			)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return nil, errors.New("failed to discard version")
+		}
+		discarded = append(discarded, version)
+	}
+	_, err = tx.Exec(b.query.GetCachedQuery(`
+		DELETE FROM chunks
+		WHERE ref_count <= 0
+	`))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return discarded, nil
+}
+
+// PurgeFile removes a file with its versions and chunks in a single transaction,
+// shared chunks are removed once no file references them
+func (b *SQLBackend) PurgeFile(fileId string) (bool, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		{
+			`UPDATE chunks
+			SET ref_count = ref_count - (
+				SELECT COUNT(*) FROM files
+				WHERE files.hash = chunks.hash AND files.file_id = ?
+			)
+			WHERE hash IN (SELECT hash FROM files WHERE file_id = ?)`,
+			[]any{fileId, fileId},
+		},
+		{`DELETE FROM files WHERE file_id = ?`, []any{fileId}},
+		{`DELETE FROM chunks WHERE ref_count <= 0`, nil},
+		{`DELETE FROM versions WHERE file_id = ?`, []any{fileId}},
+		{`DELETE FROM tags WHERE file_id = ?`, []any{fileId}},
+		{`DELETE FROM search WHERE file_id = ?`, []any{fileId}},
+		{`DELETE FROM metadata WHERE file_id = ?`, []any{fileId}},
+	}
+	for _, query := range queries {
+		_, err = tx.Exec(b.query.GetCachedQuery(query.query), query.args...)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *SQLBackend) IndexFile(document SearchDocument) error {
+	if b.query.Type == utils.PostgreSQL {
+		_, err := b.db.Exec(b.query.GetCachedQuery(`
+			INSERT INTO search (file_id, document)
+			VALUES (
+				?,
+				setweight(to_tsvector('simple', ?), 'A') ||
+				setweight(to_tsvector('simple', ?), 'B') ||
+				setweight(to_tsvector('simple', ?), 'C')
+			)
+			ON CONFLICT (file_id) DO UPDATE SET document = EXCLUDED.document
+		`),
+			document.FileId,
+			document.Filename,
+			document.Metadata,
+			document.Content,
+		)
+		return err
+	}
+
+	// full text tables have no unique constraints
+	_, err := b.db.Exec(b.query.GetCachedQuery(`
+		DELETE FROM search
+		WHERE file_id = ?
+	`),
+		document.FileId,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec(b.query.GetCachedQuery(`
+		INSERT INTO search (file_id, filename, metadata, content)
+		VALUES (?, ?, ?, ?)
+	`),
+		document.FileId,
+		document.Filename,
+		document.Metadata,
+		document.Content,
+	)
+	return err
+}
+
+// searchScoreQuery selects ids and scores of files matching every term, higher score is more relevant
+func (b *SQLBackend) searchScoreQuery(terms []string) (string, []any) {
+	switch {
+	case b.query.Type == utils.PostgreSQL:
+		tsQuery := strings.Join(terms, " & ")
+		return `
+			SELECT file_id AS search_id, ts_rank(document, to_tsquery('simple', ?)) AS score
+			FROM search
+			WHERE document @@ to_tsquery('simple', ?)
+		`, []any{tsQuery, tsQuery}
+	case b.fts5:
+		return fmt.Sprintf(`
+			SELECT file_id AS search_id, -bm25(search, 0, %d, %d, %d) AS score
+			FROM search
+			WHERE search MATCH ?
+		`, filenameWeight, metadataWeight, contentWeight), []any{quotedTerms(terms)}
+	default:
+		// FTS4 has no ranking function, files are ranked by the number of matches
+		return `
+			SELECT file_id AS search_id,
+				(LENGTH(offsets(search)) - LENGTH(REPLACE(offsets(search), ' ', '')) + 1) / 4.0 AS score
+			FROM search
+			WHERE search MATCH ?
+		`, []any{quotedTerms(terms)}
+	}
+}
+
+// scoreScanner scans metadata columns followed by a score
+type scoreScanner struct {
+	rows  *sql.Rows
+	score *float64
+}
+
+func (s scoreScanner) Scan(dest ...any) error {
+	return s.rows.Scan(append(dest, s.score)...)
+}
+
+func (b *SQLBackend) SearchFiles(query SearchQuery) (PaginatedItems[models.SearchResult], error) {
+	result := PaginatedItems[models.SearchResult]{
+		Items:    []models.SearchResult{},
+		Page:     int64(query.Page),
+		PageSize: int64(query.PageSize),
+	}
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return result, nil
+	}
+
+	scoreQuery, args := b.searchScoreQuery(terms)
+	conditions, visibleArgs := filesConditions(FileFilter{}, time.Now().Unix())
+	args = append(args, visibleArgs...)
+	// one more row tells if there is a next page
+	limit := 0
+	if query.PageSize > 0 {
+		limit = query.PageSize + 1
+	}
+	selectQuery := paginateQuery(b.query.GetCachedQuery(`
+		SELECT `+b.metadataSelect()+`, matched.score
+		FROM metadata
+		JOIN (`+scoreQuery+`) matched ON matched.search_id = metadata.file_id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY matched.score DESC, file_id ASC
+	`), limit, (query.Page-1)*query.PageSize)
+	rows, err := b.db.Query(selectQuery, args...)
+	if err != nil {
+		return result, &FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: fmt.Sprintf("failed to search files: %s", err.Error()),
+		}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var found models.SearchResult
+		err := scanMetadata(scoreScanner{rows: rows, score: &found.Score}, &found.FileMetadata)
+		if err != nil {
+			return result, &FileServerError{
+				Code:   http.StatusInternalServerError,
+				Detail: fmt.Sprintf("failed to scan file metadata: %s", err.Error()),
+			}
+		}
+		result.Items = append(result.Items, found)
+	}
+	if query.PageSize > 0 && len(result.Items) > query.PageSize {
+		result.Items = result.Items[:query.PageSize]
+		result.IsNextPage = true
+	}
+	return result, nil
+}
+
+// folderNameTaken tells if parent already has a folder with the name, other than the folder itself
+func (b *SQLBackend) folderNameTaken(folder models.Folder) (bool, error) {
+	var count int
+	err := b.db.QueryRow(b.query.GetCachedQuery(`
+		SELECT COUNT(*) FROM folders
+		WHERE parent_id = ? AND name = ? AND folder_id != ?
+	`),
+		folder.ParentId,
+		folder.Name,
+		folder.FolderId,
+	).Scan(&count)
+	return count > 0, err
+}
+
+func (b *SQLBackend) CreateFolder(folder models.Folder) error {
+	taken, err := b.folderNameTaken(folder)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return folderExistsError(folder.Name)
+	}
+	_, err = b.db.Exec(b.query.GetCachedQuery(`
+		INSERT INTO folders (folder_id, name, parent_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`),
+		folder.FolderId,
+		folder.Name,
+		folder.ParentId,
+		folder.CreatedAt,
+		folder.UpdatedAt,
+	)
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("failed to insert folder")
+	}
+	return nil
+}
+
+func (b *SQLBackend) GetFolder(folderId string) (models.Folder, error) {
+	var folder models.Folder
+	err := b.db.QueryRow(b.query.GetCachedQuery(`
+		SELECT folder_id, name, parent_id, created_at, updated_at
+		FROM folders
+		WHERE folder_id = ?
+	`),
+		folderId,
+	).Scan(&folder.FolderId, &folder.Name, &folder.ParentId, &folder.CreatedAt, &folder.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return folder, folderNotFoundError(folderId)
+	}
+	return folder, err
+}
+
+func (b *SQLBackend) GetFolders(parentId string) ([]models.Folder, error) {
+	rows, err := b.db.Query(b.query.GetCachedQuery(`
+		SELECT folder_id, name, parent_id, created_at, updated_at
+		FROM folders
+		WHERE parent_id = ?
+		ORDER BY name
+	`),
+		parentId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []models.Folder{}
+	for rows.Next() {
+		var folder models.Folder
+		err = rows.Scan(&folder.FolderId, &folder.Name, &folder.ParentId, &folder.CreatedAt, &folder.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+func (b *SQLBackend) UpdateFolder(folder models.Folder) error {
+	taken, err := b.folderNameTaken(folder)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return folderExistsError(folder.Name)
+	}
+	result, err := b.db.Exec(b.query.GetCachedQuery(`
+		UPDATE folders
+		SET name = ?, parent_id = ?, updated_at = ?
+		WHERE folder_id = ?
+	`),
+		folder.Name,
+		folder.ParentId,
+		folder.UpdatedAt,
+		folder.FolderId,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = checkAffected(result, "folder not found")
+	return err
+}
+
+func (b *SQLBackend) DeleteFolder(folderId string) (bool, error) {
+	result, err := b.db.Exec(b.query.GetCachedQuery(`
+		DELETE FROM folders
+		WHERE folder_id = ?
+	`),
+		folderId,
+	)
+	if err != nil {
+		return false, err
+	}
+	return checkAffected(result, "folder not found")
+}
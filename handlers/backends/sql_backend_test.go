@@ -0,0 +1,150 @@
+package backends
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSQLite(t *testing.T) *SQLBackend {
+	backend, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestRestoreFileVersionIsAtomic(t *testing.T) {
+	b := openTestSQLite(t)
+	_, err := b.UploadFile(testChunk("file-1", 1, 1, []byte("first")), "file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.UpdateFile(testChunk("file-1", 1, 2, []byte("second ")), "file-1", FileMetadataUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed restore of a pending version leaves revision of the file as it was
+	_, err = b.RestoreFileVersion("file-1", 2)
+	checkErrorCode(t, err, http.StatusNotFound, "restore of a pending version")
+	metadata, err := b.GetFileMetadata("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Revision != 2 {
+		t.Errorf("file has revision %d after the failed restore, expected 2", metadata.Revision)
+	}
+
+	_, err = b.RestoreFileVersion("file-1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.GetFile("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.File) != "first" || result.Metadata.Version != 3 || result.Metadata.Revision != 3 {
+		t.Errorf("restored file has %q in version %d with revision %d", result.File, result.Metadata.Version, result.Metadata.Revision)
+	}
+	// the upload of the pending version can not finish over the restored one
+	_, err = b.UpdateFile(testChunk("file-1", 2, 2, []byte("version")), "file-1", FileMetadataUpdate{})
+	checkErrorCode(t, err, http.StatusConflict, "chunk of a finished version")
+}
+
+func TestDeleteComparesRevisionInSQL(t *testing.T) {
+	b := openTestSQLite(t)
+	_, err := b.UploadFile(testChunk("file-1", 1, 1, []byte("content")), "file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := int64(5)
+	_, err = b.DeleteFile("file-1", &stale)
+	checkErrorCode(t, err, http.StatusConflict, "delete of a changed file")
+	current := int64(1)
+	_, err = b.DeleteFile("file-1", &current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DeleteFile("file-1", &current)
+	checkErrorCode(t, err, http.StatusNotFound, "delete of a file in trash")
+}
+
+func TestAbandonedVersionsAreDiscardedInSQL(t *testing.T) {
+	b := openTestSQLite(t)
+	b.Dedup = true
+	_, err := b.UploadFile(testChunk("file-1", 1, 1, []byte("first")), "file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.UpdateFile(testChunk("file-1", 1, 2, []byte("abandoned ")), "file-1", FileMetadataUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new file is left to GetExpiredFiles
+	_, err = b.UploadFile(testChunk("file-2", 1, 2, []byte("new file")), "file-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(stagedUploadTimeout + time.Minute).Unix()
+	discarded, err := b.DiscardAbandonedVersions(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discarded) != 1 || discarded[0].FileId != "file-1" || discarded[0].Size != 10 || discarded[0].Purged {
+		t.Fatalf("discarded %+v, expected version 2 of file-1", discarded)
+	}
+	versions, err := b.GetFileVersions("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("file has %d versions, expected 1", len(versions))
+	}
+	var chunks int64
+	err = b.db.QueryRow(`SELECT COUNT(*) FROM chunks WHERE hash = ?`, chunkHash([]byte("abandoned "))).Scan(&chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 0 {
+		t.Error("chunk of the discarded version is left")
+	}
+	_, err = b.UpdateFile(testChunk("file-1", 2, 2, []byte("late")), "file-1", FileMetadataUpdate{})
+	checkErrorCode(t, err, http.StatusConflict, "chunk of a discarded version")
+}
+
+func TestPurgeFileKeepsSharedChunks(t *testing.T) {
+	b := openTestSQLite(t)
+	b.Dedup = true
+	for _, fileId := range []string{"file-1", "file-2"} {
+		_, err := b.UploadFile(testChunk(fileId, 1, 1, []byte("shared")), fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := b.PurgeFile("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetFileVersions("file-1")
+	checkErrorCode(t, err, http.StatusNotFound, "versions of a purged file")
+	result, err := b.GetFile("file-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.File) != "shared" {
+		t.Errorf("file sharing the chunk has %q", result.File)
+	}
+	var refs int64
+	err = b.db.QueryRow(`SELECT ref_count FROM chunks WHERE hash = ?`, chunkHash([]byte("shared"))).Scan(&refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs != 1 {
+		t.Errorf("shared chunk has %d references, expected 1", refs)
+	}
+}
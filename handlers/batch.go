@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/utils"
+	"io"
+	"net/http"
+)
+
+const maxBatchOperations = 1000
+
+const (
+	BatchOpDelete      = "delete"
+	BatchOpRename      = "rename"
+	BatchOpSetMetadata = "setMetadata"
+	BatchOpCopy        = "copy"
+)
+
+// BatchItem is an operation of a batch request, update fields are the same as in PUT /files/{id}.
+// Copy takes the new filename and folder from them
+type BatchItem struct {
+	Op     string `json:"op"`
+	FileId string `json:"fileId"`
+	backends.FileMetadataUpdate
+}
+
+type BatchRequest struct {
+	Operations []BatchItem `json:"operations"`
+}
+
+type BatchItemResult struct {
+	FileId string `json:"fileId"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// id of the file created by copy
+	NewFileId string `json:"newFileId,omitempty"`
+}
+
+type BatchResult struct {
+	Results []BatchItemResult `json:"results"`
+}
+
+func batchItemError(fileId string, err error) BatchItemResult {
+	backendErr, ok := err.(*backends.FileServerError)
+	if ok {
+		return BatchItemResult{FileId: fileId, Status: backendErr.Code, Detail: backendErr.Detail}
+	}
+	requestErr, ok := err.(*utils.RequestError)
+	if ok {
+		return BatchItemResult{FileId: fileId, Status: http.StatusBadRequest, Detail: requestErr.Detail}
+	}
+	return BatchItemResult{FileId: fileId, Status: http.StatusInternalServerError, Detail: err.Error()}
+}
+
+func readBatchRequest(request *http.Request) (BatchRequest, error) {
+	var batch BatchRequest
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return batch, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "Unable to read request body"}
+	}
+	defer request.Body.Close()
+	err = json.Unmarshal(body, &batch)
+	if err != nil {
+		return batch, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "invalid batch json"}
+	}
+	if len(batch.Operations) == 0 || len(batch.Operations) > maxBatchOperations {
+		return batch, &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: fmt.Sprintf("expected 1 to %d operations", maxBatchOperations),
+		}
+	}
+	return batch, nil
+}
+
+// prepareBatchItem checks an operation against the current file and returns
+// the backend operation for metadata changes
+func (app *App) prepareBatchItem(item *BatchItem) (backends.BatchOperation, error) {
+	operation := backends.BatchOperation{FileId: item.FileId}
+	metadata, err := app.Backend.GetFileMetadata(item.FileId)
+	if err != nil {
+		return operation, err
+	}
+	// changes of metadata must name the revision they were made against
+	if (item.Op == BatchOpRename || item.Op == BatchOpSetMetadata) && item.Revision == nil {
+		return operation, &backends.FileServerError{Code: http.StatusPreconditionRequired, Detail: "revision is required"}
+	}
+	switch item.Op {
+	case BatchOpDelete:
+		operation.Kind = backends.BatchDelete
+		return operation, app.Retention.Check(metadata)
+	case BatchOpRename:
+		if item.Filename == "" {
+			return operation, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "filename is required for rename"}
+		}
+		operation.Kind = backends.BatchUpdate
+		operation.Update = backends.FileMetadataUpdate{Filename: item.Filename, Revision: item.Revision}
+		return operation, nil
+	case BatchOpSetMetadata, BatchOpCopy:
+		err = app.prepareUpdate(&item.FileMetadataUpdate)
+		if err != nil {
+			return operation, err
+		}
+		// new expiry could remove a retained file
+		if item.Op == BatchOpSetMetadata && item.ExpiresAt != nil {
+			err = app.Retention.Check(metadata)
+		}
+		operation.Kind = backends.BatchUpdate
+		operation.Update = item.FileMetadataUpdate
+		return operation, err
+	}
+	return operation, &backends.FileServerError{
+		Code:   http.StatusBadRequest,
+		Detail: fmt.Sprintf("unknown operation %q, expected delete, rename, setMetadata or copy", item.Op),
+	}
+}
+
+// BatchHandler applies a list of operations in order and reports the result of each one.
+// Consecutive metadata changes go to the backend together, in a single transaction for SQL
+// and a single bulk write for MongoDB
+func (app *App) BatchHandler(writer http.ResponseWriter, request *http.Request) {
+	batch, err := readBatchRequest(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	customerKey, err := readCustomerKey(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+
+	results := make([]BatchItemResult, len(batch.Operations))
+	var pending []backends.BatchOperation
+	// index of the item of every pending operation
+	var pendingItems []int
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		for k, err := range app.Backend.ApplyBatch(pending) {
+			if err != nil {
+				results[pendingItems[k]] = batchItemError(pending[k].FileId, err)
+			} else if pending[k].Kind == backends.BatchUpdate {
+				app.indexFile(pending[k].FileId)
+			}
+		}
+		pending, pendingItems = nil, nil
+	}
+
+	for i := range batch.Operations {
+		item := &batch.Operations[i]
+		results[i] = BatchItemResult{FileId: item.FileId, Status: http.StatusOK}
+		operation, err := app.prepareBatchItem(item)
+		if err != nil {
+			results[i] = batchItemError(item.FileId, err)
+			continue
+		}
+		if item.Op != BatchOpCopy {
+			pending = append(pending, operation)
+			pendingItems = append(pendingItems, i)
+			continue
+		}
+		// copy reads the file, so changes before it are applied first
+		flush()
+		source, err := app.Backend.GetFileMetadata(item.FileId)
+		if err == nil {
+			results[i].NewFileId, err = app.copyFile(request, app, source, item.Filename, item.FolderId, customerKey)
+		}
+		if err != nil {
+			results[i] = batchItemError(item.FileId, err)
+			continue
+		}
+		results[i].Status = http.StatusCreated
+	}
+	flush()
+	utils.WriteJsonResponse(BatchResult{Results: results}, writer)
+}
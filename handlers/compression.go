@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	// form value that disables compression of a single file
+	compressionNone = "none"
+)
+
+type CompressionConfig struct {
+	// codec applied to files with compressible content, empty disables compression
+	Codec string
+	// serve stored data as is to clients that accept the codec
+	Passthrough bool
+}
+
+// encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func isValidCodec(codec string) bool {
+	return codec == CompressionGzip || codec == CompressionZstd
+}
+
+// isCompressible tells if content type is text like, binary formats are usually compressed already
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson", "application/yaml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+func detectContentType(chunk utils.ChunkResult) string {
+	metadata := utils.ReadJsonData[models.FileMetadata](chunk.JsonData)
+	contentType := mime.TypeByExtension(metadata.Extension)
+	if contentType != "" {
+		return contentType
+	}
+	head := make([]byte, 512)
+	n, _ := chunk.FormDataChunk.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
+
+// chooseCodec picks codec for a new file, "compression" form value overrides the configured default
+func (app *App) chooseCodec(request *http.Request, chunk utils.ChunkResult) (string, error) {
+	codec := request.FormValue("compression")
+	switch {
+	case codec == compressionNone:
+		return "", nil
+	case codec != "":
+		if !isValidCodec(codec) {
+			return "", &backends.FileServerError{
+				Code:   http.StatusBadRequest,
+				Detail: fmt.Sprintf("unknown compression %q, expected gzip, zstd or none", codec),
+			}
+		}
+		return codec, nil
+	case app.Config.Compression.Codec != "" && isCompressible(detectContentType(chunk)):
+		return app.Config.Compression.Codec, nil
+	}
+	return "", nil
+}
+
+func compress(data []byte, codec string) ([]byte, error) {
+	switch codec {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressionGzip:
+		var buffer bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buffer)
+		_, err := gzipWriter.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = gzipWriter.Close()
+		return buffer.Bytes(), err
+	}
+	return data, nil
+}
+
+// decompress decodes stored file, every chunk is a separate frame
+// and both codecs read concatenated frames as a single stream
+func decompress(data []byte, codec string) ([]byte, error) {
+	switch codec {
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		return io.ReadAll(gzipReader)
+	}
+	return data, nil
+}
+
+// compressChunk replaces chunk data with its compressed form, size of the chunk stays
+// uncompressed so quotas and metadata show the size of the original file
+func compressChunk(chunk *utils.ChunkResult, codec string) error {
+	if chunk.FormDataChunk == nil || codec == "" {
+		return nil
+	}
+	compressed, err := compress(utils.ReadChunkBytes(*chunk), codec)
+	if err != nil {
+		return fmt.Errorf("failed to compress chunk: %w", err)
+	}
+	chunk.FormDataChunk = utils.NewMemoryChunk(compressed)
+	return nil
+}
+
+func acceptsEncoding(request *http.Request, codec string) bool {
+	for _, encoding := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(name) != codec {
+			continue
+		}
+		quality := strings.ReplaceAll(params, " ", "")
+		return quality != "q=0" && quality != "q=0.0" && quality != "q=0.00" && quality != "q=0.000"
+	}
+	return false
+}
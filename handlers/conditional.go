@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// contentETag is a strong validator of file content, content of a version never changes.
+// Stored data sent as is with Content-Encoding is another representation with its own tag
+func contentETag(metadata models.FileMetadata, encoding string) string {
+	tag := fmt.Sprintf("%s.%d", metadata.FileId, metadata.Version)
+	if encoding != "" {
+		tag += "." + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// metadataETag changes with any change of file metadata
+func metadataETag(metadata models.FileMetadata) string {
+	hash := sha256.Sum256(utils.GetJsonData(metadata))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func lastModified(metadata models.FileMetadata) time.Time {
+	return time.Unix(metadata.UpdatedAt, 0)
+}
+
+// etagMatches tells if a list of entity tags from a header contains any of the tags.
+// Weak comparison ignores W/ prefixes, strong comparison never matches weak tags
+func etagMatches(header string, weak bool, etags ...string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		for _, etag := range etags {
+			if candidate == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeNotModified answers 304 when the client already has the current representation.
+// If-Modified-Since is used only without If-None-Match
+func writeNotModified(writer http.ResponseWriter, request *http.Request, etag string, modified time.Time) bool {
+	ifNoneMatch := request.Header.Get("If-None-Match")
+	switch {
+	case ifNoneMatch != "":
+		if !etagMatches(ifNoneMatch, true, etag) {
+			return false
+		}
+	case request.Header.Get("If-Modified-Since") != "":
+		since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+		if err != nil || modified.After(since) {
+			return false
+		}
+	default:
+		return false
+	}
+	writer.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// changeKind is the part of a file a request changes
+type changeKind int
+
+const (
+	changeContent changeKind = iota
+	changeMetadata
+	// delete removes content and metadata together
+	changeFile
+)
+
+// changedETags returns tags of the part of a file a request changes, a content tag does
+// not tell if metadata changed and a metadata change keeps the content tag
+func changedETags(metadata models.FileMetadata, kind changeKind) []string {
+	contentTags := []string{contentETag(metadata, ""), contentETag(metadata, metadata.Compression)}
+	switch kind {
+	case changeContent:
+		return contentTags
+	case changeMetadata:
+		return []string{metadataETag(metadata)}
+	}
+	return append(contentTags, metadataETag(metadata))
+}
+
+// checkPreconditions rejects a change of a file modified since the client read it.
+// If-Match is compared with tags of the changed part, If-Unmodified-Since is used only without If-Match
+func checkPreconditions(request *http.Request, metadata models.FileMetadata, kind changeKind) error {
+	ifMatch := request.Header.Get("If-Match")
+	ifUnmodifiedSince := request.Header.Get("If-Unmodified-Since")
+	matches := true
+	switch {
+	case ifMatch != "":
+		matches = etagMatches(ifMatch, false, changedETags(metadata, kind)...)
+	case ifUnmodifiedSince != "":
+		since, err := http.ParseTime(ifUnmodifiedSince)
+		matches = err != nil || !lastModified(metadata).After(since)
+	}
+	if !matches {
+		return &backends.FileServerError{
+			Code:   http.StatusPreconditionFailed,
+			Detail: "file was modified",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func setCustomerKey(request *http.Request, key []byte) {
+	hash := sha256.Sum256(key)
+	request.Header.Set(CustomerKeyHeader, base64.StdEncoding.EncodeToString(key))
+	request.Header.Set(CustomerKeyHashHeader, base64.StdEncoding.EncodeToString(hash[:]))
+}
+
+func TestConditionalRequestsRequireCustomerKey(t *testing.T) {
+	app := newTestApp(t)
+	key := testDataKey(t)
+	upload := newUploadRequest(t, []byte("secret"), 1, 1, map[string]string{})
+	setCustomerKey(upload, key)
+	fileId := sendUpload(t, app, upload)
+
+	for _, endpoint := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/files/" + fileId, app.GetFileHandler},
+		{"/files/" + fileId + "/metadata", app.GetFileMetadataHandler},
+	} {
+		send := func(etag string, key []byte) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(http.MethodGet, endpoint.path, nil)
+			request.SetPathValue("id", fileId)
+			if etag != "" {
+				request.Header.Set("If-None-Match", etag)
+			}
+			if key != nil {
+				setCustomerKey(request, key)
+			}
+			recorder := httptest.NewRecorder()
+			endpoint.handler(recorder, request)
+			return recorder
+		}
+
+		response := send("", key)
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s returned %d with the key", endpoint.path, response.Code)
+		}
+		etag := response.Header().Get("ETag")
+		if code := send(etag, key).Code; code != http.StatusNotModified {
+			t.Errorf("%s returned %d for a cached copy with the key, expected 304", endpoint.path, code)
+		}
+		if code := send(etag, nil).Code; code != http.StatusForbidden {
+			t.Errorf("%s returned %d for a cached copy without the key, expected 403", endpoint.path, code)
+		}
+		if code := send(etag, testDataKey(t)).Code; code != http.StatusForbidden {
+			t.Errorf("%s returned %d for a cached copy with another key, expected 403", endpoint.path, code)
+		}
+	}
+}
+
+func TestMetadataUpdateMatchesMetadataETag(t *testing.T) {
+	app := newTestApp(t)
+	fileId := uploadChunk(t, app, []byte("content"), 1, 1, map[string]string{})
+
+	etag := func(handler http.HandlerFunc) string {
+		request := httptest.NewRequest(http.MethodGet, "/files/"+fileId, nil)
+		request.SetPathValue("id", fileId)
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder.Header().Get("ETag")
+	}
+	update := func(ifMatch string) int {
+		request := httptest.NewRequest(http.MethodPut, "/files/"+fileId, strings.NewReader(`{"filename": "renamed", "revision": 1}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("If-Match", ifMatch)
+		request.SetPathValue("id", fileId)
+		recorder := httptest.NewRecorder()
+		app.UpdateFileHandler(recorder, request)
+		return recorder.Code
+	}
+
+	if code := update(etag(app.GetFileHandler)); code != http.StatusPreconditionFailed {
+		t.Errorf("metadata update matched by the content tag returned %d, expected 412", code)
+	}
+	if code := update(etag(app.GetFileMetadataHandler)); code != http.StatusOK {
+		t.Errorf("metadata update matched by the metadata tag returned %d, expected 200", code)
+	}
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CopyRequest is the optional json body of copy and move requests
+type CopyRequest struct {
+	// new filename without extension, empty keeps the name
+	Filename string `json:"filename"`
+	// target folder, the same folder by default and the root folder on another backend
+	FolderId *string `json:"folderId"`
+	// name of another configured backend, empty stays on the same backend
+	Backend string `json:"backend"`
+	// revision the move was made against, required by move and ignored by copy
+	Revision *int64 `json:"revision"`
+}
+
+func readCopyRequest(request *http.Request) (CopyRequest, error) {
+	var copyRequest CopyRequest
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return copyRequest, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "Unable to read request body"}
+	}
+	defer request.Body.Close()
+	if len(bytes.TrimSpace(body)) == 0 {
+		return copyRequest, nil
+	}
+	err = json.Unmarshal(body, &copyRequest)
+	if err != nil {
+		return copyRequest, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "invalid copy json"}
+	}
+	return copyRequest, nil
+}
+
+// target returns the app of the backend a file is copied to and checks the target folder there
+func (app *App) target(copyRequest *CopyRequest) (*App, error) {
+	target := app
+	if copyRequest.Backend != "" {
+		peer, ok := app.Peers[copyRequest.Backend]
+		if !ok {
+			return nil, &backends.FileServerError{
+				Code:   http.StatusBadRequest,
+				Detail: fmt.Sprintf("unknown backend %q", copyRequest.Backend),
+			}
+		}
+		target = peer
+		// folders are not shared between backends
+		if copyRequest.FolderId == nil {
+			root := ""
+			copyRequest.FolderId = &root
+		}
+	}
+	if copyRequest.FolderId != nil {
+		folderId := folderIdFromUrl(*copyRequest.FolderId)
+		_, err := target.getFolder(folderId)
+		if err != nil {
+			return nil, err
+		}
+		copyRequest.FolderId = &folderId
+	}
+	return target, nil
+}
+
+// copyFile creates a new file of the caller with content and metadata of the source file.
+// Unencrypted files are copied inside the backend as stored, chunks of encrypted files are
+// bound to the file id, so they are decoded and encoded again with a new data key like
+// files copied to another backend
+func (app *App) copyFile(request *http.Request, target *App, source models.FileMetadata, filename string, folderId *string, customerKey []byte) (string, error) {
+	principal := utils.GetPrincipal(request)
+	now := time.Now().UTC().Unix()
+	metadata := models.FileMetadata{
+		FileId:       uuid.New().String(),
+		Filename:     source.Filename,
+		Extension:    source.Extension,
+		Tenant:       principal.Tenant,
+		Owner:        principal.User,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ExpiresAt:    source.ExpiresAt,
+		UserMetadata: source.UserMetadata,
+		Tags:         source.Tags,
+		FolderId:     source.FolderId,
+	}
+	if filename != "" {
+		metadata.Filename = filename
+	}
+	if folderId != nil {
+		metadata.FolderId = *folderId
+	}
+
+	encrypted := source.KeyId != "" || source.KeyFingerprint != ""
+	if target == app && !encrypted {
+		metadata.Compression = source.Compression
+		err := app.Quotas.Reserve(principal, source.Size, true)
+		if err != nil {
+			return "", err
+		}
+		_, err = app.Backend.CopyFile(source.FileId, metadata)
+		if err != nil {
+			app.Quotas.Release(principal, source.Size, 1)
+			return "", err
+		}
+		app.indexFile(metadata.FileId)
+		return metadata.FileId, nil
+	}
+
+	result, err := app.Backend.GetFile(source.FileId)
+	if err != nil {
+		return "", err
+	}
+	data, err := app.decodeFile(result, customerKey)
+	if err != nil {
+		return "", err
+	}
+	var reserved reservation
+	err = target.storeFile(request, metadata, bytes.NewReader(data), customerKey, &reserved)
+	if err != nil {
+		target.discardFiles(request, []string{metadata.FileId}, reserved)
+		return "", err
+	}
+	return metadata.FileId, nil
+}
+
+// CopyFileHandler copies the current version of a file into a new file,
+// optionally renamed, into another folder or onto another backend
+func (app *App) CopyFileHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	copyRequest, err := readCopyRequest(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	source, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	target, err := app.target(&copyRequest)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	customerKey, err := readCustomerKey(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	newFileId, err := app.copyFile(request, target, source, copyRequest.Filename, copyRequest.FolderId, customerKey)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteResponseStatusCode(backends.FileServerResult{FileId: newFileId}, http.StatusCreated, writer)
+}
+
+// MoveFileHandler renames a file or moves it into another folder, a file moved onto
+// another backend is copied there and the source goes to trash
+func (app *App) MoveFileHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	copyRequest, err := readCopyRequest(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if copyRequest.Revision == nil {
+		handleBackendError(writer, &backends.FileServerError{Code: http.StatusPreconditionRequired, Detail: "revision is required"})
+		return
+	}
+	source, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	err = checkPreconditions(request, source, changeMetadata)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	target, err := app.target(&copyRequest)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+
+	if target == app {
+		update := backends.FileMetadataUpdate{
+			Filename: copyRequest.Filename,
+			FolderId: copyRequest.FolderId,
+			Revision: copyRequest.Revision,
+		}
+		_, err = app.Backend.UpdateFile(utils.ChunkResult{IsLastChunk: true}, fileId, update)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		app.indexFile(fileId)
+		utils.WriteJsonResponse(backends.FileServerResult{FileId: fileId}, writer)
+		return
+	}
+
+	// the copy is made from the revision the client has seen
+	if *copyRequest.Revision != source.Revision {
+		handleBackendError(writer, &backends.FileServerError{
+			Code:   http.StatusConflict,
+			Detail: fmt.Sprintf("file %s was changed after revision %d", fileId, *copyRequest.Revision),
+		})
+		return
+	}
+	// retained files can not leave their backend
+	err = app.Retention.Check(source)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	customerKey, err := readCustomerKey(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	newFileId, err := app.copyFile(request, target, source, copyRequest.Filename, copyRequest.FolderId, customerKey)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	_, err = app.Backend.DeleteFile(fileId, copyRequest.Revision)
+	if err != nil {
+		// the source changed while it was copied, so the copy is removed
+		copied, copyErr := target.Backend.GetFileMetadata(newFileId)
+		if copyErr == nil {
+			target.discardFiles(request, []string{newFileId}, reservation{bytes: copied.Size, files: 1})
+		}
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(backends.FileServerResult{FileId: newFileId}, writer)
+}
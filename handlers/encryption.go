@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const keySize = 32
+
+// headers of customer supplied keys, the key and its sha256 are base64 encoded
+const (
+	CustomerAlgorithmHeader = "X-Encryption-Algorithm"
+	CustomerKeyHeader       = "X-Encryption-Key"
+	CustomerKeyHashHeader   = "X-Encryption-Key-Sha256"
+	customerAlgorithm       = "AES256"
+)
+
+// chunks are encrypted in segments of this size, a large chunk is never sealed as a whole.
+// Downloads still decrypt the whole file, ranges of it are not served
+const encryptionSegmentSize = 64 * 1024
+
+// segment header holds length of nonce with ciphertext, chunk number and segment index
+const segmentHeaderSize = 12
+
+// set in index of the last segment of a chunk, so a chunk cut at a segment boundary is detected
+const finalSegmentFlag = 1 << 31
+
+// keyFile is stored as json, keys are base64 encoded
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// KeyRing holds master keys from a local keyfile, the current one wraps data keys of new files
+// and older ones are kept until no file uses them
+type KeyRing struct {
+	path string
+	lock sync.RWMutex
+	keys keyFile
+	// only one rotation runs at a time
+	rotateLock sync.Mutex
+}
+
+func newKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// LoadKeyRing reads master keys from path, a keyfile with a new key is created if it does not exist
+func LoadKeyRing(path string) (*KeyRing, error) {
+	keyRing := &KeyRing{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := newKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate master key: %w", err)
+		}
+		keyId := uuid.New().String()
+		keyRing.keys = keyFile{Current: keyId, Keys: map[string][]byte{keyId: key}}
+		err = keyRing.save()
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Created master keyfile", path)
+		return keyRing, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	err = json.Unmarshal(data, &keyRing.keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse keyfile: %w", err)
+	}
+	if len(keyRing.keys.Keys[keyRing.keys.Current]) != keySize {
+		return nil, fmt.Errorf("keyfile has no valid current key")
+	}
+	return keyRing, nil
+}
+
+// save replaces keyfile atomically so a crash never leaves it half written
+func (kr *KeyRing) save() error {
+	data, err := json.MarshalIndent(kr.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := kr.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write keyfile: %w", err)
+	}
+	err = os.Rename(tmpPath, filepath.Clean(kr.path))
+	if err != nil {
+		return fmt.Errorf("failed to replace keyfile: %w", err)
+	}
+	return nil
+}
+
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openSealed(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// newDataKey generates a data key for a file and wraps it with the current master key
+func (kr *KeyRing) newDataKey() (string, string, error) {
+	dataKey, err := newKey()
+	if err != nil {
+		return "", "", err
+	}
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	keyId := kr.keys.Current
+	wrapped, err := seal(kr.keys.Keys[keyId], dataKey, []byte(keyId))
+	if err != nil {
+		return "", "", err
+	}
+	return keyId, base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func (kr *KeyRing) unwrap(keyId string, wrappedKey string) ([]byte, error) {
+	kr.lock.RLock()
+	masterKey, ok := kr.keys.Keys[keyId]
+	kr.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("master key %s not found", keyId)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	dataKey, err := openSealed(masterKey, wrapped, []byte(keyId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// rewrap wraps data key of a file with the current master key
+func (kr *KeyRing) rewrap(keyId string, wrappedKey string) (string, string, error) {
+	dataKey, err := kr.unwrap(keyId, wrappedKey)
+	if err != nil {
+		return "", "", err
+	}
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	currentId := kr.keys.Current
+	wrapped, err := seal(kr.keys.Keys[currentId], dataKey, []byte(currentId))
+	if err != nil {
+		return "", "", err
+	}
+	return currentId, base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func (kr *KeyRing) current() string {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.keys.Current
+}
+
+// addKey generates a new master key and makes it current
+func (kr *KeyRing) addKey() (string, error) {
+	key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	keyId := uuid.New().String()
+	kr.keys.Keys[keyId] = key
+	kr.keys.Current = keyId
+	return keyId, kr.save()
+}
+
+// retireKeys removes master keys that are neither current nor used by a stored file,
+// returns the number of kept old keys
+func (kr *KeyRing) retireKeys(used map[string]bool) (int, error) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	kept := 0
+	for keyId := range kr.keys.Keys {
+		switch {
+		case keyId == kr.keys.Current:
+		case used[keyId]:
+			kept++
+		default:
+			delete(kr.keys.Keys, keyId)
+		}
+	}
+	return kept, kr.save()
+}
+
+func segmentAdditionalData(fileId string, header []byte) []byte {
+	return append([]byte(fileId), header[4:]...)
+}
+
+// encryptChunk splits chunk into segments sealed with data key, chunk number and segment index
+// are authenticated so segments can not be reordered or moved to another file
+func encryptChunk(dataKey []byte, fileId string, chunkNumber int, data []byte) ([]byte, error) {
+	var encrypted []byte
+	for index := 0; index == 0 || len(data) > 0; index++ {
+		segment := data[:min(len(data), encryptionSegmentSize)]
+		data = data[len(segment):]
+		flags := uint32(0)
+		if len(data) == 0 {
+			flags = finalSegmentFlag
+		}
+
+		header := make([]byte, segmentHeaderSize)
+		binary.BigEndian.PutUint32(header[4:], uint32(chunkNumber))
+		binary.BigEndian.PutUint32(header[8:], uint32(index)|flags)
+		sealed, err := seal(dataKey, segment, segmentAdditionalData(fileId, header))
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(header, uint32(len(sealed)))
+		encrypted = append(encrypted, header...)
+		encrypted = append(encrypted, sealed...)
+	}
+	return encrypted, nil
+}
+
+// decryptData opens segments of all chunks of a stored version in order
+func decryptData(dataKey []byte, fileId string, data []byte) ([]byte, error) {
+	var decrypted []byte
+	var lastChunk, lastIndex uint32
+	chunkEnded := true
+	for len(data) > 0 {
+		if len(data) < segmentHeaderSize {
+			return nil, errors.New("truncated segment header")
+		}
+		header := data[:segmentHeaderSize]
+		length := binary.BigEndian.Uint32(header)
+		chunkNumber := binary.BigEndian.Uint32(header[4:])
+		index := binary.BigEndian.Uint32(header[8:])
+		final := index&finalSegmentFlag != 0
+		index &^= finalSegmentFlag
+		if uint64(len(data)-segmentHeaderSize) < uint64(length) {
+			return nil, errors.New("truncated segment")
+		}
+		continuesChunk := !chunkEnded && chunkNumber == lastChunk && index == lastIndex+1
+		startsChunk := chunkEnded && chunkNumber == lastChunk+1 && index == 0
+		if !continuesChunk && !startsChunk {
+			return nil, errors.New("segments are out of order")
+		}
+		lastChunk, lastIndex, chunkEnded = chunkNumber, index, final
+
+		segment, err := openSealed(dataKey, data[segmentHeaderSize:segmentHeaderSize+length], segmentAdditionalData(fileId, header))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt segment: %w", err)
+		}
+		decrypted = append(decrypted, segment...)
+		data = data[segmentHeaderSize+length:]
+	}
+	if !chunkEnded {
+		return nil, errors.New("last segment of a chunk is missing")
+	}
+	return decrypted, nil
+}
+
+// customerKeyFingerprint identifies a customer key, it is salted with file id
+// so equal keys of different files can not be matched
+func customerKeyFingerprint(fileId string, customerKey []byte) string {
+	hash := sha256.Sum256(append([]byte(fileId+":"), customerKey...))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// readCustomerKey reads a key supplied by the client with its sha256, nil if there is none
+func readCustomerKey(request *http.Request) ([]byte, error) {
+	encodedKey := request.Header.Get(CustomerKeyHeader)
+	if encodedKey == "" {
+		return nil, nil
+	}
+	algorithm := request.Header.Get(CustomerAlgorithmHeader)
+	if algorithm != "" && algorithm != customerAlgorithm {
+		return nil, &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: fmt.Sprintf("unsupported encryption algorithm %q, expected %s", algorithm, customerAlgorithm),
+		}
+	}
+	customerKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(customerKey) != keySize {
+		return nil, &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: fmt.Sprintf("%s must be a base64 encoded %d byte key", CustomerKeyHeader, keySize),
+		}
+	}
+	keyHash := sha256.Sum256(customerKey)
+	expectedHash := base64.StdEncoding.EncodeToString(keyHash[:])
+	if subtle.ConstantTimeCompare([]byte(request.Header.Get(CustomerKeyHashHeader)), []byte(expectedHash)) != 1 {
+		return nil, &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: fmt.Sprintf("%s does not match the key", CustomerKeyHashHeader),
+		}
+	}
+	return customerKey, nil
+}
+
+// checkCustomerKey verifies that the key supplied with the request is the one the file is encrypted with,
+// files encrypted with a customer key can not be read or even validated by a cached copy without it
+func checkCustomerKey(metadata models.FileMetadata, customerKey []byte) error {
+	if metadata.KeyFingerprint != "" {
+		fingerprint := customerKeyFingerprint(metadata.FileId, customerKey)
+		if customerKey == nil || subtle.ConstantTimeCompare([]byte(fingerprint), []byte(metadata.KeyFingerprint)) != 1 {
+			return &backends.FileServerError{
+				Code:   http.StatusForbidden,
+				Detail: "file is encrypted with a customer key, matching key is required",
+			}
+		}
+		return nil
+	}
+	if customerKey != nil {
+		return &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: "file is not encrypted with a customer key",
+		}
+	}
+	return nil
+}
+
+// dataKey returns key that encrypts content of a file or nil if file is not encrypted,
+// customerKey is the key supplied with the request and is required for files encrypted with one
+func (app *App) dataKey(metadata models.FileMetadata, customerKey []byte) ([]byte, error) {
+	err := checkCustomerKey(metadata, customerKey)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.KeyFingerprint != "" {
+		return customerKey, nil
+	}
+	if metadata.KeyId == "" {
+		return nil, nil
+	}
+	if app.Keys == nil {
+		return nil, &backends.FileServerError{
+			Code:   http.StatusInternalServerError,
+			Detail: "file is encrypted but no master keyfile is configured",
+		}
+	}
+	return app.Keys.unwrap(metadata.KeyId, metadata.WrappedKey)
+}
+
+func (app *App) encryptChunk(chunk *utils.ChunkResult, metadata models.FileMetadata, customerKey []byte) error {
+	if chunk.FormDataChunk == nil {
+		return nil
+	}
+	dataKey, err := app.dataKey(metadata, customerKey)
+	if err != nil || dataKey == nil {
+		return err
+	}
+	encrypted, err := encryptChunk(dataKey, metadata.FileId, chunk.ChunkNumber, utils.ReadChunkBytes(*chunk))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt chunk: %w", err)
+	}
+	chunk.FormDataChunk = utils.NewMemoryChunk(encrypted)
+	return nil
+}
+
+func (app *App) decryptFile(result backends.GetFileResult, customerKey []byte) ([]byte, error) {
+	dataKey, err := app.dataKey(result.Metadata, customerKey)
+	if err != nil || dataKey == nil {
+		return result.File, err
+	}
+	return decryptData(dataKey, result.Metadata.FileId, result.File)
+}
+
+// rewrapKeys wraps data keys of every stored file that uses an old master key with the current one.
+// Files in trash, expired files and unfinished uploads are rewrapped too, they can still be read later
+func (app *App) rewrapKeys() (int64, error) {
+	var rewrapped int64
+	currentId := app.Keys.current()
+	files, err := app.Backend.GetStoredFiles()
+	if err != nil {
+		return 0, err
+	}
+	for _, metadata := range files {
+		if metadata.KeyId == "" || metadata.KeyId == currentId {
+			continue
+		}
+		keyId, wrappedKey, err := app.Keys.rewrap(metadata.KeyId, metadata.WrappedKey)
+		if err == nil {
+			_, err = app.Backend.SetFileKey(metadata.FileId, keyId, wrappedKey)
+		}
+		if err != nil {
+			log.Printf("Failed to rewrap key of %s: %s", metadata.FileId, err.Error())
+			continue
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// usedKeys returns master keys that wrap data keys of stored files
+func (app *App) usedKeys() (map[string]bool, error) {
+	files, err := app.Backend.GetStoredFiles()
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, metadata := range files {
+		if metadata.KeyId != "" {
+			used[metadata.KeyId] = true
+		}
+	}
+	return used, nil
+}
+
+// RotateKeyHandler makes a new master key current and rewraps data keys of all files,
+// file content is not rewritten. Old keys are removed once no file uses them
+func (app *App) RotateKeyHandler(writer http.ResponseWriter, request *http.Request) {
+	if !app.isAdmin(request) {
+		utils.WriteResponseStatusCode(models.Error{Detail: "only admins can rotate keys"}, http.StatusForbidden, writer)
+		return
+	}
+	if app.Keys == nil {
+		utils.WriteResponseStatusCode(models.Error{Detail: "encryption is not enabled"}, http.StatusConflict, writer)
+		return
+	}
+	app.Keys.rotateLock.Lock()
+	defer app.Keys.rotateLock.Unlock()
+
+	keyId, err := app.Keys.addKey()
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	rewrapped, err := app.rewrapKeys()
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	// second pass catches files created with the old key while the first one ran
+	lateRewrapped, err := app.rewrapKeys()
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	rewrapped += lateRewrapped
+	// a master key is removed only when no stored file refers to it
+	used, err := app.usedKeys()
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	kept, err := app.Keys.retireKeys(used)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if kept > 0 {
+		log.Printf("%d old master keys are kept, some files still use them", kept)
+	}
+	log.Printf("Rotated master key to %s, rewrapped %d data keys", keyId, rewrapped)
+	utils.WriteJsonResponse(models.KeyRotation{KeyId: keyId, Rewrapped: rewrapped}, writer)
+}
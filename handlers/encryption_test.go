@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hybrid-storage/handlers/backends"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testDataKey(t *testing.T) []byte {
+	key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+// encryptChunks encrypts data split into chunks the way an upload stores them
+func encryptChunks(t *testing.T, dataKey []byte, fileId string, chunks ...[]byte) [][]byte {
+	var encrypted [][]byte
+	for i, chunk := range chunks {
+		sealed, err := encryptChunk(dataKey, fileId, i+1, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted = append(encrypted, sealed)
+	}
+	return encrypted
+}
+
+// segments splits encrypted data at segment boundaries
+func segments(data []byte) [][]byte {
+	var result [][]byte
+	for len(data) > 0 {
+		length := segmentHeaderSize + int(binary.BigEndian.Uint32(data))
+		result = append(result, data[:length])
+		data = data[length:]
+	}
+	return result
+}
+
+func TestEncryptChunkRoundTrip(t *testing.T) {
+	dataKey := testDataKey(t)
+	first := testData(2*encryptionSegmentSize + 100)
+	second := testData(encryptionSegmentSize)
+	third := []byte{}
+
+	encrypted := bytes.Join(encryptChunks(t, dataKey, "file", first, second, third), nil)
+	decrypted, err := decryptData(dataKey, "file", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bytes.Join([][]byte{first, second, third}, nil)
+	if !bytes.Equal(decrypted, expected) {
+		t.Fatalf("decrypted %d bytes, expected %d", len(decrypted), len(expected))
+	}
+
+	_, err = decryptData(dataKey, "other", encrypted)
+	if err == nil {
+		t.Fatal("segments of another file were decrypted")
+	}
+	_, err = decryptData(testDataKey(t), "file", encrypted)
+	if err == nil {
+		t.Fatal("segments were decrypted with another key")
+	}
+}
+
+func TestDecryptDataRejectsReorderedSegments(t *testing.T) {
+	dataKey := testDataKey(t)
+	chunks := encryptChunks(t, dataKey, "file", testData(2*encryptionSegmentSize), testData(10))
+	parts := segments(bytes.Join(chunks, nil))
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(parts))
+	}
+
+	cases := map[string][][]byte{
+		"swapped segments":   {parts[1], parts[0], parts[2]},
+		"chunks swapped":     {chunks[1], chunks[0]},
+		"segment dropped":    {parts[0], parts[2]},
+		"segment duplicated": {parts[0], parts[0], parts[1], parts[2]},
+	}
+	for name, reordered := range cases {
+		_, err := decryptData(dataKey, "file", bytes.Join(reordered, nil))
+		if err == nil {
+			t.Errorf("%s: decrypted without error", name)
+		}
+	}
+}
+
+func TestDecryptDataRejectsTruncatedSegments(t *testing.T) {
+	dataKey := testDataKey(t)
+	encrypted := encryptChunks(t, dataKey, "file", testData(encryptionSegmentSize+10))[0]
+
+	firstSegment := len(segments(encrypted)[0])
+	for _, length := range []int{segmentHeaderSize - 1, segmentHeaderSize + 5, firstSegment, len(encrypted) - 1} {
+		_, err := decryptData(dataKey, "file", encrypted[:length])
+		if err == nil {
+			t.Errorf("data cut to %d of %d bytes was decrypted", length, len(encrypted))
+		}
+	}
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	_, err := decryptData(dataKey, "file", tampered)
+	if err == nil {
+		t.Error("tampered segment was decrypted")
+	}
+}
+
+func newTestApp(t *testing.T) *App {
+	dir := t.TempDir()
+	backend, err := backends.NewSQLiteBackend(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyRing(filepath.Join(dir, "keyfile.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &App{
+		Backend:   backend,
+		Config:    AppConfig{MaxChunkSize: 1024 * 1024, AdminToken: "admin"},
+		Quotas:    NewQuotaTracker(QuotaConfig{}),
+		Retention: NewRetentionPolicy(RetentionConfig{}),
+		Keys:      keys,
+	}
+}
+
+func newUploadRequest(t *testing.T, data []byte, chunkNumber int, totalChunks int, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields["chunkNumber"] = strconv.Itoa(chunkNumber)
+	fields["totalChunks"] = strconv.Itoa(totalChunks)
+	fields["filename"] = "test.bin"
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, err := form.CreateFormFile("file", "test.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/files", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	return request
+}
+
+// uploadChunk sends one chunk through the upload handler and returns id of the file
+func uploadChunk(t *testing.T, app *App, data []byte, chunkNumber int, totalChunks int, fields map[string]string) string {
+	return sendUpload(t, app, newUploadRequest(t, data, chunkNumber, totalChunks, fields))
+}
+
+func sendUpload(t *testing.T, app *App, request *http.Request) string {
+	recorder := httptest.NewRecorder()
+	app.UploadFileHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var result backends.FileServerResult
+	err := json.Unmarshal(recorder.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.FileId
+}
+
+func TestRotateKeyRewrapsExpiredAndPendingFiles(t *testing.T) {
+	app := newTestApp(t)
+	oldKeyId := app.Keys.current()
+
+	expiredData := testData(100)
+	expiredAt := strconv.FormatInt(time.Now().Unix()-60, 10)
+	expiredId := uploadChunk(t, app, expiredData, 1, 1, map[string]string{"expiresAt": expiredAt})
+	firstChunk := testData(200)
+	pendingId := uploadChunk(t, app, firstChunk, 1, 2, map[string]string{})
+
+	request := httptest.NewRequest(http.MethodPost, "/keys/rotate", nil)
+	request.Header.Set(AdminTokenHeader, "admin")
+	recorder := httptest.NewRecorder()
+	app.RotateKeyHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("rotation failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	newKeyId := app.Keys.current()
+	if newKeyId == oldKeyId {
+		t.Fatal("current key did not change")
+	}
+	files, err := app.Backend.GetStoredFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 stored files, got %d", len(files))
+	}
+	stored := map[string]bool{}
+	for _, metadata := range files {
+		stored[metadata.FileId] = true
+		if metadata.KeyId != newKeyId {
+			t.Errorf("file %s still uses key %s", metadata.FileId, metadata.KeyId)
+		}
+		_, err = app.dataKey(metadata, nil)
+		if err != nil {
+			t.Errorf("data key of %s can not be unwrapped: %v", metadata.FileId, err)
+		}
+	}
+	if !stored[expiredId] || !stored[pendingId] {
+		t.Fatal("expired file or pending upload is missing")
+	}
+	if _, found := app.Keys.keys.Keys[oldKeyId]; found {
+		t.Error("old master key was kept though no file uses it")
+	}
+
+	// the upload started before the rotation is finished with the rewrapped data key
+	secondChunk := testData(50)
+	uploadChunk(t, app, secondChunk, 2, 2, map[string]string{"fileId": pendingId})
+	result, err := app.Backend.GetFile(pendingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := app.decryptFile(result, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(firstChunk, secondChunk...)) {
+		t.Error("content of the finished upload does not match")
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"net/http"
+	"strconv"
+)
+
+// readFilesQuery reads paging, filters and sorting of GET /files from query parameters
+func readFilesQuery(request *http.Request) (backends.FilesQuery, error) {
+	values := request.URL.Query()
+	query := backends.FilesQuery{
+		Page:     max(convertToIntWithDefaultMax(values.Get("page"), 1, 0), 1),
+		PageSize: max(convertToIntWithDefaultMax(values.Get("pageSize"), 0, maxFilesPerPage), 0),
+		Filter: backends.FileFilter{
+			Filename:       values.Get("filename"),
+			FilenamePrefix: values.Get("filenamePrefix"),
+			Extension:      values.Get("extension"),
+			Tag:            values.Get("tag"),
+		},
+		SortBy: values.Get("sort"),
+	}
+
+	if values.Has("folderId") {
+		folderId := folderIdFromUrl(values.Get("folderId"))
+		query.Filter.FolderId = &folderId
+	}
+
+	for name, target := range map[string]*int64{
+		"createdAfter":  &query.Filter.CreatedAfter,
+		"createdBefore": &query.Filter.CreatedBefore,
+		"updatedAfter":  &query.Filter.UpdatedAfter,
+		"updatedBefore": &query.Filter.UpdatedBefore,
+		"minSize":       &query.Filter.MinSize,
+		"maxSize":       &query.Filter.MaxSize,
+	} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		intValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || intValue < 0 {
+			return query, &backends.FileServerError{
+				Code:   http.StatusBadRequest,
+				Detail: fmt.Sprintf("expected non-negative int for %s", name),
+			}
+		}
+		*target = intValue
+	}
+
+	if query.SortBy != "" && !backends.IsValidSortField(query.SortBy) {
+		return query, &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: fmt.Sprintf("unknown sort %q, expected filename, extension, createdAt, updatedAt or size", query.SortBy),
+		}
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: "expected asc or desc for order",
+		}
+	}
+
+	count := values.Get("count")
+	if count != "" {
+		countBool, err := strconv.ParseBool(count)
+		if err != nil {
+			return query, &backends.FileServerError{
+				Code:   http.StatusBadRequest,
+				Detail: "expected bool for count",
+			}
+		}
+		query.SkipCount = !countBool
+	}
+
+	// page is ignored when a cursor is given
+	cursor := values.Get("cursor")
+	if cursor != "" {
+		after, err := backends.ParseCursor(cursor, query)
+		if err != nil {
+			return query, err
+		}
+		query.After = after
+	}
+	return query, nil
+}
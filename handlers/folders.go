@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// rootFolderId addresses the root folder in urls, it is stored as an empty id
+const rootFolderId = "root"
+
+const maxFolderNameLength = 255
+
+// FolderChildren lists subfolders of a folder and a page of its files
+type FolderChildren struct {
+	Folder  models.Folder                                `json:"folder"`
+	Folders []models.Folder                              `json:"folders"`
+	Files   backends.PaginatedItems[models.FileMetadata] `json:"files"`
+}
+
+func validateFolderName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > maxFolderNameLength || strings.Contains(name, "/") {
+		return &backends.FileServerError{
+			Code:   http.StatusBadRequest,
+			Detail: fmt.Sprintf("folder name must be 1 to %d bytes long without slashes", maxFolderNameLength),
+		}
+	}
+	return nil
+}
+
+func folderIdFromUrl(folderId string) string {
+	if folderId == rootFolderId {
+		return ""
+	}
+	return folderId
+}
+
+// getFolder returns a folder by id, the root folder always exists
+func (app *App) getFolder(folderId string) (models.Folder, error) {
+	if folderId == "" {
+		return models.Folder{Name: "/"}, nil
+	}
+	return app.Backend.GetFolder(folderId)
+}
+
+func (app *App) createFolder(name string, parentId string) (models.Folder, error) {
+	err := validateFolderName(name)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	_, err = app.getFolder(parentId)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	now := time.Now().Unix()
+	folder := models.Folder{
+		FolderId:  uuid.New().String(),
+		Name:      name,
+		ParentId:  parentId,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return folder, app.Backend.CreateFolder(folder)
+}
+
+func splitPath(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// resolveFolderPath returns id of the folder at path relative to the parent folder,
+// missing folders are created if asked
+func (app *App) resolveFolderPath(parentId string, segments []string, create bool) (string, error) {
+	folderId := parentId
+	for _, name := range segments {
+		folders, err := app.Backend.GetFolders(folderId)
+		if err != nil {
+			return "", err
+		}
+		found := false
+		for _, folder := range folders {
+			if folder.Name == name {
+				folderId = folder.FolderId
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if !create {
+			return "", &backends.FileServerError{
+				Code:   http.StatusNotFound,
+				Detail: fmt.Sprintf("folder not found: %s", name),
+			}
+		}
+		folder, err := app.createFolder(name, folderId)
+		if err != nil {
+			return "", err
+		}
+		folderId = folder.FolderId
+	}
+	return folderId, nil
+}
+
+// uploadFolder reads folder of a new file from "folderId" or "folderPath" form values,
+// folders of the path are created when missing
+func (app *App) uploadFolder(request *http.Request) (string, error) {
+	folderPath := request.FormValue("folderPath")
+	if folderPath != "" {
+		return app.resolveFolderPath("", splitPath(folderPath), true)
+	}
+	folderId := folderIdFromUrl(request.FormValue("folderId"))
+	_, err := app.getFolder(folderId)
+	return folderId, err
+}
+
+// isInside tells if folder is the ancestor folder or one of its descendants
+func (app *App) isInside(folderId string, ancestorId string) (bool, error) {
+	for folderId != "" {
+		if folderId == ancestorId {
+			return true, nil
+		}
+		folder, err := app.Backend.GetFolder(folderId)
+		if err != nil {
+			return false, err
+		}
+		folderId = folder.ParentId
+	}
+	return false, nil
+}
+
+func (app *App) folderFiles(folderId string, page int, pageSize int) (backends.PaginatedItems[models.FileMetadata], error) {
+	return app.Backend.GetAllFiles(backends.FilesQuery{
+		Page:      page,
+		PageSize:  pageSize,
+		Filter:    backends.FileFilter{FolderId: &folderId},
+		SkipCount: true,
+	})
+}
+
+func readFolderUpdate(request *http.Request) (models.FolderUpdate, error) {
+	var update models.FolderUpdate
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return update, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "Unable to read request body"}
+	}
+	defer request.Body.Close()
+	err = json.Unmarshal(body, &update)
+	if err != nil {
+		return update, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "invalid folder json"}
+	}
+	if update.ParentId != nil {
+		parentId := folderIdFromUrl(*update.ParentId)
+		update.ParentId = &parentId
+	}
+	return update, nil
+}
+
+func (app *App) CreateFolderHandler(writer http.ResponseWriter, request *http.Request) {
+	update, err := readFolderUpdate(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	parentId := ""
+	if update.ParentId != nil {
+		parentId = *update.ParentId
+	}
+	folder, err := app.createFolder(update.Name, parentId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteResponseStatusCode(folder, http.StatusCreated, writer)
+}
+
+func (app *App) GetFolderHandler(writer http.ResponseWriter, request *http.Request) {
+	folder, err := app.getFolder(folderIdFromUrl(request.PathValue("id")))
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(folder, writer)
+}
+
+// UpdateFolderHandler renames a folder or moves it with all its contents
+func (app *App) UpdateFolderHandler(writer http.ResponseWriter, request *http.Request) {
+	folder, err := app.Backend.GetFolder(request.PathValue("id"))
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	update, err := readFolderUpdate(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if update.Name != "" {
+		err = validateFolderName(update.Name)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		folder.Name = update.Name
+	}
+	if update.ParentId != nil {
+		_, err = app.getFolder(*update.ParentId)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		inside, err := app.isInside(*update.ParentId, folder.FolderId)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		if inside {
+			utils.WriteResponseStatusCode(
+				models.Error{Detail: "folder can not be moved into itself"},
+				http.StatusBadRequest,
+				writer,
+			)
+			return
+		}
+		folder.ParentId = *update.ParentId
+	}
+	folder.UpdatedAt = time.Now().Unix()
+	err = app.Backend.UpdateFolder(folder)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(folder, writer)
+}
+
+// subtree returns a folder with all its descendants, children go before their parents
+func (app *App) subtree(folder models.Folder) ([]models.Folder, error) {
+	children, err := app.Backend.GetFolders(folder.FolderId)
+	if err != nil {
+		return nil, err
+	}
+	var folders []models.Folder
+	for _, child := range children {
+		descendants, err := app.subtree(child)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, descendants...)
+	}
+	return append(folders, folder), nil
+}
+
+// DeleteFolderHandler deletes an empty folder, with recursive=true files of the whole
+// subtree are moved to trash and subfolders are deleted
+func (app *App) DeleteFolderHandler(writer http.ResponseWriter, request *http.Request) {
+	folder, err := app.Backend.GetFolder(request.PathValue("id"))
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	folders, err := app.subtree(folder)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	var files []models.FileMetadata
+	for _, subfolder := range folders {
+		result, err := app.folderFiles(subfolder.FolderId, 1, 0)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		files = append(files, result.Items...)
+	}
+
+	if request.URL.Query().Get("recursive") != "true" && (len(folders) > 1 || len(files) > 0) {
+		utils.WriteResponseStatusCode(models.Error{Detail: "folder is not empty"}, http.StatusConflict, writer)
+		return
+	}
+	// nothing is deleted if any file is retained
+	for _, metadata := range files {
+		err = app.Retention.Check(metadata)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+	for _, metadata := range files {
+		_, err = app.Backend.DeleteFile(metadata.FileId, &metadata.Revision)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+	for _, subfolder := range folders {
+		_, err = app.Backend.DeleteFolder(subfolder.FolderId)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+	utils.WriteJsonResponse(models.Status{Status: true}, writer)
+}
+
+// GetFolderChildrenHandler lists all subfolders and a page of files, files accept
+// the same paging, filter and sort parameters as GET /files
+func (app *App) GetFolderChildrenHandler(writer http.ResponseWriter, request *http.Request) {
+	folderId := folderIdFromUrl(request.PathValue("id"))
+	folder, err := app.getFolder(folderId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	folders, err := app.Backend.GetFolders(folderId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	query, err := readFilesQuery(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	query.Filter.FolderId = &folderId
+	files, err := app.Backend.GetAllFiles(query)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(FolderChildren{Folder: folder, Folders: folders, Files: files}, writer)
+}
+
+// GetFileByPathHandler downloads a file by its folder path and name,
+// the most recently updated file wins if several files share the name
+func (app *App) GetFileByPathHandler(writer http.ResponseWriter, request *http.Request) {
+	segments := splitPath(request.PathValue("path"))
+	if len(segments) == 0 {
+		utils.WriteResponseStatusCode(models.Error{Detail: "file path is required"}, http.StatusBadRequest, writer)
+		return
+	}
+	folderId, err := app.resolveFolderPath("", segments[:len(segments)-1], false)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	files, err := app.Backend.GetAllFiles(backends.FilesQuery{
+		Page:       1,
+		PageSize:   1,
+		Filter:     backends.FileFilter{FolderId: &folderId, Name: segments[len(segments)-1]},
+		SortBy:     backends.SortByUpdatedAt,
+		Descending: true,
+		SkipCount:  true,
+	})
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if len(files.Items) == 0 {
+		utils.WriteResponseStatusCode(
+			models.Error{Detail: fmt.Sprintf("file not found: %s", request.PathValue("path"))},
+			http.StatusNotFound,
+			writer,
+		)
+		return
+	}
+	result, err := app.Backend.GetFile(files.Items[0].FileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	app.writeFile(writer, request, result)
+}
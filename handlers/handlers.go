@@ -1,34 +1,55 @@
 package handlers
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"hybrid-storage/handlers/backends"
 	"hybrid-storage/models"
 	"hybrid-storage/utils"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type AppConfig struct {
 	MaxChunkSize int64
+	// how long deleted files stay in trash
+	TrashRetention time.Duration
+	PurgeInterval  time.Duration
+	// token required to lift legal holds and shorten retention, empty disables it
+	AdminToken  string
+	Compression CompressionConfig
+	Archive     ArchiveConfig
 }
 
 type App struct {
-	Backend backends.FileServerBackend
-	Config  AppConfig
+	Backend   backends.FileServerBackend
+	Config    AppConfig
+	Quotas    *QuotaTracker
+	Retention *RetentionPolicy
+	// master keys for encryption at rest, nil if disabled
+	Keys *KeyRing
+	// other backends files can be copied or moved to, by name
+	Peers map[string]*App
 }
 
 const maxFilesPerPage = 100
 
 func handleBackendError(writer http.ResponseWriter, err error) {
 	backendErr, ok := err.(*backends.FileServerError)
+	requestErr, isRequestErr := err.(*utils.RequestError)
 	if ok {
 		log.Println("Known backend error:", backendErr.Detail)
 		utils.WriteResponseStatusCode(models.Error{Detail: backendErr.Detail}, backendErr.Code, writer)
+	} else if isRequestErr {
+		log.Println("Invalid request:", requestErr.Detail)
+		utils.WriteResponseStatusCode(models.Error{Detail: requestErr.Detail}, http.StatusBadRequest, writer)
 	} else {
 		log.Println("Unknown backend error:", err.Error())
 		utils.WriteResponseStatusCode(models.Error{Detail: err.Error()}, http.StatusInternalServerError, writer)
@@ -51,11 +72,48 @@ func (app *App) UploadFileHandler(writer http.ResponseWriter, request *http.Requ
 	// if chunk is empty - dont save anything
 	var result backends.FileServerResult
 	if chunk.FormDataChunk != nil {
+		customerKey, err := readCustomerKey(request)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		if request.FormValue("extract") == "true" {
+			files, err := app.extractArchive(request, chunk, customerKey)
+			if err != nil {
+				handleBackendError(writer, err)
+				return
+			}
+			utils.WriteJsonResponse(files, writer)
+			return
+		}
+		metadata, err := app.uploadMetadata(request, &chunk, customerKey)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		err = app.encodeChunk(&chunk, metadata, customerKey)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+
+		// later chunks may come from another client, usage belongs to the owner of the file
+		principal := models.Principal{Tenant: metadata.Tenant, User: metadata.Owner}
+		newFile := chunk.ChunkNumber == 1
+		err = app.Quotas.Reserve(principal, chunk.Size, newFile)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
 		result, err = app.Backend.UploadFile(chunk, fileId)
 		if err != nil {
+			app.Quotas.Release(principal, chunk.Size, boolToInt(newFile))
 			handleBackendError(writer, err)
 			return
 		}
+		if chunk.IsLastChunk {
+			app.indexFile(result.FileId)
+		}
 	} else {
 		result = backends.FileServerResult{FileId: fileId}
 	}
@@ -69,11 +127,71 @@ func (app *App) GetFileHandler(writer http.ResponseWriter, request *http.Request
 		handleBackendError(writer, err)
 		return
 	}
-	result, err := app.Backend.GetFile(fileId)
+	var result backends.GetFileResult
+	version := request.URL.Query().Get("version")
+	if version != "" {
+		versionInt, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			utils.WriteResponseStatusCode(models.Error{Detail: "expected int for version"}, http.StatusBadRequest, writer)
+			return
+		}
+		result, err = app.Backend.GetFileVersion(fileId, versionInt)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	} else {
+		result, err = app.Backend.GetFile(fileId)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+
+	app.writeFile(writer, request, result)
+}
+
+// writeFile sends file content decoded the way the client asked for
+func (app *App) writeFile(writer http.ResponseWriter, request *http.Request, result backends.GetFileResult) {
+	customerKey, err := readCustomerKey(request)
+	if err == nil {
+		// a 304 would confirm the content to a client without the key
+		err = checkCustomerKey(result.Metadata, customerKey)
+	}
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	codec := result.Metadata.Compression
+	encoding := ""
+	if codec != "" {
+		writer.Header().Add("Vary", "Accept-Encoding")
+		if app.Config.Compression.Passthrough && acceptsEncoding(request, codec) {
+			encoding = codec
+		}
+	}
+	etag := contentETag(result.Metadata, encoding)
+	modified := lastModified(result.Metadata)
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if writeNotModified(writer, request, etag, modified) {
+		return
+	}
+
+	fileData, err := app.decryptFile(result, customerKey)
 	if err != nil {
 		handleBackendError(writer, err)
 		return
 	}
+	if encoding != "" {
+		writer.Header().Set("Content-Encoding", encoding)
+	} else if codec != "" {
+		fileData, err = decompress(fileData, codec)
+		if err != nil {
+			handleBackendError(writer, fmt.Errorf("failed to decompress file: %w", err))
+			return
+		}
+	}
 	writer.Header().Set("Content-Type", "application/octet-stream")
 	writer.Header().Set(
 		"Content-Disposition",
@@ -82,7 +200,115 @@ func (app *App) GetFileHandler(writer http.ResponseWriter, request *http.Request
 			result.Metadata.Filename+result.Metadata.Extension,
 		),
 	)
-	writer.Write(result.File)
+	writer.Write(fileData)
+}
+
+// uploadMetadata returns metadata of the file a chunk is uploaded to,
+// for the first chunk codec and data key of a new file are chosen and recorded
+func (app *App) uploadMetadata(request *http.Request, chunk *utils.ChunkResult, customerKey []byte) (models.FileMetadata, error) {
+	if chunk.ChunkNumber != 1 {
+		return app.Backend.GetUploadMetadata(chunk.FileId)
+	}
+	metadata := utils.ReadJsonData[models.FileMetadata](chunk.JsonData)
+	folderId, err := app.uploadFolder(request)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.FolderId = folderId
+	return app.newFileMetadata(request, chunk, metadata, customerKey)
+}
+
+// newFileMetadata chooses codec and data key of a new file and records them in the first chunk
+func (app *App) newFileMetadata(request *http.Request, chunk *utils.ChunkResult, metadata models.FileMetadata, customerKey []byte) (models.FileMetadata, error) {
+	codec, err := app.chooseCodec(request, *chunk)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.Compression = codec
+	// customer key replaces the data key, only its fingerprint is stored
+	if customerKey != nil {
+		metadata.KeyFingerprint = customerKeyFingerprint(metadata.FileId, customerKey)
+	} else if app.Keys != nil {
+		metadata.KeyId, metadata.WrappedKey, err = app.Keys.newDataKey()
+		if err != nil {
+			return metadata, fmt.Errorf("failed to create data key: %w", err)
+		}
+	}
+	chunk.JsonData = utils.GetJsonData(models.NewStoredMetadata(&metadata))
+	return metadata, nil
+}
+
+// encodeChunk transforms chunk data the way the file is stored, compression goes first
+// since encrypted data does not compress
+func (app *App) encodeChunk(chunk *utils.ChunkResult, metadata models.FileMetadata, customerKey []byte) error {
+	err := compressChunk(chunk, metadata.Compression)
+	if err != nil {
+		return err
+	}
+	return app.encryptChunk(chunk, metadata, customerKey)
+}
+
+// reservation is quota taken by files stored so far
+type reservation struct {
+	bytes int64
+	files int64
+}
+
+// storeFile uploads content of a new file split into regular chunks
+func (app *App) storeFile(request *http.Request, metadata models.FileMetadata, content io.Reader, customerKey []byte, reserved *reservation) error {
+	principal := utils.GetPrincipal(request)
+	reader := bufio.NewReader(content)
+	for number := 1; ; number++ {
+		data := make([]byte, app.Config.MaxChunkSize)
+		n, err := io.ReadFull(reader, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, err = reader.Peek(1)
+		chunk := utils.ChunkResult{
+			FormDataChunk: utils.NewMemoryChunk(data[:n]),
+			ChunkNumber:   number,
+			FileId:        metadata.FileId,
+			Size:          int64(n),
+			IsLastChunk:   err != nil,
+			JsonData:      utils.GetJsonData(metadata),
+		}
+		if number == 1 {
+			metadata, err = app.newFileMetadata(request, &chunk, metadata, customerKey)
+			if err != nil {
+				return err
+			}
+		}
+		err = app.encodeChunk(&chunk, metadata, customerKey)
+		if err != nil {
+			return err
+		}
+		err = app.Quotas.Reserve(principal, chunk.Size, number == 1)
+		if err != nil {
+			return err
+		}
+		reserved.bytes += chunk.Size
+		reserved.files += boolToInt(number == 1)
+		_, err = app.Backend.UploadFile(chunk, metadata.FileId)
+		if err != nil {
+			return err
+		}
+		if chunk.IsLastChunk {
+			app.indexFile(metadata.FileId)
+			return nil
+		}
+	}
+}
+
+// discardFiles purges files of a failed operation and releases their quota
+func (app *App) discardFiles(request *http.Request, fileIds []string, reserved reservation) {
+	for _, fileId := range fileIds {
+		_, err := app.Backend.PurgeFile(fileId)
+		if err != nil {
+			log.Printf("Failed to purge file %s: %v", fileId, err)
+		}
+	}
+	app.Quotas.Release(utils.GetPrincipal(request), reserved.bytes, reserved.files)
 }
 
 func (app *App) GetFileMetadataHandler(writer http.ResponseWriter, request *http.Request) {
@@ -96,9 +322,31 @@ func (app *App) GetFileMetadataHandler(writer http.ResponseWriter, request *http
 		handleBackendError(writer, err)
 		return
 	}
+	customerKey, err := readCustomerKey(request)
+	if err == nil {
+		err = checkCustomerKey(result, customerKey)
+	}
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	etag := metadataETag(result)
+	modified := lastModified(result)
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if writeNotModified(writer, request, etag, modified) {
+		return
+	}
 	utils.WriteJsonResponse(result, writer)
 }
 
+func boolToInt(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 func convertToIntWithDefaultMax(value string, defaultValue int, max int) int {
 	if value == "" {
 		return defaultValue
@@ -114,11 +362,12 @@ func convertToIntWithDefaultMax(value string, defaultValue int, max int) int {
 }
 
 func (app *App) GetAllFilesHandler(writer http.ResponseWriter, request *http.Request) {
-	page := request.URL.Query().Get("page")
-	pageInt := convertToIntWithDefaultMax(page, 1, 0)
-	pageSize := request.URL.Query().Get("pageSize")
-	pageSizeInt := convertToIntWithDefaultMax(pageSize, 0, maxFilesPerPage)
-	result, err := app.Backend.GetAllFiles(pageInt, pageSizeInt)
+	query, err := readFilesQuery(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	result, err := app.Backend.GetAllFiles(query)
 	if err != nil {
 		handleBackendError(writer, err)
 		return
@@ -126,6 +375,37 @@ func (app *App) GetAllFilesHandler(writer http.ResponseWriter, request *http.Req
 	utils.WriteJsonResponse(result, writer)
 }
 
+// prepareUpdate validates a metadata update from a client, converts ttl into expiry
+// and resolves the target folder
+func (app *App) prepareUpdate(data *backends.FileMetadataUpdate) error {
+	if data.Ttl != nil {
+		if *data.Ttl <= 0 {
+			return &backends.FileServerError{Code: http.StatusBadRequest, Detail: "expected positive int for ttl"}
+		}
+		expiresAt := time.Now().Unix() + *data.Ttl
+		data.ExpiresAt = &expiresAt
+	}
+	err := utils.ValidateUserMetadata(data.UserMetadata)
+	if err != nil {
+		return err
+	}
+	if data.Tags != nil {
+		data.Tags, err = utils.NormalizeTags(data.Tags)
+		if err != nil {
+			return err
+		}
+	}
+	if data.FolderId != nil {
+		folderId := folderIdFromUrl(*data.FolderId)
+		_, err = app.getFolder(folderId)
+		if err != nil {
+			return err
+		}
+		data.FolderId = &folderId
+	}
+	return nil
+}
+
 func (app *App) UpdateFileHandler(writer http.ResponseWriter, request *http.Request) {
 	fileId, err := utils.GetFileId(request)
 	if err != nil {
@@ -142,7 +422,16 @@ func (app *App) UpdateFileHandler(writer http.ResponseWriter, request *http.Requ
 			return
 		}
 		defer request.Body.Close()
-		data = utils.ReadJsonData[backends.FileMetadataUpdate](body)
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			handleBackendError(writer, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "invalid file update json"})
+			return
+		}
+		err = app.prepareUpdate(&data)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
 	} else {
 		chunk, err = utils.ReadFileInChunks(
 			writer,
@@ -154,25 +443,231 @@ func (app *App) UpdateFileHandler(writer http.ResponseWriter, request *http.Requ
 			handleBackendError(writer, err)
 			return
 		}
+		data.Revision, err = readRevision(request)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+	// a new version is checked by its first chunk, later chunks continue it
+	if chunk.ChunkNumber <= 1 && data.Revision == nil {
+		utils.WriteResponseStatusCode(
+			models.Error{Detail: "revision of the file is required"},
+			http.StatusPreconditionRequired,
+			writer,
+		)
+		return
+	}
+
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if chunk.ChunkNumber <= 1 {
+		kind := changeMetadata
+		if chunk.FormDataChunk != nil {
+			kind = changeContent
+		}
+		err = checkPreconditions(request, metadata, kind)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+	// new content or expiry could remove a retained file
+	if chunk.FormDataChunk != nil || data.ExpiresAt != nil {
+		err = app.Retention.Check(metadata)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+
+	// content updates are charged to the owner of the file
+	principal := models.Principal{Tenant: metadata.Tenant, User: metadata.Owner}
+	if chunk.FormDataChunk != nil {
+		// new versions keep codec and data key of the file
+		customerKey, err := readCustomerKey(request)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		err = app.encodeChunk(&chunk, metadata, customerKey)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+		err = app.Quotas.Reserve(principal, chunk.Size, false)
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
 	}
 	result, err := app.Backend.UpdateFile(chunk, fileId, data)
 	if err != nil {
+		if chunk.FormDataChunk != nil {
+			app.Quotas.Release(principal, chunk.Size, 0)
+		}
 		handleBackendError(writer, err)
 		return
 	}
+	if chunk.IsLastChunk {
+		app.indexFile(fileId)
+	}
+	metadata, err = app.Backend.GetFileMetadata(fileId)
+	if err == nil {
+		result.Revision = metadata.Revision
+	}
 	utils.WriteJsonResponse(result, writer)
 }
 
+// readRevision reads the expected revision of a file from the "revision" form value
+func readRevision(request *http.Request) (*int64, error) {
+	value := request.FormValue("revision")
+	if value == "" {
+		return nil, nil
+	}
+	revision, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, &backends.FileServerError{Code: http.StatusBadRequest, Detail: "expected int for revision"}
+	}
+	return &revision, nil
+}
+
 func (app *App) DeleteFileHandler(writer http.ResponseWriter, request *http.Request) {
 	fileId, err := utils.GetFileId(request)
 	if err != nil {
 		handleBackendError(writer, err)
 		return
 	}
-	status, err := app.Backend.DeleteFile(fileId)
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	err = checkPreconditions(request, metadata, changeFile)
+	if err == nil {
+		err = app.Retention.Check(metadata)
+	}
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	// file goes to trash, its space is released when it is purged. Only the revision
+	// the preconditions were checked against is deleted
+	status, err := app.Backend.DeleteFile(fileId, &metadata.Revision)
 	if err != nil {
 		handleBackendError(writer, err)
 		return
 	}
 	utils.WriteJsonResponse(models.Status{Status: status}, writer)
 }
+
+func (app *App) UndeleteFileHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	status, err := app.Backend.UndeleteFile(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	// folder could be deleted while the file was in trash
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err == nil {
+		_, err = app.getFolder(metadata.FolderId)
+	}
+	if err != nil {
+		root := ""
+		_, err = app.Backend.UpdateFile(utils.ChunkResult{IsLastChunk: true}, fileId, backends.FileMetadataUpdate{FolderId: &root})
+		if err != nil {
+			handleBackendError(writer, err)
+			return
+		}
+	}
+	utils.WriteJsonResponse(models.Status{Status: status}, writer)
+}
+
+func (app *App) GetTrashHandler(writer http.ResponseWriter, request *http.Request) {
+	result, err := app.Backend.GetDeletedFiles(math.MaxInt64)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if result == nil {
+		result = []models.FileMetadata{}
+	}
+	utils.WriteJsonResponse(result, writer)
+}
+
+func (app *App) GetFileVersionsHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	result, err := app.Backend.GetFileVersions(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(result, writer)
+}
+
+func (app *App) RestoreFileVersionHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	version, err := strconv.ParseInt(request.PathValue("version"), 10, 64)
+	if err != nil {
+		utils.WriteResponseStatusCode(models.Error{Detail: "expected int for version"}, http.StatusBadRequest, writer)
+		return
+	}
+
+	// restored version is a copy, so it is charged to the owner again
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	err = app.Retention.Check(metadata)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	versions, err := app.Backend.GetFileVersions(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	var size int64
+	for _, fileVersion := range versions {
+		if fileVersion.Version == version {
+			size = fileVersion.Size
+		}
+	}
+	principal := models.Principal{Tenant: metadata.Tenant, User: metadata.Owner}
+	err = app.Quotas.Reserve(principal, size, false)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+
+	restored, err := app.Backend.RestoreFileVersion(fileId, version)
+	if err != nil {
+		app.Quotas.Release(principal, size, 0)
+		handleBackendError(writer, err)
+		return
+	}
+	app.indexFile(fileId)
+	utils.WriteJsonResponse(restored, writer)
+}
+
+func (app *App) GetUsageHandler(writer http.ResponseWriter, request *http.Request) {
+	utils.WriteJsonResponse(app.Quotas.Usage(utils.GetPrincipal(request)), writer)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpdateFileRejectsInvalidJson(t *testing.T) {
+	app := newTestApp(t)
+	fileId := uploadChunk(t, app, []byte("content"), 1, 1, map[string]string{})
+
+	for _, body := range []string{`{"filename": `, `{"revision": "1"}`, `[]`} {
+		request := httptest.NewRequest(http.MethodPut, "/files/"+fileId, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.SetPathValue("id", fileId)
+		recorder := httptest.NewRecorder()
+		app.UpdateFileHandler(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("update with %s returned %d, expected 400", body, recorder.Code)
+		}
+	}
+}
+
+func TestUploadRejectsInvalidExpiry(t *testing.T) {
+	app := newTestApp(t)
+	for _, fields := range []map[string]string{{"expiresAt": "tomorrow"}, {"ttl": "-5"}, {"ttl": "soon"}} {
+		recorder := httptest.NewRecorder()
+		app.UploadFileHandler(recorder, newUploadRequest(t, []byte("content"), 1, 1, fields))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("upload with %v returned %d, expected 400", fields, recorder.Code)
+		}
+	}
+}
+
+func TestInvalidUserMetadataIsRejected(t *testing.T) {
+	app := newTestApp(t)
+	longTag := strings.Repeat("t", 200)
+	for _, fields := range []map[string]string{{"userMetadata": "[1]"}, {"userMetadata": `{"": "value"}`}, {"tags": longTag}} {
+		recorder := httptest.NewRecorder()
+		app.UploadFileHandler(recorder, newUploadRequest(t, []byte("content"), 1, 1, fields))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("upload with %v returned %d, expected 400", fields, recorder.Code)
+		}
+	}
+
+	fileId := uploadChunk(t, app, []byte("content"), 1, 1, map[string]string{})
+	body := `{"revision": 1, "tags": ["` + longTag + `"]}`
+	request := httptest.NewRequest(http.MethodPut, "/files/"+fileId, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.SetPathValue("id", fileId)
+	recorder := httptest.NewRecorder()
+	app.UpdateFileHandler(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("update with a long tag returned %d, expected 400", recorder.Code)
+	}
+}
+
+func TestMoveRequiresCurrentRevision(t *testing.T) {
+	app := newTestApp(t)
+	fileId := uploadChunk(t, app, []byte("content"), 1, 1, map[string]string{})
+
+	cases := []struct {
+		body     string
+		expected int
+	}{
+		{`{"filename": "moved"}`, http.StatusPreconditionRequired},
+		{`{"filename": "moved", "revision": 5}`, http.StatusConflict},
+		{`{"filename": "moved", "revision": 1}`, http.StatusOK},
+		{`{"filename": "again", "revision": 1}`, http.StatusConflict},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodPost, "/files/"+fileId+"/move", strings.NewReader(c.body))
+		request.SetPathValue("id", fileId)
+		recorder := httptest.NewRecorder()
+		app.MoveFileHandler(recorder, request)
+		if recorder.Code != c.expected {
+			t.Errorf("move with %s returned %d, expected %d", c.body, recorder.Code, c.expected)
+		}
+	}
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Filename != "moved" || metadata.Revision != 2 {
+		t.Errorf("file is named %q with revision %d", metadata.Filename, metadata.Revision)
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"hybrid-storage/models"
+	"log"
+	"time"
+)
+
+// StartPurger periodically removes files that stayed in trash longer than TrashRetention,
+// files that are past their expiry and versions whose upload was abandoned
+func (app *App) StartPurger() {
+	go func() {
+		for range time.Tick(app.Config.PurgeInterval) {
+			app.purgeTrash()
+			app.purgeExpired()
+			app.discardAbandonedVersions()
+		}
+	}()
+}
+
+func (app *App) purgeExpired() {
+	files, err := app.Backend.GetExpiredFiles(time.Now().Unix())
+	if err != nil {
+		log.Println("Failed to query expired files:", err.Error())
+		return
+	}
+
+	purged := 0
+	for _, metadata := range files {
+		if app.purgeFile(metadata) {
+			purged++
+		}
+	}
+	if purged > 0 {
+		log.Printf("Purged %d expired files", purged)
+	}
+}
+
+// discardAbandonedVersions releases space of pending versions nobody finished,
+// versions discarded before an error are released too
+func (app *App) discardAbandonedVersions() {
+	discarded, err := app.Backend.DiscardAbandonedVersions(time.Now().Unix())
+	if err != nil {
+		log.Println("Failed to discard abandoned versions:", err.Error())
+	}
+	for _, version := range discarded {
+		app.Quotas.Release(
+			models.Principal{Tenant: version.Tenant, User: version.Owner},
+			version.Size,
+			boolToInt(version.Purged),
+		)
+	}
+	if len(discarded) > 0 {
+		log.Printf("Discarded %d abandoned versions", len(discarded))
+	}
+}
+
+func (app *App) purgeTrash() {
+	deletedBefore := time.Now().Add(-app.Config.TrashRetention).Unix()
+	files, err := app.Backend.GetDeletedFiles(deletedBefore)
+	if err != nil {
+		log.Println("Failed to query trash:", err.Error())
+		return
+	}
+
+	purged := 0
+	for _, metadata := range files {
+		if app.purgeFile(metadata) {
+			purged++
+		}
+	}
+	if purged > 0 {
+		log.Printf("Purged %d files from trash", purged)
+	}
+}
+
+// purgeFile skips files that are held or retained, they are purged on a later run
+func (app *App) purgeFile(metadata models.FileMetadata) bool {
+	if app.Retention.Check(metadata) != nil {
+		return false
+	}
+	size, err := getStoredSize(app.Backend, metadata.FileId)
+	if err != nil {
+		log.Printf("Failed to get size of %s: %s", metadata.FileId, err.Error())
+		return false
+	}
+	_, err = app.Backend.PurgeFile(metadata.FileId)
+	if err != nil {
+		log.Printf("Failed to purge %s: %s", metadata.FileId, err.Error())
+		return false
+	}
+	app.Quotas.Release(
+		models.Principal{Tenant: metadata.Tenant, User: metadata.Owner},
+		size,
+		1,
+	)
+	return true
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// QuotaLimit describes how much a tenant or user may store, 0 means unlimited
+type QuotaLimit struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int64 `json:"maxFiles"`
+}
+
+type QuotaConfig struct {
+	// defaults applied to every tenant and user
+	Tenant QuotaLimit `json:"tenant"`
+	User   QuotaLimit `json:"user"`
+	// overrides by tenant id and by "tenant/user"
+	Tenants map[string]QuotaLimit `json:"tenants"`
+	Users   map[string]QuotaLimit `json:"users"`
+}
+
+// LoadQuotaConfig reads a json file over config, limits missing in the file keep their values
+func LoadQuotaConfig(path string, config QuotaConfig) (QuotaConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read quota config: %w", err)
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse quota config: %w", err)
+	}
+	return config, nil
+}
+
+type quotaCounter struct {
+	bytes int64
+	files int64
+}
+
+// QuotaTracker keeps current usage per tenant and per user in memory,
+// it is updated incrementally as chunks are stored and files are deleted
+type QuotaTracker struct {
+	config  QuotaConfig
+	lock    sync.Mutex
+	tenants map[string]*quotaCounter
+	users   map[string]*quotaCounter
+}
+
+func NewQuotaTracker(config QuotaConfig) *QuotaTracker {
+	return &QuotaTracker{
+		config:  config,
+		tenants: make(map[string]*quotaCounter),
+		users:   make(map[string]*quotaCounter),
+	}
+}
+
+func userKey(principal models.Principal) string {
+	return principal.Tenant + "/" + principal.User
+}
+
+func (qt *QuotaTracker) tenantLimit(tenant string) QuotaLimit {
+	if limit, ok := qt.config.Tenants[tenant]; ok {
+		return limit
+	}
+	return qt.config.Tenant
+}
+
+func (qt *QuotaTracker) userLimit(principal models.Principal) QuotaLimit {
+	if limit, ok := qt.config.Users[userKey(principal)]; ok {
+		return limit
+	}
+	return qt.config.User
+}
+
+func getCounter(counters map[string]*quotaCounter, key string) *quotaCounter {
+	counter, ok := counters[key]
+	if !ok {
+		counter = &quotaCounter{}
+		counters[key] = counter
+	}
+	return counter
+}
+
+func checkLimit(kind string, counter *quotaCounter, limit QuotaLimit, bytes int64, files int64) error {
+	if limit.MaxBytes != 0 && bytes > limit.MaxBytes {
+		return &backends.FileServerError{
+			Code:   http.StatusRequestEntityTooLarge,
+			Detail: fmt.Sprintf("%s quota is %d bytes, upload of %d bytes can never fit", kind, limit.MaxBytes, bytes),
+		}
+	}
+	if limit.MaxBytes != 0 && counter.bytes+bytes > limit.MaxBytes {
+		return &backends.FileServerError{
+			Code:   http.StatusInsufficientStorage,
+			Detail: fmt.Sprintf("%s byte quota exceeded: %d of %d bytes used", kind, counter.bytes, limit.MaxBytes),
+		}
+	}
+	if limit.MaxFiles != 0 && counter.files+files > limit.MaxFiles {
+		return &backends.FileServerError{
+			Code:   http.StatusInsufficientStorage,
+			Detail: fmt.Sprintf("%s file quota exceeded: %d of %d files used", kind, counter.files, limit.MaxFiles),
+		}
+	}
+	return nil
+}
+
+// Reserve checks that bytes (and one more file if newFile) fit into both tenant
+// and user quotas and records them as used
+func (qt *QuotaTracker) Reserve(principal models.Principal, bytes int64, newFile bool) error {
+	var files int64
+	if newFile {
+		files = 1
+	}
+
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	tenantCounter := getCounter(qt.tenants, principal.Tenant)
+	userCounter := getCounter(qt.users, userKey(principal))
+	err := checkLimit("tenant", tenantCounter, qt.tenantLimit(principal.Tenant), bytes, files)
+	if err != nil {
+		return err
+	}
+	err = checkLimit("user", userCounter, qt.userLimit(principal), bytes, files)
+	if err != nil {
+		return err
+	}
+
+	tenantCounter.bytes += bytes
+	tenantCounter.files += files
+	userCounter.bytes += bytes
+	userCounter.files += files
+	return nil
+}
+
+// Release gives back previously reserved bytes and files
+func (qt *QuotaTracker) Release(principal models.Principal, bytes int64, files int64) {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	for _, counter := range []*quotaCounter{
+		getCounter(qt.tenants, principal.Tenant),
+		getCounter(qt.users, userKey(principal)),
+	} {
+		counter.bytes = max(counter.bytes-bytes, 0)
+		counter.files = max(counter.files-files, 0)
+	}
+}
+
+func (qt *QuotaTracker) Usage(principal models.Principal) models.Usage {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	tenantCounter := getCounter(qt.tenants, principal.Tenant)
+	userCounter := getCounter(qt.users, userKey(principal))
+	tenantLimit := qt.tenantLimit(principal.Tenant)
+	userLimit := qt.userLimit(principal)
+	return models.Usage{
+		Tenant: principal.Tenant,
+		User:   principal.User,
+		TenantUsage: models.QuotaUsage{
+			Bytes:    tenantCounter.bytes,
+			Files:    tenantCounter.files,
+			MaxBytes: tenantLimit.MaxBytes,
+			MaxFiles: tenantLimit.MaxFiles,
+		},
+		UserUsage: models.QuotaUsage{
+			Bytes:    userCounter.bytes,
+			Files:    userCounter.files,
+			MaxBytes: userLimit.MaxBytes,
+			MaxFiles: userLimit.MaxFiles,
+		},
+	}
+}
+
+// getStoredSize sums sizes of every version of a file
+func getStoredSize(backend backends.FileServerBackend, fileId string) (int64, error) {
+	versions, err := backend.GetFileVersions(fileId)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, version := range versions {
+		size += version.Size
+	}
+	return size, nil
+}
+
+func (qt *QuotaTracker) add(backend backends.FileServerBackend, metadata models.FileMetadata) error {
+	size, err := getStoredSize(backend, metadata.FileId)
+	if err != nil {
+		return err
+	}
+
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	principal := models.Principal{Tenant: metadata.Tenant, User: metadata.Owner}
+	for _, counter := range []*quotaCounter{
+		getCounter(qt.tenants, principal.Tenant),
+		getCounter(qt.users, userKey(principal)),
+	} {
+		counter.bytes += size
+		counter.files++
+	}
+	return nil
+}
+
+// Load seeds usage from files that are already stored in the backend, files in trash,
+// expired files and unfinished uploads take space until they are purged
+func (qt *QuotaTracker) Load(backend backends.FileServerBackend) error {
+	files, err := backend.GetStoredFiles()
+	if err != nil {
+		return err
+	}
+	for _, metadata := range files {
+		err = qt.add(backend, metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Loaded quota usage for %d tenants and %d users", len(qt.tenants), len(qt.users))
+	return nil
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUploadChunksAreChargedToOwner(t *testing.T) {
+	app := newTestApp(t)
+	owner := models.Principal{Tenant: "tenant", User: "owner"}
+	other := models.Principal{Tenant: "other-tenant", User: "other"}
+	upload := func(principal models.Principal, data []byte, chunkNumber int, totalChunks int, fields map[string]string) string {
+		request := newUploadRequest(t, data, chunkNumber, totalChunks, fields)
+		return sendUpload(t, app, utils.WithPrincipal(request, principal))
+	}
+
+	fileId := upload(owner, testData(100), 1, 2, map[string]string{})
+	upload(other, testData(50), 2, 2, map[string]string{"fileId": fileId})
+	expiredAt := strconv.FormatInt(time.Now().Unix()-60, 10)
+	upload(owner, testData(30), 1, 1, map[string]string{"expiresAt": expiredAt})
+	upload(owner, testData(20), 1, 2, map[string]string{})
+	deletedId := upload(owner, testData(10), 1, 1, map[string]string{})
+	request := httptest.NewRequest(http.MethodDelete, "/files/"+deletedId, nil)
+	request.SetPathValue("id", deletedId)
+	recorder := httptest.NewRecorder()
+	app.DeleteFileHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("delete failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	usage := app.Quotas.Usage(owner)
+	if usage.UserUsage.Files != 4 {
+		t.Errorf("owner has %d files, expected 4", usage.UserUsage.Files)
+	}
+	if usage.TenantUsage.Files != 4 {
+		t.Errorf("tenant of the owner has %d files, expected 4", usage.TenantUsage.Files)
+	}
+	if otherUsage := app.Quotas.Usage(other); otherUsage.UserUsage.Bytes != 0 || otherUsage.TenantUsage.Bytes != 0 {
+		t.Errorf("chunk of another client was charged to it: %+v", otherUsage)
+	}
+
+	// usage loaded at startup counts expired files, unfinished uploads and files in trash too
+	loaded := NewQuotaTracker(QuotaConfig{})
+	err := loaded.Load(app.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedUsage := loaded.Usage(owner); loadedUsage != usage {
+		t.Errorf("loaded usage %+v, expected %+v", loadedUsage, usage)
+	}
+}
+
+func TestQuotaConfigFileKeepsEnvironmentLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	err := os.WriteFile(path, []byte(`{"user": {"maxFiles": 10}, "tenants": {"big": {"maxBytes": 1000}}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := QuotaConfig{
+		Tenant: QuotaLimit{MaxBytes: 100, MaxFiles: 5},
+		User:   QuotaLimit{MaxBytes: 50},
+	}
+
+	config, err := LoadQuotaConfig(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Tenant != base.Tenant || config.User != (QuotaLimit{MaxBytes: 50, MaxFiles: 10}) {
+		t.Errorf("merged defaults are %+v and %+v", config.Tenant, config.User)
+	}
+	if config.Tenants["big"].MaxBytes != 1000 {
+		t.Errorf("tenant overrides are %+v", config.Tenants)
+	}
+}
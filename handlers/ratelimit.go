@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how long a client bucket is kept after its last request
+const bucketIdleTimeout = 10 * time.Minute
+
+// RouteLimit describes limits for a single route, 0 means unlimited
+type RouteLimit struct {
+	// requests per second per client ip
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+	// bytes per second per client ip, shared by all its connections
+	UploadBytesPerSecond   int64 `json:"uploadBytesPerSecond"`
+	DownloadBytesPerSecond int64 `json:"downloadBytesPerSecond"`
+}
+
+type RateLimitConfig struct {
+	Default RouteLimit            `json:"default"`
+	Routes  map[string]RouteLimit `json:"routes"`
+	// bytes per second shared by all connections
+	GlobalUploadBytesPerSecond   int64 `json:"globalUploadBytesPerSecond"`
+	GlobalDownloadBytesPerSecond int64 `json:"globalDownloadBytesPerSecond"`
+}
+
+// LoadRateLimitConfig reads a json file over config, fields missing in the file keep their values
+func LoadRateLimitConfig(path string, config RateLimitConfig) (RateLimitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read rate limit config: %w", err)
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse rate limit config: %w", err)
+	}
+	return config, nil
+}
+
+type tokenBucket struct {
+	lock     sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastSeen time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, lastSeen: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.lastSeen).Seconds()*tb.rate)
+	tb.lastSeen = now
+}
+
+// Allow takes one token or returns how long to wait until one is available
+func (tb *tokenBucket) Allow() (bool, time.Duration) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// Wait takes n tokens going into debt if needed and sleeps until the debt is paid
+func (tb *tokenBucket) Wait(n int) {
+	tb.lock.Lock()
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	var wait time.Duration
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.lock.Unlock()
+
+	time.Sleep(wait)
+}
+
+func (tb *tokenBucket) idleSince(now time.Time) time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	return now.Sub(tb.lastSeen)
+}
+
+// throttle waits for n bytes in every non nil bucket
+func throttle(n int, buckets ...*tokenBucket) {
+	for _, bucket := range buckets {
+		if bucket != nil {
+			bucket.Wait(n)
+		}
+	}
+}
+
+func newBandwidthBucket(bytesPerSecond int64) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// allow bursts of up to a quarter of a second
+	return newTokenBucket(float64(bytesPerSecond), math.Max(float64(bytesPerSecond)/4, 1))
+}
+
+// bytes are passed in pieces not larger than the smallest burst,
+// so a single Read or Write can not overshoot the limit
+func pieceSize(size int, buckets ...*tokenBucket) int {
+	for _, bucket := range buckets {
+		if bucket != nil && int(bucket.burst) < size {
+			size = int(bucket.burst)
+		}
+	}
+	return size
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	buckets []*tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := tr.ReadCloser.Read(p[:pieceSize(len(p), tr.buckets...)])
+	throttle(n, tr.buckets...)
+	return n, err
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	buckets []*tokenBucket
+}
+
+func (trw *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + pieceSize(len(p)-written, trw.buckets...)
+		n, err := trw.ResponseWriter.Write(p[written:end])
+		written += n
+		throttle(n, trw.buckets...)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// RateLimiter applies token bucket request and bandwidth limits per client ip
+// and bandwidth limits for the whole server
+type RateLimiter struct {
+	config         RateLimitConfig
+	lock           sync.Mutex
+	clients        map[string]*tokenBucket
+	globalUpload   *tokenBucket
+	globalDownload *tokenBucket
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{
+		config:         config,
+		clients:        make(map[string]*tokenBucket),
+		globalUpload:   newBandwidthBucket(config.GlobalUploadBytesPerSecond),
+		globalDownload: newBandwidthBucket(config.GlobalDownloadBytesPerSecond),
+	}
+	go rl.cleanupIdleClients()
+	return rl
+}
+
+func (rl *RateLimiter) cleanupIdleClients() {
+	for range time.Tick(bucketIdleTimeout) {
+		now := time.Now()
+		rl.lock.Lock()
+		for key, bucket := range rl.clients {
+			if bucket.idleSince(now) > bucketIdleTimeout {
+				delete(rl.clients, key)
+			}
+		}
+		rl.lock.Unlock()
+	}
+}
+
+// getClientKey identifies a client by ip, headers sent by the client are not validated
+// and a client changing them would get a new bucket with every request
+func getClientKey(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func (rl *RateLimiter) routeLimit(route string) RouteLimit {
+	if limit, ok := rl.config.Routes[route]; ok {
+		return limit
+	}
+	return rl.config.Default
+}
+
+// clientBucket returns the bucket of a client for a kind of limit of the route,
+// newBucket creates it for the first request of the client
+func (rl *RateLimiter) clientBucket(route string, kind string, request *http.Request, newBucket func() *tokenBucket) *tokenBucket {
+	key := route + "|" + kind + "|" + getClientKey(request)
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	bucket, ok := rl.clients[key]
+	if !ok {
+		bucket = newBucket()
+		rl.clients[key] = bucket
+	}
+	return bucket
+}
+
+// bandwidthBucket returns the bandwidth bucket of a client, nil when the route is unlimited
+func (rl *RateLimiter) bandwidthBucket(route string, kind string, bytesPerSecond int64, request *http.Request) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rl.clientBucket(route, kind, request, func() *tokenBucket {
+		return newBandwidthBucket(bytesPerSecond)
+	})
+}
+
+// Limit wraps handler of a route with limits configured for it
+func (rl *RateLimiter) Limit(route string, next http.HandlerFunc) http.HandlerFunc {
+	limit := rl.routeLimit(route)
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if limit.RequestsPerSecond > 0 {
+			bucket := rl.clientBucket(route, "requests", request, func() *tokenBucket {
+				return newTokenBucket(limit.RequestsPerSecond, float64(max(limit.Burst, 1)))
+			})
+			allowed, wait := bucket.Allow()
+			if !allowed {
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				writer.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+				utils.WriteResponseStatusCode(
+					models.Error{Detail: "rate limit exceeded"},
+					http.StatusTooManyRequests,
+					writer,
+				)
+				return
+			}
+		}
+
+		// parallel connections of a client share its buckets
+		uploadBuckets := []*tokenBucket{rl.bandwidthBucket(route, "upload", limit.UploadBytesPerSecond, request), rl.globalUpload}
+		if uploadBuckets[0] != nil || uploadBuckets[1] != nil {
+			request.Body = &throttledReader{ReadCloser: request.Body, buckets: uploadBuckets}
+		}
+		downloadBuckets := []*tokenBucket{rl.bandwidthBucket(route, "download", limit.DownloadBytesPerSecond, request), rl.globalDownload}
+		if downloadBuckets[0] != nil || downloadBuckets[1] != nil {
+			writer = &throttledResponseWriter{ResponseWriter: writer, buckets: downloadBuckets}
+		}
+
+		next(writer, request)
+	}
+}
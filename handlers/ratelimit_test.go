@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimitIgnoresClientHeaders(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{Default: RouteLimit{RequestsPerSecond: 0.001, Burst: 1}})
+	handler := limiter.Limit("GET /files", func(writer http.ResponseWriter, request *http.Request) {})
+
+	codes := []int{}
+	for i := range 3 {
+		request := httptest.NewRequest(http.MethodGet, "/files", nil)
+		request.Header.Set("X-Api-Key", "key-"+strconv.Itoa(i))
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		codes = append(codes, recorder.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("requests from one ip with new keys returned %v", codes)
+	}
+}
+
+func TestBandwidthBucketIsSharedByClient(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{})
+	request := func(remoteAddr string) *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "/files", nil)
+		request.RemoteAddr = remoteAddr
+		return request
+	}
+
+	first := limiter.bandwidthBucket("POST /files", "upload", 1000, request("10.0.0.1:1000"))
+	second := limiter.bandwidthBucket("POST /files", "upload", 1000, request("10.0.0.1:2000"))
+	other := limiter.bandwidthBucket("POST /files", "upload", 1000, request("10.0.0.2:1000"))
+	if first == nil || first != second {
+		t.Error("connections of one client got different upload buckets")
+	}
+	if other == first {
+		t.Error("another client shares the upload bucket")
+	}
+	if limiter.bandwidthBucket("POST /files", "download", 0, request("10.0.0.1:1000")) != nil {
+		t.Error("unlimited route got a bucket")
+	}
+}
+
+func TestRateLimitConfigFileKeepsEnvironmentLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	err := os.WriteFile(path, []byte(`{"default": {"burst": 5}, "routes": {"POST /files": {"requestsPerSecond": 1}}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := RateLimitConfig{
+		Default:                    RouteLimit{RequestsPerSecond: 10, Burst: 1, UploadBytesPerSecond: 1000},
+		GlobalUploadBytesPerSecond: 5000,
+	}
+
+	config, err := LoadRateLimitConfig(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RouteLimit{RequestsPerSecond: 10, Burst: 5, UploadBytesPerSecond: 1000}
+	if config.Default != expected || config.GlobalUploadBytesPerSecond != 5000 {
+		t.Errorf("merged config is %+v", config)
+	}
+	if config.Routes["POST /files"].RequestsPerSecond != 1 {
+		t.Errorf("route limits are %+v", config.Routes)
+	}
+}
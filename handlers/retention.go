@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const AdminTokenHeader = "X-Admin-Token"
+
+// RetentionRule keeps matching files from being deleted or overwritten for Days after creation,
+// empty fields match any file
+type RetentionRule struct {
+	Tenant    string `json:"tenant"`
+	Extension string `json:"extension"`
+	Tag       string `json:"tag"`
+	Days      int64  `json:"days"`
+}
+
+type RetentionConfig struct {
+	Rules []RetentionRule `json:"rules"`
+}
+
+func LoadRetentionConfig(path string) (RetentionConfig, error) {
+	var config RetentionConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read retention config: %w", err)
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse retention config: %w", err)
+	}
+	return config, nil
+}
+
+type RetentionPolicy struct {
+	config RetentionConfig
+}
+
+func NewRetentionPolicy(config RetentionConfig) *RetentionPolicy {
+	return &RetentionPolicy{config: config}
+}
+
+func (rule RetentionRule) matches(metadata models.FileMetadata) bool {
+	if rule.Tenant != "" && rule.Tenant != metadata.Tenant {
+		return false
+	}
+	// extensions are stored with a leading dot, rules may omit it
+	extension := strings.TrimPrefix(metadata.Extension, ".")
+	if rule.Extension != "" && !strings.EqualFold(strings.TrimPrefix(rule.Extension, "."), extension) {
+		return false
+	}
+	if rule.Tag != "" && !slices.Contains(metadata.Tags, rule.Tag) {
+		return false
+	}
+	return true
+}
+
+// RetainedUntil combines per file retention with every matching rule
+func (rp *RetentionPolicy) RetainedUntil(metadata models.FileMetadata) int64 {
+	retainUntil := metadata.RetainUntil
+	for _, rule := range rp.config.Rules {
+		if rule.matches(metadata) {
+			retainUntil = max(retainUntil, metadata.CreatedAt+rule.Days*24*60*60)
+		}
+	}
+	return retainUntil
+}
+
+// Check returns an error if file can not be deleted or overwritten right now
+func (rp *RetentionPolicy) Check(metadata models.FileMetadata) error {
+	if metadata.LegalHold {
+		return &backends.FileServerError{
+			Code:   http.StatusLocked,
+			Detail: "file is under legal hold",
+		}
+	}
+	retainUntil := rp.RetainedUntil(metadata)
+	if retainUntil > time.Now().Unix() {
+		return &backends.FileServerError{
+			Code:   http.StatusLocked,
+			Detail: fmt.Sprintf("file is retained until %s", time.Unix(retainUntil, 0).UTC().Format(time.RFC3339)),
+		}
+	}
+	return nil
+}
+
+func (rp *RetentionPolicy) Retention(metadata models.FileMetadata) models.Retention {
+	return models.Retention{
+		FileId:      metadata.FileId,
+		LegalHold:   metadata.LegalHold,
+		RetainUntil: rp.RetainedUntil(metadata),
+	}
+}
+
+func (app *App) isAdmin(request *http.Request) bool {
+	token := request.Header.Get(AdminTokenHeader)
+	if app.Config.AdminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(app.Config.AdminToken)) == 1
+}
+
+func (app *App) GetRetentionHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(app.Retention.Retention(metadata), writer)
+}
+
+// UpdateRetentionHandler places or lifts a legal hold and per file retention,
+// anyone may make retention stricter, only admins may relax it
+func (app *App) UpdateRetentionHandler(writer http.ResponseWriter, request *http.Request) {
+	fileId, err := utils.GetFileId(request)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, "Unable to read request body", http.StatusBadRequest)
+		return
+	}
+	defer request.Body.Close()
+	var update models.RetentionUpdate
+	err = json.Unmarshal(body, &update)
+	if err != nil {
+		utils.WriteResponseStatusCode(models.Error{Detail: "invalid retention update"}, http.StatusBadRequest, writer)
+		return
+	}
+
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	liftsHold := update.LegalHold != nil && !*update.LegalHold && metadata.LegalHold
+	shortensRetention := update.RetainUntil != nil && *update.RetainUntil < metadata.RetainUntil
+	if (liftsHold || shortensRetention) && !app.isAdmin(request) {
+		utils.WriteResponseStatusCode(
+			models.Error{Detail: "only admins can lift legal hold or shorten retention"},
+			http.StatusForbidden,
+			writer,
+		)
+		return
+	}
+
+	_, err = app.Backend.UpdateFile(
+		utils.ChunkResult{IsLastChunk: true},
+		fileId,
+		backends.FileMetadataUpdate{LegalHold: update.LegalHold, RetainUntil: update.RetainUntil},
+	)
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	if update.LegalHold != nil {
+		metadata.LegalHold = *update.LegalHold
+	}
+	if update.RetainUntil != nil {
+		metadata.RetainUntil = *update.RetainUntil
+	}
+	utils.WriteJsonResponse(app.Retention.Retention(metadata), writer)
+}
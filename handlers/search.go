@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/zlib"
+	"hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// larger files are searchable only by name and metadata
+	maxIndexedFileSize = 16 * 1024 * 1024
+	maxIndexedText     = 1024 * 1024
+)
+
+var textExtensions = []string{".txt", ".text", ".md", ".markdown", ".csv", ".tsv", ".log"}
+
+// extractText returns searchable text of file content, empty for unsupported formats
+func extractText(metadata models.FileMetadata, data []byte) string {
+	extension := strings.ToLower(metadata.Extension)
+	var text string
+	switch {
+	case extension == ".pdf" || bytes.HasPrefix(data, []byte("%PDF-")):
+		text = extractPdfText(data)
+	case slices.Contains(textExtensions, extension),
+		strings.HasPrefix(http.DetectContentType(data), "text/plain"):
+		text = string(data)
+	}
+	if len(text) > maxIndexedText {
+		text = text[:maxIndexedText]
+	}
+	return strings.ToValidUTF8(text, " ")
+}
+
+// extractPdfText collects literal strings shown by text operators of content streams.
+// Fonts with custom encodings (hex strings) are not decoded
+func extractPdfText(data []byte) string {
+	var text strings.Builder
+	for {
+		start := bytes.Index(data, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		data = bytes.TrimLeft(data[start+len("stream"):], "\r\n")
+		end := bytes.Index(data, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[:end]
+		data = data[end+len("endstream"):]
+
+		// most content streams are FlateDecode
+		reader, err := zlib.NewReader(bytes.NewReader(stream))
+		if err == nil {
+			inflated, err := io.ReadAll(io.LimitReader(reader, maxIndexedText))
+			if err == nil || len(inflated) > 0 {
+				stream = inflated
+			}
+		}
+		extractPdfStrings(stream, &text)
+		if text.Len() > maxIndexedText {
+			break
+		}
+	}
+	return text.String()
+}
+
+// extractPdfStrings appends literal strings found between BT and ET operators
+func extractPdfStrings(stream []byte, text *strings.Builder) {
+	for {
+		begin := bytes.Index(stream, []byte("BT"))
+		if begin < 0 {
+			return
+		}
+		stream = stream[begin+2:]
+		end := bytes.Index(stream, []byte("ET"))
+		if end < 0 {
+			end = len(stream)
+		}
+		block := stream[:end]
+		stream = stream[end:]
+
+		for i := 0; i < len(block); i++ {
+			if block[i] != '(' {
+				continue
+			}
+			var literal []byte
+			literal, i = readPdfLiteral(block, i+1)
+			if utf8.Valid(literal) {
+				text.Write(literal)
+			}
+		}
+		text.WriteByte(' ')
+	}
+}
+
+// readPdfLiteral decodes a literal string starting after its opening parenthesis
+// and returns it with the index of the closing parenthesis
+func readPdfLiteral(block []byte, i int) ([]byte, int) {
+	var literal []byte
+	depth := 1
+	for ; i < len(block); i++ {
+		switch c := block[i]; c {
+		case '\\':
+			i++
+			if i == len(block) {
+				return literal, i
+			}
+			switch block[i] {
+			case 'n', 'r', 't':
+				literal = append(literal, ' ')
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				// up to three octal digits
+				value := 0
+				for j := 0; j < 3 && i < len(block) && block[i] >= '0' && block[i] <= '7'; j++ {
+					value = value*8 + int(block[i]-'0')
+					i++
+				}
+				i--
+				literal = append(literal, byte(value))
+			default:
+				literal = append(literal, block[i])
+			}
+		case '(':
+			depth++
+			literal = append(literal, c)
+		case ')':
+			depth--
+			if depth == 0 {
+				return literal, i
+			}
+			literal = append(literal, c)
+		default:
+			literal = append(literal, c)
+		}
+	}
+	return literal, i
+}
+
+// indexFile updates searchable text of a file after its content or metadata changed.
+// Content of encrypted files is never indexed, the index would keep it in plain text
+func (app *App) indexFile(fileId string) {
+	metadata, err := app.Backend.GetFileMetadata(fileId)
+	if err != nil {
+		log.Printf("Failed to index file %s: %v", fileId, err)
+		return
+	}
+
+	userMetadata := slices.Sorted(maps.Keys(metadata.UserMetadata))
+	for _, key := range slices.Clone(userMetadata) {
+		userMetadata = append(userMetadata, metadata.UserMetadata[key])
+	}
+	document := backends.SearchDocument{
+		FileId:   fileId,
+		Filename: backends.SearchText(metadata.Filename + metadata.Extension),
+		Metadata: backends.SearchText(strings.Join(append(userMetadata, metadata.Tags...), " ")),
+	}
+
+	encrypted := metadata.KeyId != "" || metadata.KeyFingerprint != ""
+	if !encrypted && metadata.Size <= maxIndexedFileSize {
+		result, err := app.Backend.GetFile(fileId)
+		if err == nil {
+			var data []byte
+			data, err = decompress(result.File, metadata.Compression)
+			document.Content = backends.SearchText(extractText(metadata, data))
+		}
+		if err != nil {
+			log.Printf("Failed to read content of file %s for indexing: %v", fileId, err)
+		}
+	}
+
+	err = app.Backend.IndexFile(document)
+	if err != nil {
+		log.Printf("Failed to index file %s: %v", fileId, err)
+	}
+}
+
+func (app *App) SearchHandler(writer http.ResponseWriter, request *http.Request) {
+	values := request.URL.Query()
+	text := values.Get("q")
+	if strings.TrimSpace(text) == "" {
+		utils.WriteResponseStatusCode(models.Error{Detail: "expected search query q"}, http.StatusBadRequest, writer)
+		return
+	}
+	result, err := app.Backend.SearchFiles(backends.SearchQuery{
+		Text:     text,
+		Page:     max(convertToIntWithDefaultMax(values.Get("page"), 1, 0), 1),
+		PageSize: max(convertToIntWithDefaultMax(values.Get("pageSize"), maxFilesPerPage, maxFilesPerPage), 1),
+	})
+	if err != nil {
+		handleBackendError(writer, err)
+		return
+	}
+	utils.WriteJsonResponse(result, writer)
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"hybrid-storage/handlers"
 	fileHandlers "hybrid-storage/handlers/backends"
+	"hybrid-storage/models"
+	"hybrid-storage/utils"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/rs/cors"
@@ -36,43 +39,205 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+func newBackend(name string) fileHandlers.FileServerBackend {
+	// identical chunks are stored once when dedup is enabled
+	dedup := utils.GetEnvBool("DEDUP", false)
+	switch name {
+	case "sqlite":
+		sqliteBackend, err := fileHandlers.NewSQLiteBackend("test.db")
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Connected to SQLite")
+		sqliteBackend.Dedup = dedup
+		return sqliteBackend
+	case "postgres":
+		postgresBackend, err := fileHandlers.NewPostgresBackend("localhost", 5432, "postgres", "password", "postgres", "disable")
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Connected to Postgres")
+		postgresBackend.Dedup = dedup
+		return postgresBackend
+	case "mongodb", "mongo":
+		mongoDbBackend, err := fileHandlers.NewMongoDBBackend("mongodb://localhost:27017", "test")
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Connected to MongoDB")
+		mongoDbBackend.Dedup = dedup
+		return mongoDbBackend
+	default:
+		log.Println("Unknown backend specified, defaulting to filesystem")
+		// stored layout is kept unless FS_SHARD_LEVELS is set
+		fileSystemBackend, err := fileHandlers.NewFileSystemBackend(int(utils.GetEnvInt64("FS_SHARD_LEVELS", -1)))
+		if err != nil {
+			panic(err)
+		}
+		fileSystemBackend.Dedup = dedup
+		// changes interrupted by a crash are rolled back before serving
+		recovered, err := fileSystemBackend.Recover()
+		if err != nil {
+			panic(err)
+		}
+		if recovered > 0 {
+			log.Printf("Recovered %d interrupted file changes", recovered)
+		}
+		return fileSystemBackend
+	}
+}
+
 func determineBackendFromArgs(args []string) fileHandlers.FileServerBackend {
-	var backend fileHandlers.FileServerBackend
 	if len(args) > 1 {
-		switch args[1] {
-		case "sqlite":
-			sqliteBackend, err := fileHandlers.NewSQLiteBackend("test.db")
-			if err != nil {
-				panic(err)
-			}
-			log.Println("Connected to SQLite")
-			backend = sqliteBackend
-		case "postgres":
-			postgresBackend, err := fileHandlers.NewPostgresBackend("localhost", 5432, "postgres", "password", "postgres", "disable")
-			if err != nil {
-				panic(err)
-			}
-			log.Println("Connected to Postgres")
-			backend = postgresBackend
-		case "mongodb", "mongo":
-			mongoDbBackend, err := fileHandlers.NewMongoDBBackend("mongodb://localhost:27017", "test")
-			if err != nil {
-				panic(err)
-			}
-			log.Println("Connected to MongoDB")
-			backend = mongoDbBackend
-		default:
-			log.Println("Unknown backend specified, defaulting to filesystem")
-			backend = fileHandlers.FileSystemBackend{}
+		return newBackend(args[1])
+	}
+	log.Println("No backend specified, defaulting to filesystem")
+	return newBackend("filesystem")
+}
+
+// determinePeers opens backends listed in COPY_BACKENDS, files can be copied
+// and moved to them. Peers share configuration of the main app
+func determinePeers(app *handlers.App, primary string) map[string]*handlers.App {
+	peers := map[string]*handlers.App{}
+	for _, name := range strings.Split(utils.GetEnvString("COPY_BACKENDS", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == primary {
+			continue
+		}
+		backend := newBackend(name)
+		quotas := handlers.NewQuotaTracker(determineQuotaConfig())
+		err := quotas.Load(backend)
+		if err != nil {
+			log.Println("Could not load quota usage:", err.Error())
+		}
+		peers[name] = &handlers.App{
+			Backend:   backend,
+			Config:    app.Config,
+			Quotas:    quotas,
+			Retention: app.Retention,
+			Keys:      app.Keys,
+		}
+		peers[name].StartPurger()
+	}
+	return peers
+}
+
+func determineQuotaConfig() handlers.QuotaConfig {
+	quotaConfig := handlers.QuotaConfig{
+		Tenant: handlers.QuotaLimit{
+			MaxBytes: utils.GetEnvInt64("QUOTA_TENANT_MAX_BYTES", 0),
+			MaxFiles: utils.GetEnvInt64("QUOTA_TENANT_MAX_FILES", 0),
+		},
+		User: handlers.QuotaLimit{
+			MaxBytes: utils.GetEnvInt64("QUOTA_USER_MAX_BYTES", 0),
+			MaxFiles: utils.GetEnvInt64("QUOTA_USER_MAX_FILES", 0),
+		},
+	}
+	// per tenant and per user overrides come from a json file, defaults it does not set stay as in the environment
+	configPath := utils.GetEnvString("QUOTA_CONFIG", "")
+	if configPath != "" {
+		var err error
+		quotaConfig, err = handlers.LoadQuotaConfig(configPath, quotaConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return quotaConfig
+}
+
+func determineRateLimitConfig() handlers.RateLimitConfig {
+	rateLimitConfig := handlers.RateLimitConfig{
+		Default: handlers.RouteLimit{
+			RequestsPerSecond:      float64(utils.GetEnvInt64("RATE_LIMIT_RPS", 0)),
+			Burst:                  int(utils.GetEnvInt64("RATE_LIMIT_BURST", 1)),
+			UploadBytesPerSecond:   utils.GetEnvInt64("RATE_LIMIT_UPLOAD_BPS", 0),
+			DownloadBytesPerSecond: utils.GetEnvInt64("RATE_LIMIT_DOWNLOAD_BPS", 0),
+		},
+		GlobalUploadBytesPerSecond:   utils.GetEnvInt64("RATE_LIMIT_GLOBAL_UPLOAD_BPS", 0),
+		GlobalDownloadBytesPerSecond: utils.GetEnvInt64("RATE_LIMIT_GLOBAL_DOWNLOAD_BPS", 0),
+	}
+	// per route limits come from a json file, limits it does not set stay as in the environment
+	configPath := utils.GetEnvString("RATE_LIMIT_CONFIG", "")
+	if configPath != "" {
+		var err error
+		rateLimitConfig, err = handlers.LoadRateLimitConfig(configPath, rateLimitConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return rateLimitConfig
+}
+
+func determineAuthenticator() *handlers.Authenticator {
+	var keys map[string]models.Principal
+	keysPath := utils.GetEnvString("API_KEYS_FILE", "")
+	if keysPath != "" {
+		var err error
+		keys, err = handlers.LoadApiKeys(keysPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// tenant and user headers are trusted only behind a gateway that authenticates clients
+	return handlers.NewAuthenticator(keys, utils.GetEnvBool("TRUST_PRINCIPAL_HEADERS", false))
+}
+
+func determineRetentionConfig() handlers.RetentionConfig {
+	var retentionConfig handlers.RetentionConfig
+	configPath := utils.GetEnvString("RETENTION_CONFIG", "")
+	if configPath != "" {
+		fileConfig, err := handlers.LoadRetentionConfig(configPath)
+		if err != nil {
+			panic(err)
 		}
-	} else {
-		log.Println("No backend specified, defaulting to filesystem")
-		backend = fileHandlers.FileSystemBackend{}
+		retentionConfig = fileConfig
+	}
+	return retentionConfig
+}
+
+func determineCompressionConfig() handlers.CompressionConfig {
+	compressionConfig := handlers.CompressionConfig{
+		Codec:       utils.GetEnvString("COMPRESSION", ""),
+		Passthrough: utils.GetEnvBool("COMPRESSION_PASSTHROUGH", true),
 	}
-	return backend
+	switch compressionConfig.Codec {
+	case "", handlers.CompressionGzip, handlers.CompressionZstd:
+	default:
+		panic(fmt.Errorf("unknown compression %q, expected gzip or zstd", compressionConfig.Codec))
+	}
+	return compressionConfig
+}
+
+func determineKeyRing() *handlers.KeyRing {
+	// encryption at rest is enabled by a master keyfile
+	keyFilePath := utils.GetEnvString("MASTER_KEY_FILE", "")
+	if keyFilePath == "" {
+		return nil
+	}
+	keyRing, err := handlers.LoadKeyRing(keyFilePath)
+	if err != nil {
+		panic(err)
+	}
+	return keyRing
+}
+
+// migrateLayout moves stored files into shard directories of FS_SHARD_LEVELS,
+// the server must be stopped meanwhile
+func migrateLayout() {
+	levels := int(utils.GetEnvInt64("FS_SHARD_LEVELS", fileHandlers.DEFAULT_SHARD_LEVELS))
+	moved, err := fileHandlers.MigrateLayout(levels)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Moved %d files to layout with %d shard levels", moved, levels)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-layout" {
+		migrateLayout()
+		return
+	}
+
 	portServe := ":8008"
 	fmt.Println("Starting server on http://localhost" + portServe)
 
@@ -82,25 +247,109 @@ func main() {
 	handler := http.NewServeMux()
 	handler.HandleFunc("GET /", handlers.Root)
 
+	quotas := handlers.NewQuotaTracker(determineQuotaConfig())
+	err := quotas.Load(backend)
+	if err != nil {
+		log.Println("Could not load quota usage:", err.Error())
+	}
+
 	// handlers for files
-	app := handlers.App{Backend: backend, Config: handlers.AppConfig{MaxChunkSize: 5 * 1024 * 1024}}
-	handler.HandleFunc("POST /files", app.UploadFileHandler)
-	handler.HandleFunc("GET /files", app.GetAllFilesHandler)
-	handler.HandleFunc("GET /files/{id}", app.GetFileHandler)
-	handler.HandleFunc("PUT /files/{id}", app.UpdateFileHandler)
-	handler.HandleFunc("DELETE /files/{id}", app.DeleteFileHandler)
+	app := handlers.App{
+		Backend: backend,
+		Config: handlers.AppConfig{
+			MaxChunkSize:   5 * 1024 * 1024,
+			TrashRetention: time.Duration(utils.GetEnvInt64("TRASH_RETENTION_SECONDS", 7*24*60*60)) * time.Second,
+			PurgeInterval:  time.Duration(utils.GetEnvInt64("PURGE_INTERVAL_SECONDS", 60*60)) * time.Second,
+			AdminToken:     utils.GetEnvString("ADMIN_TOKEN", ""),
+			Compression:    determineCompressionConfig(),
+			Archive: handlers.ArchiveConfig{
+				MaxEntries:       utils.GetEnvInt64("ARCHIVE_MAX_ENTRIES", 1000),
+				MaxExtractedSize: utils.GetEnvInt64("ARCHIVE_MAX_EXTRACTED_BYTES", 1024*1024*1024),
+			},
+		},
+		Quotas:    quotas,
+		Retention: handlers.NewRetentionPolicy(determineRetentionConfig()),
+		Keys:      determineKeyRing(),
+	}
+	primary := "filesystem"
+	if len(os.Args) > 1 {
+		primary = os.Args[1]
+	}
+	app.Peers = determinePeers(&app, primary)
+	app.StartPurger()
+	// every route goes through its own rate limits
+	limiter := handlers.NewRateLimiter(determineRateLimitConfig())
+	handle := func(route string, handlerFunc http.HandlerFunc) {
+		handler.HandleFunc(route, limiter.Limit(route, handlerFunc))
+	}
+
+	handle("POST /files", app.UploadFileHandler)
+	handle("GET /files", app.GetAllFilesHandler)
+	handle("GET /search", app.SearchHandler)
+	handle("GET /archive", app.GetArchiveHandler)
+	handle("POST /files/batch", app.BatchHandler)
+	handle("GET /files/{id}", app.GetFileHandler)
+	handle("PUT /files/{id}", app.UpdateFileHandler)
+	handle("DELETE /files/{id}", app.DeleteFileHandler)
+
+	// handlers for trash
+	handle("GET /trash", app.GetTrashHandler)
+	handle("POST /files/{id}/undelete", app.UndeleteFileHandler)
 
 	// handlers for metadata
-	handler.HandleFunc("GET /files/{id}/metadata", app.GetFileMetadataHandler)
+	handle("GET /files/{id}/metadata", app.GetFileMetadataHandler)
+
+	// handlers for copy and move
+	handle("POST /files/{id}/copy", app.CopyFileHandler)
+	handle("POST /files/{id}/move", app.MoveFileHandler)
+
+	// handlers for folders
+	handle("POST /folders", app.CreateFolderHandler)
+	handle("GET /folders/{id}", app.GetFolderHandler)
+	handle("PUT /folders/{id}", app.UpdateFolderHandler)
+	handle("DELETE /folders/{id}", app.DeleteFolderHandler)
+	handle("GET /folders/{id}/children", app.GetFolderChildrenHandler)
+	handle("GET /fs/{path...}", app.GetFileByPathHandler)
+
+	// handlers for versions
+	handle("GET /files/{id}/versions", app.GetFileVersionsHandler)
+	handle("POST /files/{id}/versions/{version}/restore", app.RestoreFileVersionHandler)
+
+	// handlers for retention
+	handle("GET /files/{id}/retention", app.GetRetentionHandler)
+	handle("PUT /files/{id}/retention", app.UpdateRetentionHandler)
+
+	// handlers for encryption
+	handle("POST /admin/keys/rotate", app.RotateKeyHandler)
+
+	// handlers for quotas
+	handle("GET /usage", app.GetUsageHandler)
 
 	corsConfig := cors.New(cors.Options{
-		AllowedHeaders:   []string{"Origin", "Authorization", "Accept", "Content-Type"},
+		AllowedHeaders: []string{
+			"Origin",
+			"Authorization",
+			"Accept",
+			"Content-Type",
+			utils.TenantHeader,
+			utils.UserHeader,
+			handlers.ApiKeyHeader,
+			handlers.AdminTokenHeader,
+			handlers.CustomerAlgorithmHeader,
+			handlers.CustomerKeyHeader,
+			handlers.CustomerKeyHashHeader,
+			"If-Match",
+			"If-None-Match",
+			"If-Modified-Since",
+			"If-Unmodified-Since",
+		},
+		ExposedHeaders:   []string{"Retry-After", "Content-Encoding", "ETag", "Last-Modified"},
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE", "PUT"},
 		AllowCredentials: true,
 	})
 
-	loggingHandler := LoggingMiddleware(handler)
+	loggingHandler := LoggingMiddleware(determineAuthenticator().Authenticate(handler))
 	corsHandler := corsConfig.Handler(loggingHandler)
 
 	http.ListenAndServe(
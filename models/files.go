@@ -1,9 +1,101 @@
 package models
 
 type FileMetadata struct {
+	FileId    string `json:"fileId" bson:"fileId"`
+	Filename  string `json:"filename" bson:"filename"`
+	Extension string `json:"extension" bson:"extension"`
+	Tenant    string `json:"tenant" bson:"tenant"`
+	Owner     string `json:"owner" bson:"owner"`
+	Size      int64  `json:"size" bson:"size"`
+	Version   int64  `json:"version" bson:"version"`
+	// incremented by every change of the file, updates compare it to the expected one
+	Revision  int64 `json:"revision" bson:"revision"`
+	CreatedAt int64 `json:"createdAt" bson:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt" bson:"updatedAt"`
+	DeletedAt int64 `json:"deletedAt" bson:"deletedAt"`
+	ExpiresAt int64 `json:"expiresAt" bson:"expiresAt"`
+	// file can not be deleted or overwritten while on hold or until RetainUntil
+	LegalHold   bool  `json:"legalHold" bson:"legalHold"`
+	RetainUntil int64 `json:"retainUntil" bson:"retainUntil"`
+	// codec of stored chunks, empty if stored as is
+	Compression string `json:"compression" bson:"compression"`
+	// data key of the file wrapped by master key KeyId, empty if stored unencrypted.
+	// Key fields are never sent to clients, StoredMetadata keeps them in json
+	KeyId      string `json:"-" bson:"keyId"`
+	WrappedKey string `json:"-" bson:"wrappedKey"`
+	// fingerprint of a customer supplied key, the key itself is never stored
+	KeyFingerprint string `json:"-" bson:"keyFingerprint"`
+	// user defined key/value pairs and tags
+	UserMetadata map[string]string `json:"userMetadata" bson:"userMetadata"`
+	Tags         []string          `json:"tags" bson:"tags"`
+	// folder containing the file, empty for the root folder
+	FolderId string `json:"folderId" bson:"folderId"`
+}
+
+// StoredMetadata is metadata with its key fields, the way it is written to json
+// stored by the server or passed to a backend with the first chunk of a file
+type StoredMetadata struct {
+	FileMetadata
+	KeyId          string `json:"keyId"`
+	WrappedKey     string `json:"wrappedKey"`
+	KeyFingerprint string `json:"keyFingerprint"`
+}
+
+// NewStoredMetadata returns nil for nil metadata
+func NewStoredMetadata(metadata *FileMetadata) *StoredMetadata {
+	if metadata == nil {
+		return nil
+	}
+	return &StoredMetadata{
+		FileMetadata:   *metadata,
+		KeyId:          metadata.KeyId,
+		WrappedKey:     metadata.WrappedKey,
+		KeyFingerprint: metadata.KeyFingerprint,
+	}
+}
+
+// Metadata returns nil for nil stored metadata
+func (stored *StoredMetadata) Metadata() *FileMetadata {
+	if stored == nil {
+		return nil
+	}
+	metadata := stored.FileMetadata
+	metadata.KeyId = stored.KeyId
+	metadata.WrappedKey = stored.WrappedKey
+	metadata.KeyFingerprint = stored.KeyFingerprint
+	return &metadata
+}
+
+type FileVersion struct {
+	FileId    string `json:"fileId" bson:"fileId"`
+	Version   int64  `json:"version" bson:"version"`
+	Size      int64  `json:"size" bson:"size"`
+	CreatedAt int64  `json:"createdAt" bson:"createdAt"`
+	// last chunk written to the version
+	UpdatedAt int64 `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	// upload of the version is not finished yet, it can not be downloaded or restored
+	Pending bool `json:"pending,omitempty" bson:"pending,omitempty"`
+}
+
+type Retention struct {
 	FileId    string `json:"fileId"`
-	Filename  string `json:"filename"`
-	Extension string `json:"extension"`
-	CreatedAt int64  `json:"createdAt"`
-	UpdatedAt int64  `json:"updatedAt"`
+	LegalHold bool   `json:"legalHold"`
+	// effective retention, includes retention rules
+	RetainUntil int64 `json:"retainUntil"`
+}
+
+type RetentionUpdate struct {
+	LegalHold   *bool  `json:"legalHold"`
+	RetainUntil *int64 `json:"retainUntil"`
+}
+
+type KeyRotation struct {
+	KeyId     string `json:"keyId"`
+	Rewrapped int64  `json:"rewrapped"`
+}
+
+// SearchResult is file metadata with relevance of the file to a search query
+type SearchResult struct {
+	FileMetadata `bson:",inline"`
+	Score        float64 `json:"score" bson:"score"`
 }
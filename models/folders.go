@@ -0,0 +1,16 @@
+package models
+
+// Folder is a virtual directory, files and folders refer to their parent by id
+// and an empty ParentId is the root
+type Folder struct {
+	FolderId  string `json:"folderId" bson:"folderId"`
+	Name      string `json:"name" bson:"name"`
+	ParentId  string `json:"parentId" bson:"parentId"`
+	CreatedAt int64  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt" bson:"updatedAt"`
+}
+
+type FolderUpdate struct {
+	Name     string  `json:"name"`
+	ParentId *string `json:"parentId"`
+}
@@ -0,0 +1,20 @@
+package models
+
+type Principal struct {
+	Tenant string `json:"tenant"`
+	User   string `json:"user"`
+}
+
+type QuotaUsage struct {
+	Bytes    int64 `json:"bytes"`
+	Files    int64 `json:"files"`
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int64 `json:"maxFiles"`
+}
+
+type Usage struct {
+	Tenant      string     `json:"tenant"`
+	User        string     `json:"user"`
+	TenantUsage QuotaUsage `json:"tenantUsage"`
+	UserUsage   QuotaUsage `json:"userUsage"`
+}
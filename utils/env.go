@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+func GetEnvString(key string, defaultValue string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+	return value
+}
+
+func GetEnvInt64(key string, defaultValue int64) int64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return intValue
+}
+
+func GetEnvBool(key string, defaultValue bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %t", key, value, defaultValue)
+		return defaultValue
+	}
+	return boolValue
+}
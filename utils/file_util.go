@@ -1,10 +1,33 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"hybrid-storage/models"
 	"net/http"
 )
 
+// RequestError reports invalid input of a request, handlers answer it with 400.
+// utils can not depend on backends, so FileServerError is not used here
+type RequestError struct {
+	Detail string
+}
+
+func (e *RequestError) Error() string {
+	return e.Detail
+}
+
+func requestError(format string, args ...any) error {
+	return &RequestError{Detail: fmt.Sprintf(format, args...)}
+}
+
+const (
+	TenantHeader  = "X-Tenant-Id"
+	UserHeader    = "X-User-Id"
+	DefaultTenant = "default"
+	DefaultUser   = "anonymous"
+)
+
 func GetFileId(request *http.Request) (string, error) {
 	fileId := request.PathValue("id")
 
@@ -14,3 +37,35 @@ func GetFileId(request *http.Request) (string, error) {
 
 	return fileId, nil
 }
+
+type principalKey struct{}
+
+// WithPrincipal returns the request carrying the principal it was authenticated as
+func WithPrincipal(request *http.Request, principal models.Principal) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), principalKey{}, principal))
+}
+
+// GetPrincipal returns the principal a request was authenticated as,
+// the default tenant and user when it was not authenticated
+func GetPrincipal(request *http.Request) models.Principal {
+	principal, ok := request.Context().Value(principalKey{}).(models.Principal)
+	if !ok {
+		return models.Principal{Tenant: DefaultTenant, User: DefaultUser}
+	}
+	return principal
+}
+
+// HeaderPrincipal reads tenant and user headers, they are trusted only when set by an authenticating gateway
+func HeaderPrincipal(request *http.Request) models.Principal {
+	principal := models.Principal{
+		Tenant: request.Header.Get(TenantHeader),
+		User:   request.Header.Get(UserHeader),
+	}
+	if principal.Tenant == "" {
+		principal.Tenant = DefaultTenant
+	}
+	if principal.User == "" {
+		principal.User = DefaultUser
+	}
+	return principal
+}
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"hybrid-storage/models"
+	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
@@ -16,6 +18,7 @@ type ChunkResult struct {
 	FormDataChunk multipart.File
 	ChunkNumber   int
 	FileId        string
+	Size          int64
 	IsLastChunk   bool
 	JsonData      []byte
 }
@@ -29,7 +32,7 @@ func ReadFileInChunks(writer http.ResponseWriter, request *http.Request, fileId
 		return ChunkResult{}, fmt.Errorf("file chunk is too large, limit is %v MB", maxChunkSize/(1024*1024))
 	}
 
-	fileChunk, _, err := request.FormFile("file")
+	fileChunk, fileHeader, err := request.FormFile("file")
 	if err != nil {
 		return ChunkResult{}, errors.New("error reading file")
 	}
@@ -47,16 +50,31 @@ func ReadFileInChunks(writer http.ResponseWriter, request *http.Request, fileId
 	}
 	log.Printf("Chunk %s/%s for file %s uploaded successfully", chunkNum, totalChunks, fileId)
 
+	expiresAt, err := readExpiresAt(request)
+	if err != nil {
+		return ChunkResult{}, err
+	}
+	userMetadata, tags, err := readUserMetadata(request)
+	if err != nil {
+		return ChunkResult{}, err
+	}
+
+	principal := GetPrincipal(request)
 	timeNow := time.Now().UTC().Unix()
 	filename := filepath.Base(filenameFormValue)
 	extension := filepath.Ext(filenameFormValue)
 	jsonData := GetJsonData(
 		models.FileMetadata{
-			FileId:    fileId,
-			Filename:  filename[:len(filename)-len(extension)],
-			Extension: extension,
-			CreatedAt: timeNow,
-			UpdatedAt: timeNow,
+			FileId:       fileId,
+			Filename:     filename[:len(filename)-len(extension)],
+			Extension:    extension,
+			Tenant:       principal.Tenant,
+			Owner:        principal.User,
+			CreatedAt:    timeNow,
+			UpdatedAt:    timeNow,
+			ExpiresAt:    expiresAt,
+			UserMetadata: userMetadata,
+			Tags:         tags,
 		},
 	)
 
@@ -65,19 +83,49 @@ func ReadFileInChunks(writer http.ResponseWriter, request *http.Request, fileId
 		ChunkNumber:   chunkNumInt,
 		IsLastChunk:   chunkNum == totalChunks,
 		FileId:        fileId,
+		Size:          fileHeader.Size,
 		JsonData:      jsonData,
 	}, nil
 }
 
-func ReadChunkBytes(chunk ChunkResult) []byte {
-	bytes := make([]byte, 0)
-	for {
-		currentBytes := make([]byte, 1024)
-		_, err := chunk.FormDataChunk.Read(currentBytes)
+// readExpiresAt reads expiry of a file either as "expiresAt" unix time or as "ttl" in seconds
+func readExpiresAt(request *http.Request) (int64, error) {
+	expiresAt := request.FormValue("expiresAt")
+	ttl := request.FormValue("ttl")
+	if expiresAt != "" {
+		expiresAtInt, err := strconv.ParseInt(expiresAt, 10, 64)
 		if err != nil {
-			break
+			return 0, requestError("expected int for expiresAt")
+		}
+		return expiresAtInt, nil
+	}
+	if ttl != "" {
+		ttlInt, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || ttlInt <= 0 {
+			return 0, requestError("expected positive int for ttl")
 		}
-		bytes = append(bytes, currentBytes...)
+		return time.Now().Unix() + ttlInt, nil
+	}
+	return 0, nil
+}
+
+// memoryChunk holds chunk data that was transformed after the form was read
+type memoryChunk struct {
+	*bytes.Reader
+}
+
+func (memoryChunk) Close() error {
+	return nil
+}
+
+func NewMemoryChunk(data []byte) multipart.File {
+	return memoryChunk{bytes.NewReader(data)}
+}
+
+func ReadChunkBytes(chunk ChunkResult) []byte {
+	bytes, err := io.ReadAll(chunk.FormDataChunk)
+	if err != nil {
+		log.Printf("Error reading chunk %d of %s: %v", chunk.ChunkNumber, chunk.FileId, err)
 	}
 	return bytes
 }
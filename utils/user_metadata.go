@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	maxUserMetadataEntries = 64
+	maxUserMetadataKey     = 128
+	maxUserMetadataValue   = 2048
+	maxTags                = 64
+	maxTagLength           = 128
+)
+
+// ValidateUserMetadata checks limits of user defined key/value metadata
+func ValidateUserMetadata(userMetadata map[string]string) error {
+	if len(userMetadata) > maxUserMetadataEntries {
+		return requestError("at most %d user metadata entries are allowed", maxUserMetadataEntries)
+	}
+	for key, value := range userMetadata {
+		if key == "" || len(key) > maxUserMetadataKey {
+			return requestError("user metadata keys must be 1 to %d bytes long", maxUserMetadataKey)
+		}
+		if len(value) > maxUserMetadataValue {
+			return requestError("user metadata value of %q is longer than %d bytes", key, maxUserMetadataValue)
+		}
+	}
+	return nil
+}
+
+// NormalizeTags trims, deduplicates and sorts tags, empty tags are dropped
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, requestError("tags must be at most %d bytes long", maxTagLength)
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > maxTags {
+		return nil, requestError("at most %d tags are allowed", maxTags)
+	}
+	return normalized, nil
+}
+
+// readUserMetadata reads "userMetadata" form value as a json object
+// and "tags" form values as comma separated lists
+func readUserMetadata(request *http.Request) (map[string]string, []string, error) {
+	userMetadata := map[string]string{}
+	userMetadataValue := request.FormValue("userMetadata")
+	if userMetadataValue != "" {
+		err := json.Unmarshal([]byte(userMetadataValue), &userMetadata)
+		if err != nil {
+			return nil, nil, requestError("expected json object of strings for userMetadata")
+		}
+		err = ValidateUserMetadata(userMetadata)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var tags []string
+	for _, tagsValue := range request.Form["tags"] {
+		tags = append(tags, strings.Split(tagsValue, ",")...)
+	}
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userMetadata, tags, nil
+}